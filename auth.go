@@ -0,0 +1,440 @@
+package postgresql
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/backstage-app/postgresql/pgwire"
+)
+
+// AuthMethod is the method Proxy authenticates clients with. The names are the same as in pg_hba.conf.
+type AuthMethod string
+
+const (
+	// AuthSCRAMSHA256 is SCRAM-SHA-256 authentication. Clients whose secret is an md5 hash
+	// fall back to AuthMD5.
+	AuthSCRAMSHA256 AuthMethod = "scram-sha-256"
+	// AuthMD5 is md5 password authentication. Clients whose secret is a SCRAM verifier
+	// are authenticated with AuthSCRAMSHA256 instead.
+	AuthMD5 AuthMethod = "md5"
+	// AuthPassword is cleartext password authentication. It should be used only along with TLS.
+	AuthPassword AuthMethod = "password"
+)
+
+// CredentialStore provides the credentials Proxy authenticates clients and itself with.
+type CredentialStore interface {
+	// Credentials returns the credentials of user connecting to database.
+	// It returns nil if the user is unknown.
+	Credentials(user, database string) (*Credentials, error)
+}
+
+// Credentials are the secrets of a single user.
+type Credentials struct {
+	// Password is the secret the client authenticates with. It's either the password itself,
+	// its md5 hash ("md5" followed by md5 of the password and the user name) or SCRAM-SHA-256 verifier
+	// in the format of pg_authid. The hashes don't let clients authenticate with all methods:
+	// md5 hash doesn't work with SCRAM-SHA-256 and SCRAM verifier doesn't work with md5.
+	Password string
+	// TargetUser and TargetPassword are what Proxy authenticates to the target with.
+	// TargetUser defaults to the user the client connected as.
+	TargetUser     string
+	TargetPassword string
+}
+
+// CredentialMap is CredentialStore which maps user names to their credentials for all databases.
+type CredentialMap map[string]*Credentials
+
+func (m CredentialMap) Credentials(user, database string) (*Credentials, error) {
+	return m[user], nil
+}
+
+// maxAuthMessageLen is the limit of messages exchanged during authentication.
+const maxAuthMessageLen = 10000
+
+// errRejected is the error Proxy rejects the client with if its credentials are invalid.
+var errRejected = errors.New("postgresql: authentication failed")
+
+// authentication is the outcome of successful client authentication.
+type authentication struct {
+	startup     *startupMessage
+	credentials *Credentials
+	// method is the code of Authentication message which requested the credentials.
+	method uint32
+}
+
+// authenticateClient reads StartupMessage from the client and authenticates it with the credentials
+// from the store set by Proxy.Authenticate. It returns nil authentication for CancelRequest,
+// which is left unread, because it has to be passed to the target as is.
+func (p *Proxy) authenticateClient(conn *proxyConn) (*authentication, error) {
+	client := conn.client
+	msg, err := readStartupMessage(client)
+	if err != nil {
+		return nil, fmt.Errorf("postgresql.Proxy.authenticateClient: %w", err)
+	}
+	if isCancelRequestMessage(msg) {
+		conn.setClient(&readerConn{Conn: client, r: io.MultiReader(bytes.NewReader(msg), client)})
+		return nil, nil
+	}
+	if !isStartupMessage(msg) {
+		_, _ = client.Write(encodeErrorResponse("FATAL", "0A000", "unsupported frontend protocol"))
+		return nil, fmt.Errorf("postgresql.Proxy.authenticateClient: unsupported startup message")
+	}
+	startup, err := decodeStartupMessage(msg)
+	if err != nil {
+		return nil, fmt.Errorf("postgresql.Proxy.authenticateClient: %w", err)
+	}
+	conn.session.frontend([]interface{}{startup})
+
+	user := startup.params["user"]
+	if user == "" {
+		p.rejectClient(conn, 0, encodeErrorResponse("FATAL", "28000", "no PostgreSQL user name specified in startup packet"))
+		return nil, fmt.Errorf("postgresql.Proxy.authenticateClient: %w", errRejected)
+	}
+	database := startup.params["database"]
+	if database == "" {
+		database = user
+	}
+	credentials, err := p.credentials.Credentials(user, database)
+	if err != nil {
+		p.rejectClient(conn, 0, encodeErrorResponse("FATAL", "XX000", "could not look up credentials"))
+		return nil, fmt.Errorf("postgresql.Proxy.authenticateClient: %w", err)
+	}
+
+	method, err := p.verifyClient(client, user, credentials)
+	if err != nil {
+		p.rejectClient(conn, method, encodeErrorResponse("FATAL", "28P01",
+			fmt.Sprintf("password authentication failed for user %q", user)))
+		return nil, fmt.Errorf("postgresql.Proxy.authenticateClient: %w", err)
+	}
+	return &authentication{startup: startup, credentials: credentials, method: method}, nil
+}
+
+// verifyClient requests the password from the client and verifies it. Unknown users are asked
+// for the password as well, so that the client can't tell them from the known ones.
+// It returns the code of Authentication message the password was requested with.
+func (p *Proxy) verifyClient(client net.Conn, user string, credentials *Credentials) (uint32, error) {
+	secret := ""
+	if credentials != nil {
+		secret = credentials.Password
+	}
+	// Backend doesn't let users with empty passwords in either.
+	known := secret != ""
+	verifier, isVerifier := parseSCRAMVerifier(secret)
+	isMD5 := len(secret) == 35 && strings.HasPrefix(secret, "md5")
+
+	method := p.authMethod
+	switch {
+	case method == AuthSCRAMSHA256 && isMD5:
+		method = AuthMD5
+	case method == AuthMD5 && isVerifier:
+		method = AuthSCRAMSHA256
+	}
+
+	switch method {
+	case AuthSCRAMSHA256:
+		if !isVerifier {
+			salt := make([]byte, 16)
+			if _, err := rand.Read(salt); err != nil {
+				return 0, err
+			}
+			verifier = newSCRAMVerifier(secret, salt, scramIterations)
+		}
+		return authenticationSASL, p.verifySCRAM(client, verifier, known)
+	case AuthMD5:
+		salt := make([]byte, 4)
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		if _, err := client.Write(encodeAuthentication(authenticationMD5Password, salt)); err != nil {
+			return authenticationMD5Password, err
+		}
+		password, err := readPassword(client)
+		if err != nil {
+			return authenticationMD5Password, err
+		}
+		hash := secret
+		if !isMD5 {
+			hash = md5Password(secret, user)
+		}
+		expected := "md5" + md5Hex(hash[3:]+string(salt))
+		if !known || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+			return authenticationMD5Password, errRejected
+		}
+		return authenticationMD5Password, nil
+	case AuthPassword:
+		if _, err := client.Write(encodeAuthentication(authenticationCleartextPassword, nil)); err != nil {
+			return authenticationCleartextPassword, err
+		}
+		password, err := readPassword(client)
+		if err != nil {
+			return authenticationCleartextPassword, err
+		}
+		var ok bool
+		switch {
+		case isVerifier:
+			ok = verifier.verifyPassword(password)
+		case isMD5:
+			ok = subtle.ConstantTimeCompare([]byte(md5Password(password, user)), []byte(secret)) == 1
+		default:
+			ok = subtle.ConstantTimeCompare([]byte(password), []byte(secret)) == 1
+		}
+		if !known || !ok {
+			return authenticationCleartextPassword, errRejected
+		}
+		return authenticationCleartextPassword, nil
+	}
+	return 0, fmt.Errorf("unknown AuthMethod %q", p.authMethod)
+}
+
+// verifySCRAM runs SCRAM-SHA-256 exchange with the client. known is false if the user is unknown,
+// so the exchange must fail whatever the client sends.
+func (p *Proxy) verifySCRAM(client net.Conn, verifier *scramVerifier, known bool) error {
+	if _, err := client.Write(encodeAuthentication(authenticationSASL, []byte(scramMechanism+"\x00\x00"))); err != nil {
+		return err
+	}
+
+	msg, err := readMessage(client)
+	if err != nil {
+		return err
+	}
+	if !isPasswordMessage(msg) {
+		return fmt.Errorf("unexpected message %q instead of SASLInitialResponse", msg[0])
+	}
+	initial, err := decodeSASLInitialResponseMessage(msg)
+	if err != nil {
+		return err
+	}
+	if initial.mechanism != scramMechanism {
+		return fmt.Errorf("unsupported SASL mechanism %q", initial.mechanism)
+	}
+
+	nonce, err := scramNonce()
+	if err != nil {
+		return err
+	}
+	server := newSCRAMServer(verifier, nonce)
+	serverFirst, err := server.first(string(initial.data))
+	if err != nil {
+		return err
+	}
+	if _, err := client.Write(encodeAuthentication(authenticationSASLContinue, []byte(serverFirst))); err != nil {
+		return err
+	}
+
+	msg, err = readMessage(client)
+	if err != nil {
+		return err
+	}
+	if !isPasswordMessage(msg) {
+		return fmt.Errorf("unexpected message %q instead of SASLResponse", msg[0])
+	}
+	serverFinal, err := server.final(string(decodePasswordMessage(msg, false).data))
+	if err != nil {
+		return err
+	}
+	if !known {
+		return errRejected
+	}
+	_, err = client.Write(encodeAuthentication(authenticationSASLFinal, []byte(serverFinal)))
+	return err
+}
+
+// rejectClient sends ErrorResponse to the client and lets the session know about it.
+func (p *Proxy) rejectClient(conn *proxyConn, method uint32, msg []byte) {
+	_, _ = conn.client.Write(msg)
+	messages := []interface{}{decodeErrorMessage(msg)}
+	if method != 0 {
+		messages = append([]interface{}{&authenticationMessage{code: method}}, messages...)
+	}
+	conn.session.backend(messages)
+}
+
+// authenticateTarget starts the session on the target with the parameters of the client's StartupMessage
+// and authenticates with the target credentials. Once the target accepts them, the client gets
+// AuthenticationOk and the rest of the target stream is what follows AuthenticationOk.
+// If the target rejects the credentials, its ErrorResponse is passed to the client.
+func (p *Proxy) authenticateTarget(conn *proxyConn, auth *authentication) error {
+	params := make(map[string]string, len(auth.startup.params))
+	for name, value := range auth.startup.params {
+		params[name] = value
+	}
+	if auth.credentials.TargetUser != "" {
+		params["user"] = auth.credentials.TargetUser
+	}
+
+	rejection, err := loginTarget(conn.server, params, auth.credentials.TargetPassword)
+	if err != nil {
+		if rejection == nil {
+			rejection = encodeErrorResponse("FATAL", "08006", "could not authenticate to the target")
+		}
+		p.rejectClient(conn, auth.method, rejection)
+		return fmt.Errorf("postgresql.Proxy.authenticateTarget: %w", err)
+	}
+
+	if _, err := conn.client.Write(encodeAuthentication(authenticationOk, nil)); err != nil {
+		return fmt.Errorf("postgresql.Proxy.authenticateTarget: %w", err)
+	}
+	conn.session.backend([]interface{}{&authenticationMessage{code: auth.method}, &authenticationMessage{code: authenticationOk}})
+	return nil
+}
+
+// loginTarget starts the session on server with params and answers the authentication requests
+// with password. It returns once server sends AuthenticationOk. If server rejects the password,
+// rejection is its ErrorResponse.
+func loginTarget(server net.Conn, params map[string]string, password string) (rejection []byte, err error) {
+	if _, err := server.Write(encodeStartupMessage(params)); err != nil {
+		return nil, err
+	}
+
+	var scram *scramClient
+	// verified is true once the server proved it knows the password, which SCRAM requires before AuthenticationOk.
+	var verified bool
+	for {
+		msg, err := readMessage(server)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case isErrorMessage(msg):
+			return msg, decodeErrorMessage(msg).fields
+		case isNoticeMessage(msg):
+			continue
+		case !isAuthenticationMessage(msg):
+			return nil, fmt.Errorf("unexpected message %q", msg[0])
+		}
+
+		m := decodeAuthenticationMessage(msg)
+		var response []byte
+		switch m.code {
+		case authenticationOk:
+			if scram != nil && !verified {
+				return nil, errors.New("AuthenticationOk before the server signature was verified")
+			}
+			return nil, nil
+		case authenticationCleartextPassword:
+			response = encodePasswordMessage(password)
+		case authenticationMD5Password:
+			hash := md5Password(password, params["user"])
+			response = encodePasswordMessage("md5" + md5Hex(hash[3:]+string(m.data)))
+		case authenticationSASL:
+			supported := false
+			for _, mechanism := range decodeSASLMechanisms(m) {
+				supported = supported || mechanism == scramMechanism
+			}
+			if !supported {
+				return nil, errors.New("no supported SASL mechanism")
+			}
+			nonce, err := scramNonce()
+			if err != nil {
+				return nil, err
+			}
+			scram = newSCRAMClient("", password, nonce)
+			response = encodeSASLInitialResponse(scramMechanism, []byte(scram.first()))
+		case authenticationSASLContinue:
+			if scram == nil {
+				return nil, errors.New("unexpected AuthenticationSASLContinue")
+			}
+			clientFinal, err := scram.final(string(m.data))
+			if err != nil {
+				return nil, err
+			}
+			response = encodeMessage(passwordMessageType, []byte(clientFinal))
+		case authenticationSASLFinal:
+			if scram == nil {
+				return nil, errors.New("unexpected AuthenticationSASLFinal")
+			}
+			if err := scram.verify(string(m.data)); err != nil {
+				return nil, err
+			}
+			verified = true
+			continue
+		default:
+			return nil, fmt.Errorf("unsupported authentication request %d", m.code)
+		}
+
+		if _, err := server.Write(response); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readMessage reads a single typed message.
+func readMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, minPacketLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	pktLen := binary.BigEndian.Uint32(header[1:])
+	if pktLen < 4 || pktLen > maxAuthMessageLen {
+		return nil, errInvalidMessageLength
+	}
+	msg := make([]byte, pktLen+1)
+	copy(msg, header)
+	if _, err := io.ReadFull(r, msg[minPacketLen:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// readPassword reads PasswordMessage and returns the password.
+func readPassword(r io.Reader) (string, error) {
+	msg, err := readMessage(r)
+	if err != nil {
+		return "", err
+	}
+	if !isPasswordMessage(msg) {
+		return "", fmt.Errorf("unexpected message %q instead of PasswordMessage", msg[0])
+	}
+	return string(decodePasswordMessage(msg, true).data), nil
+}
+
+// md5Password returns the md5 hash of the password the way pg_authid stores it.
+func md5Password(password, user string) string {
+	return "md5" + md5Hex(password+user)
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// encodeMessage returns the message of type t with body.
+func encodeMessage(t byte, body []byte) []byte {
+	msg := make([]byte, minPacketLen, minPacketLen+len(body))
+	msg[0] = t
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(body)))
+	return append(msg, body...)
+}
+
+func encodeAuthentication(code uint32, data []byte) []byte {
+	body := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(body, code)
+	return encodeMessage(authenticationMessageType, append(body, data...))
+}
+
+func encodePasswordMessage(password string) []byte {
+	return (&pgwire.PasswordMessage{Password: password}).Encode(nil)
+}
+
+func encodeSASLInitialResponse(mechanism string, data []byte) []byte {
+	return (&pgwire.SASLInitialResponse{Mechanism: mechanism, Data: data}).Encode(nil)
+}
+
+func encodeErrorResponse(severity, code, message string) []byte {
+	return (&pgwire.ErrorResponse{Severity: severity, Code: code, Message: message}).Encode(nil)
+}
+
+// encodeStartupMessage returns StartupMessage of protocol 3.0 with params.
+func encodeStartupMessage(params map[string]string) []byte {
+	return (&pgwire.StartupMessage{ProtocolVersion: pgwire.ProtocolVersion30, Parameters: params}).Encode(nil)
+}
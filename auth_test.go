@@ -0,0 +1,281 @@
+package postgresql
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// startTestAuthBackend starts a backend which requests the password of user with the method
+// before it answers with AuthenticationOk and ReadyForQuery.
+func startTestAuthBackend(t *testing.T, method uint32, user, password string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				msg, err := readStartupMessage(conn)
+				if err != nil {
+					return
+				}
+				startup, err := decodeStartupMessage(msg)
+				if err != nil || startup.params["user"] != user {
+					_, _ = conn.Write(encodeErrorResponse("FATAL", "28000", "unexpected user"))
+					return
+				}
+				if err := verifyTestPassword(conn, method, user, password); err != nil {
+					_, _ = conn.Write(encodeErrorResponse("FATAL", "28P01", err.Error()))
+					return
+				}
+				_, _ = conn.Write(decodeHexStream(t, "5200000008000000005a0000000549"))
+				_, _ = io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() { _ = l.Close() })
+	return l
+}
+
+// verifyTestPassword plays the backend side of the authentication with the method.
+func verifyTestPassword(conn net.Conn, method uint32, user, password string) error {
+	switch method {
+	case authenticationCleartextPassword:
+		_, _ = conn.Write(encodeAuthentication(method, nil))
+		got, err := readPassword(conn)
+		if err != nil || got != password {
+			return errors.New("wrong password")
+		}
+	case authenticationMD5Password:
+		salt := []byte{1, 2, 3, 4}
+		_, _ = conn.Write(encodeAuthentication(method, salt))
+		got, err := readPassword(conn)
+		if err != nil || got != "md5"+md5Hex(md5Password(password, user)[3:]+string(salt)) {
+			return errors.New("wrong password")
+		}
+	case authenticationSASL:
+		_, _ = conn.Write(encodeAuthentication(method, []byte("SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00\x00")))
+		msg, err := readMessage(conn)
+		if err != nil {
+			return err
+		}
+		initial, err := decodeSASLInitialResponseMessage(msg)
+		if err != nil {
+			return err
+		}
+		server := newSCRAMServer(newSCRAMVerifier(password, []byte("salt"), scramIterations), "server-nonce")
+		serverFirst, err := server.first(string(initial.data))
+		if err != nil {
+			return err
+		}
+		_, _ = conn.Write(encodeAuthentication(authenticationSASLContinue, []byte(serverFirst)))
+		if msg, err = readMessage(conn); err != nil {
+			return err
+		}
+		serverFinal, err := server.final(string(decodePasswordMessage(msg, false).data))
+		if err != nil {
+			return err
+		}
+		_, _ = conn.Write(encodeAuthentication(authenticationSASLFinal, []byte(serverFinal)))
+	}
+	return nil
+}
+
+// authenticateTestClient starts the session as user and answers the authentication request
+// with the password. It returns PgError the session was rejected with.
+func authenticateTestClient(t *testing.T, addr, user, password string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(encodeStartupMessage(map[string]string{"user": user, "database": "d"})); err != nil {
+		t.Fatal(err)
+	}
+
+	var scram *scramClient
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isErrorMessage(msg) {
+			return decodeErrorMessage(msg).fields
+		}
+		if !isAuthenticationMessage(msg) {
+			t.Fatalf("unexpected message %q", msg[0])
+		}
+
+		m := decodeAuthenticationMessage(msg)
+		var response []byte
+		switch m.code {
+		case authenticationOk:
+			// ReadyForQuery comes from the target.
+			if msg, err := readMessage(conn); err != nil || !isReadyForQueryMessage(msg) {
+				t.Fatalf("ReadyForQuery expected, got %x, %v", msg, err)
+			}
+			return nil
+		case authenticationCleartextPassword:
+			response = encodePasswordMessage(password)
+		case authenticationMD5Password:
+			response = encodePasswordMessage("md5" + md5Hex(md5Password(password, user)[3:]+string(m.data)))
+		case authenticationSASL:
+			scram = newSCRAMClient("", password, "client-nonce")
+			response = encodeSASLInitialResponse(scramMechanism, []byte(scram.first()))
+		case authenticationSASLContinue:
+			clientFinal, err := scram.final(string(m.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			response = encodeMessage(passwordMessageType, []byte(clientFinal))
+		case authenticationSASLFinal:
+			if err := scram.verify(string(m.data)); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if _, err := conn.Write(response); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_Proxy_Authenticate(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	verifier := newSCRAMVerifier("secret", salt, scramIterations)
+	scramSecret := fmt.Sprintf("SCRAM-SHA-256$%d:%s$%s:%s", scramIterations,
+		base64.StdEncoding.EncodeToString(salt),
+		base64.StdEncoding.EncodeToString(verifier.storedKey),
+		base64.StdEncoding.EncodeToString(verifier.serverKey))
+
+	tests := []struct {
+		name       string
+		method     AuthMethod
+		secret     string
+		password   string
+		target     uint32
+		wantCode   string
+		wantMethod string
+	}{
+		{"SCRAM_Client_SCRAM_Target", AuthSCRAMSHA256, "secret", "secret", authenticationSASL, "", "scram-sha-256"},
+		{"SCRAM_Verifier_MD5_Target", AuthSCRAMSHA256, scramSecret, "secret", authenticationMD5Password, "", "scram-sha-256"},
+		{"SCRAM_Wrong_Password", AuthSCRAMSHA256, "secret", "wrong", authenticationSASL, "28P01", "scram-sha-256"},
+		{"SCRAM_Falls_Back_To_MD5", AuthSCRAMSHA256, md5Password("secret", "app"), "secret", authenticationCleartextPassword, "", "md5"},
+		{"MD5_Upgraded_To_SCRAM", AuthMD5, scramSecret, "secret", authenticationSASL, "", "scram-sha-256"},
+		{"MD5_Wrong_Password", AuthMD5, "secret", "wrong", authenticationSASL, "28P01", "md5"},
+		{"Password_With_Verifier", AuthPassword, scramSecret, "secret", authenticationSASL, "", "password"},
+		{"Password_Wrong", AuthPassword, "secret", "wrong", authenticationSASL, "28P01", "password"},
+		{"Unknown_User", AuthSCRAMSHA256, "", "", authenticationSASL, "28P01", "scram-sha-256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := startTestAuthBackend(t, tt.target, "db_user", "db_password")
+			store := CredentialMap{}
+			if tt.secret != "" {
+				store["app"] = &Credentials{Password: tt.secret, TargetUser: "db_user", TargetPassword: "db_password"}
+			}
+			recorder := newEventRecorder()
+			proxy := NewEventProxy(recorder).To(backend.Addr().String()).Authenticate(tt.method, store)
+			addr, _ := startTestProxy(t, proxy)
+			defer proxy.Shutdown(context.Background())
+
+			err := authenticateTestClient(t, addr, "app", tt.password)
+			if tt.wantCode == "" && err != nil {
+				t.Fatalf("authentication failed: %v", err)
+			}
+			if tt.wantCode != "" {
+				if pgErr, ok := err.(*PgError); !ok || pgErr.Code != tt.wantCode {
+					t.Fatalf("authentication error = %v, want code %s", err, tt.wantCode)
+				}
+			}
+
+			closed := recorder.waitClosed(t)
+			if closed.Session.User != "app" {
+				t.Errorf("Session.User = %q, want app", closed.Session.User)
+			}
+			recorder.mu.Lock()
+			defer recorder.mu.Unlock()
+			switch e := recorder.events[1].(type) {
+			case *AuthenticationSucceeded:
+				if tt.wantCode != "" || e.Method != tt.wantMethod {
+					t.Errorf("unexpected %+v", e)
+				}
+			case *AuthenticationFailed:
+				if tt.wantCode == "" || e.Method != tt.wantMethod {
+					t.Errorf("unexpected %+v", e)
+				}
+			default:
+				t.Errorf("unexpected event %T", e)
+			}
+		})
+	}
+}
+
+func Test_Proxy_Authenticate_Target_Rejects(t *testing.T) {
+	backend := startTestAuthBackend(t, authenticationSASL, "db_user", "db_password")
+	store := CredentialMap{"app": {Password: "secret", TargetUser: "db_user", TargetPassword: "wrong"}}
+	proxy := NewEventProxy(newEventRecorder()).To(backend.Addr().String()).Authenticate(AuthSCRAMSHA256, store)
+	addr, _ := startTestProxy(t, proxy)
+	defer proxy.Shutdown(context.Background())
+
+	err := authenticateTestClient(t, addr, "app", "secret")
+	if pgErr, ok := err.(*PgError); !ok || pgErr.Code != "28P01" {
+		t.Fatalf("authentication error = %v, want code 28P01 of the target", err)
+	}
+}
+
+func Test_loginTarget_Requires_SCRAM_Signature(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		if _, err := readStartupMessage(server); err != nil {
+			return
+		}
+		_, _ = server.Write(encodeAuthentication(authenticationSASL, []byte("SCRAM-SHA-256\x00\x00")))
+		msg, err := readMessage(server)
+		if err != nil {
+			return
+		}
+		initial, err := decodeSASLInitialResponseMessage(msg)
+		if err != nil {
+			return
+		}
+		scram := newSCRAMServer(newSCRAMVerifier("other", []byte("salt"), scramIterations), "server-nonce")
+		serverFirst, err := scram.first(string(initial.data))
+		if err != nil {
+			return
+		}
+		_, _ = server.Write(encodeAuthentication(authenticationSASLContinue, []byte(serverFirst)))
+		if _, err := readMessage(server); err != nil {
+			return
+		}
+		// The server doesn't know the password, so it skips AuthenticationSASLFinal.
+		_, _ = server.Write(encodeAuthentication(authenticationOk, nil))
+	}()
+
+	rejection, err := loginTarget(client, map[string]string{"user": "u"}, "secret")
+	if err == nil || rejection != nil {
+		t.Errorf("loginTarget() = %x, %v, want an error", rejection, err)
+	}
+}
+
+func Test_encodeStartupMessage(t *testing.T) {
+	got := encodeStartupMessage(map[string]string{"database": "d", "user": "u"})
+	want := decodeHexStream(t, "0000001b0003000075736572007500646174616261736500640000")
+	if !bytes.Equal(got, want) {
+		t.Errorf("encodeStartupMessage() = %x, want %x", got, want)
+	}
+}
@@ -0,0 +1,199 @@
+package postgresql
+
+import (
+	"strings"
+	"time"
+)
+
+// CopyDirection tells which way COPY transfers data.
+type CopyDirection string
+
+const (
+	// CopyIn is COPY FROM STDIN, the client sends data to the server.
+	CopyIn CopyDirection = "in"
+	// CopyOut is COPY TO STDOUT, the server sends data to the client.
+	CopyOut CopyDirection = "out"
+	// CopyBoth is the data exchange in both directions which streaming replication runs on.
+	CopyBoth CopyDirection = "both"
+)
+
+// CopyFormat is the format of COPY data.
+type CopyFormat string
+
+const (
+	CopyText   CopyFormat = "text"
+	CopyCSV    CopyFormat = "csv"
+	CopyBinary CopyFormat = "binary"
+)
+
+// CopyStats describes the data COPY transferred through Proxy.
+// The number of copied rows is RowsAffected of the Query the stats belong to.
+type CopyStats struct {
+	Direction CopyDirection
+	// Format is binary if backend reported so. Otherwise it's csv if the statement has the CSV option
+	// following STDIN or STDOUT, e.g. (FORMAT csv), and text if it doesn't.
+	Format CopyFormat
+	// MessagesFromClient and MessagesFromServer are the numbers of CopyData messages sent in each direction,
+	// BytesFromClient and BytesFromServer are the numbers of bytes of data they carried.
+	MessagesFromClient int64
+	MessagesFromServer int64
+	BytesFromClient    int64
+	BytesFromServer    int64
+	// Duration is the time passed from CopyInResponse, CopyOutResponse or CopyBothResponse till CopyDone
+	// or CopyFail ended the data. It lasts till the completion of the statement if the data never ended,
+	// e.g. because backend failed in the middle of them.
+	Duration time.Duration
+	// Failed is true if the client aborted COPY FROM STDIN with CopyFail.
+	Failed bool
+}
+
+// copyData is the data sent in one direction during a single COPY.
+type copyData struct {
+	messages int64
+	bytes    int64
+	// end is the moment CopyDone or CopyFail ended the data, it's zero until then.
+	end    time.Time
+	failed bool
+	// matched is true if the statement completed before the data ended, so the rest of them
+	// are ignored by backend and aren't reported.
+	matched bool
+}
+
+func (d *copyData) add(m *copyDataMessage) {
+	d.messages++
+	d.bytes += m.size
+}
+
+// copyState is COPY a pending statement started.
+type copyState struct {
+	stats CopyStats
+	// begin is the moment the copy response arrived from backend.
+	begin time.Time
+	// fromServer is the data of COPY TO STDOUT.
+	fromServer copyData
+}
+
+func newCopyState(m *copyResponseMessage, query string, now time.Time) *copyState {
+	return &copyState{stats: CopyStats{Direction: m.direction, Format: copyFormat(query, m.binary)}, begin: now}
+}
+
+// copyTracker matches the data frontend sends during COPY FROM STDIN to the statement.
+// Frontend may start sending the data before the session learns about CopyInResponse,
+// so the data are kept apart from pending states and matched once the statement completes.
+type copyTracker struct {
+	// sending is the data frontend is sending now, it's nil outside of the copy mode.
+	sending *copyData
+	// sent are the data frontend ended with CopyDone or CopyFail, which no statement has completed with yet.
+	sent []*copyData
+}
+
+// frontend records CopyData, CopyDone or CopyFail message sent by frontend.
+func (t *copyTracker) frontend(m interface{}, now time.Time) {
+	if t.sending == nil {
+		t.sending = &copyData{}
+	}
+	switch m := m.(type) {
+	case *copyDataMessage:
+		t.sending.add(m)
+		return
+	case *copyFailMessage:
+		t.sending.failed = true
+	}
+	t.sending.end = now
+	if !t.sending.matched {
+		t.sent = append(t.sent, t.sending)
+	}
+	t.sending = nil
+}
+
+// complete returns the stats of COPY c once its statement completes.
+func (t *copyTracker) complete(c *copyState, now time.Time) *CopyStats {
+	stats := c.stats
+	stats.MessagesFromServer = c.fromServer.messages
+	stats.BytesFromServer = c.fromServer.bytes
+	end := c.fromServer.end
+
+	if stats.Direction != CopyOut {
+		var fromClient *copyData
+		switch {
+		case len(t.sent) > 0:
+			fromClient = t.sent[0]
+			t.sent = t.sent[1:]
+		case t.sending != nil:
+			fromClient = t.sending
+			fromClient.matched = true
+		default:
+			fromClient = &copyData{}
+		}
+		stats.MessagesFromClient = fromClient.messages
+		stats.BytesFromClient = fromClient.bytes
+		stats.Failed = fromClient.failed
+		if stats.Direction == CopyIn || fromClient.end.After(end) {
+			end = fromClient.end
+		}
+	}
+
+	if end.IsZero() {
+		end = now
+	}
+	// Frontend may end the data before the session learns about the copy response.
+	if end.After(c.begin) {
+		stats.Duration = end.Sub(c.begin)
+	}
+	return &stats
+}
+
+// copyFormat returns the format of COPY statement query. Backend reports only whether the format is binary,
+// so csv is told apart from text by the options following STDIN or STDOUT: either FORMAT csv or legacy CSV.
+func copyFormat(query string, binary bool) CopyFormat {
+	if binary {
+		return CopyBinary
+	}
+
+	format := CopyText
+	var options, afterFormat bool
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		var word string
+		var quoted bool
+		switch {
+		case c == '\'' || c == '"':
+			end := skipQuoted(query, i, c, false)
+			word = query[i+1 : end]
+			quoted = true
+			i = end
+		case isWordByte(c):
+			start := i
+			for i+1 < len(query) && isWordByte(query[i+1]) {
+				i++
+			}
+			word = query[start : i+1]
+		default:
+			continue
+		}
+
+		switch {
+		case !quoted && (strings.EqualFold(word, "STDIN") || strings.EqualFold(word, "STDOUT")):
+			// Options follow the last one, the query of COPY (query) TO STDOUT may mention them too.
+			options, afterFormat = true, false
+			format = CopyText
+		case !options:
+		case afterFormat:
+			afterFormat = false
+			if strings.EqualFold(word, "csv") {
+				format = CopyCSV
+			}
+		case quoted:
+			// E.g. the value of DELIMITER or NULL option.
+		case strings.EqualFold(word, "FORMAT"):
+			afterFormat = true
+		case strings.EqualFold(word, "CSV"):
+			format = CopyCSV
+		}
+	}
+	return format
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80
+}
@@ -0,0 +1,119 @@
+package postgresql
+
+import "time"
+
+// EventWriter receives everything Proxy observes on its connections.
+type EventWriter interface {
+	WriteEvent(e Event)
+}
+
+// Event is one of *Query, *Transaction, *ConnectionOpened, *ConnectionClosed,
+// *AuthenticationSucceeded, *AuthenticationFailed, *DialFailed or *ProtocolError.
+type Event interface {
+	event()
+}
+
+func (*Query) event()                   {}
+func (*Transaction) event()             {}
+func (*ConnectionOpened) event()        {}
+func (*ConnectionClosed) event()        {}
+func (*AuthenticationSucceeded) event() {}
+func (*AuthenticationFailed) event()    {}
+func (*DialFailed) event()              {}
+func (*ProtocolError) event()           {}
+
+// ConnectionOpened is written once Proxy accepts a client connection, before it dials the target.
+type ConnectionOpened struct {
+	Session SessionInfo
+	Time    time.Time
+}
+
+// CloseReason tells which side ended the connection.
+type CloseReason string
+
+const (
+	// CloseByClient means the client closed its connection or sending to it failed.
+	CloseByClient CloseReason = "client"
+	// CloseByServer means the target closed its connection or sending to it failed.
+	CloseByServer CloseReason = "server"
+	// CloseByShutdown means Proxy closed the connection while shutting down.
+	CloseByShutdown CloseReason = "shutdown"
+	// CloseByDialFailure means Proxy couldn't connect to the target.
+	CloseByDialFailure CloseReason = "dial failure"
+)
+
+// ConnectionClosed is written once both the client and the target connections are closed.
+type ConnectionClosed struct {
+	Session SessionInfo
+	Time    time.Time
+	// Duration is the time passed since the connection was accepted.
+	Duration time.Duration
+	// BytesFromClient and BytesFromServer are the numbers of bytes forwarded in each direction.
+	BytesFromClient int64
+	BytesFromServer int64
+	Reason          CloseReason
+	// Err is the I/O error which ended the connection, it's nil if the connection was closed gracefully.
+	Err error
+}
+
+// AuthenticationSucceeded is written once backend accepts the client.
+type AuthenticationSucceeded struct {
+	Session SessionInfo
+	Time    time.Time
+	// Method is the authentication method backend requested, named as in pg_hba.conf:
+	// trust, password, md5, gss, sspi, scram-sha-256 or krb5.
+	Method string
+}
+
+// AuthenticationFailed is written once backend rejects the client.
+type AuthenticationFailed struct {
+	Session SessionInfo
+	Time    time.Time
+	// Method is the authentication method backend requested, it's empty if backend
+	// rejected the client before requesting any, e.g. because of pg_hba.conf reject rule.
+	Method string
+	Error  *PgError
+}
+
+// DialFailed is written if Proxy can't connect to the target for a client connection.
+type DialFailed struct {
+	Session SessionInfo
+	Time    time.Time
+	Target  string
+	Err     error
+}
+
+// ProtocolError is written if a stream can't be split into protocol messages anymore.
+// Proxy keeps forwarding the connection, but stops observing it.
+// It's also written for a single message which doesn't match its format, then Err wraps ErrMalformedMessage.
+// Proxy skips such a message and goes on observing the stream, a statement sent in such a message is reported
+// with an empty Query. A message with a field longer than MaxFieldSize is observed with the field truncated,
+// then Err wraps ErrFieldTooLong.
+type ProtocolError struct {
+	Session SessionInfo
+	Time    time.Time
+	// Frontend is true if the broken stream was sent by the client, and false if by the server.
+	Frontend bool
+	Err      error
+}
+
+// QueryEvents adapts QueryWriter to EventWriter. It passes queries to w, transactions too
+// if w implements TransactionWriter, and drops other events.
+func QueryEvents(w QueryWriter) EventWriter {
+	return queryEvents{w}
+}
+
+type queryEvents struct {
+	w QueryWriter
+}
+
+func (e queryEvents) WriteEvent(event Event) {
+	switch event := event.(type) {
+	case *Query:
+		e.w.Write(event)
+	case *Transaction:
+		if w, ok := e.w.(TransactionWriter); ok {
+			w.WriteTransaction(event)
+		}
+	}
+}
@@ -0,0 +1,473 @@
+package postgresql
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Action is what Firewall does with a statement.
+type Action string
+
+const (
+	// Allow passes the statement on to the target.
+	Allow Action = "allow"
+	// Deny answers the statement with an error right away, so that it never reaches the target.
+	Deny Action = "deny"
+)
+
+// firewallErrorCode is SQLSTATE of the error blocked statements fail with: insufficient_privilege.
+const firewallErrorCode = "42501"
+
+// Rule matches statements by the session they are sent in and by their text.
+// A statement matches the rule if it matches all fields which are set.
+type Rule struct {
+	// Name identifies the rule in the error the client gets.
+	Name   string
+	Action Action
+	// User, Database and ApplicationName match the parameters of the client session.
+	User            string
+	Database        string
+	ApplicationName string
+	// Types match the commands of the statement by their first keyword, e.g. DROP, TRUNCATE or DELETE.
+	// Besides the statement itself, its commands are the data-modifying statements in its WITH clause,
+	// the statement EXPLAIN ANALYZE executes and the one PREPARE prepares. A Deny rule matches the statement
+	// if any of its commands matches, other rules match only if all of them do.
+	// Commands run by functions, DO blocks, rules or triggers aren't seen, and neither is the statement
+	// EXECUTE runs, so Types isn't a security boundary on its own: restrict privileges of the user as well.
+	Types []string
+	// Unqualified matches commands without WHERE clause, e.g. DELETE or UPDATE of all rows of a table.
+	// Combined with Types it requires the same command to match both.
+	Unqualified bool
+	// Pattern is matched against the text of the statement, e.g. to find the tables it refers to.
+	Pattern *regexp.Regexp
+	// Fingerprint matches statements with the fingerprint, see Fingerprint.
+	Fingerprint string
+}
+
+// matches returns true if the statement sent in the session matches the rule.
+func (r *Rule) matches(info SessionInfo, statement string, tokens []string) bool {
+	if r.User != "" && r.User != info.User {
+		return false
+	}
+	if r.Database != "" && r.Database != info.Database {
+		return false
+	}
+	if r.ApplicationName != "" && r.ApplicationName != info.ApplicationName {
+		return false
+	}
+	if (len(r.Types) > 0 || r.Unqualified) && !r.matchesCommands(statementCommands(tokens)) {
+		return false
+	}
+	if r.Pattern != nil && !r.Pattern.MatchString(statement) {
+		return false
+	}
+	if r.Fingerprint != "" && r.Fingerprint != fingerprintTokens(tokens) {
+		return false
+	}
+	return true
+}
+
+// matchesCommands returns true if any of the commands matches Types and Unqualified of a Deny rule,
+// or all of them match those of another rule, so that neither rule lets through a command it doesn't mean.
+func (r *Rule) matchesCommands(commands []command) bool {
+	deny := r.Action == Deny
+	for _, c := range commands {
+		if r.matchesCommand(c) == deny {
+			return deny
+		}
+	}
+	return !deny
+}
+
+func (r *Rule) matchesCommand(c command) bool {
+	if len(r.Types) > 0 {
+		matched := false
+		for _, t := range r.Types {
+			matched = matched || strings.ToLower(t) == c.keyword
+		}
+		if !matched {
+			return false
+		}
+	}
+	return !r.Unqualified || !hasWhereClause(c.tokens)
+}
+
+// Firewall checks each statement which arrives from the client with Query or Parse message against
+// the rules in their order, the first rule the statement matches decides. Blocked statements never
+// reach the target, the client gets ErrorResponse with SQLSTATE 42501 instead, followed by ReadyForQuery
+// once the client expects it, so the connection stays usable. Query messages with several statements
+// are blocked entirely if any of them is. Query and Parse messages which don't match their format
+// are blocked as if Default was Deny, since their statements can't be checked.
+//
+// The target doesn't know about the errors, so a transaction the blocked statement belongs to
+// goes on rather than being aborted.
+type Firewall struct {
+	Rules []Rule
+	// Default is the action for statements no rule matches. It's Allow if empty.
+	Default Action
+}
+
+// check returns the rule which blocks the query sent in the session, or nil if it's allowed.
+// Statements which are allowed by default aren't blocked by any rule, so Default Deny is reported
+// as a rule without a name.
+func (f *Firewall) check(info SessionInfo, query string) *Rule {
+	for _, statement := range splitStatements(query) {
+		if rule := f.checkStatement(info, statement); rule != nil {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (f *Firewall) checkStatement(info SessionInfo, statement string) *Rule {
+	tokens := statementTokens(statement)
+	for i := range f.Rules {
+		rule := &f.Rules[i]
+		if !rule.matches(info, statement, tokens) {
+			continue
+		}
+		if rule.Action == Deny {
+			return rule
+		}
+		return nil
+	}
+	if f.Default == Deny {
+		return &Rule{Action: Deny}
+	}
+	return nil
+}
+
+// firewallError encodes ErrorResponse the client gets in place of the response to a statement the rule blocks.
+func firewallError(rule *Rule) []byte {
+	message := "permission denied: statement blocked by firewall"
+	if rule.Name != "" {
+		message = fmt.Sprintf("permission denied: statement blocked by firewall rule %q", rule.Name)
+	}
+	return encodeErrorResponse("ERROR", firewallErrorCode, message)
+}
+
+// guard applies Firewall to the frontend messages of a single connection. Blocked messages are
+// answered with responses made up the same way backend would answer them if they failed.
+type guard struct {
+	firewall *Firewall
+	session  *session
+	// skipping is true from a blocked Parse till Sync, since backend would discard these messages after an error.
+	skipping bool
+	// unsynced is true if messages of the current extended query batch were passed on to the target.
+	unsynced bool
+}
+
+// check returns whether msg is passed on to the target. If it isn't, it returns the response
+// the client gets in its place, or nil if the client gets none. beforeNext is true if the response
+// must precede ReadyForQuery of the target answering the next Sync, rather than follow the responses
+// to all messages passed on so far.
+func (g *guard) check(msg []byte) (pass bool, response *syntheticResponse, beforeNext bool) {
+	switch {
+	case g.skipping && msg[0] == syncMessageType:
+		g.skipping = false
+		if g.unsynced {
+			// The target must end the batch it received a part of, the error precedes its ReadyForQuery.
+			g.unsynced = false
+			return true, nil, false
+		}
+		return false, &syntheticResponse{ready: true}, false
+	case g.skipping:
+		return false, nil, false
+	case msg[0] == queryMessageType:
+		// The target may accept a message Proxy can't decode, so such a message is blocked
+		// rather than passed on unchecked. The collector reports it as ProtocolError.
+		rule := &Rule{Action: Deny}
+		if query, err := decodeQueryMessage(msg); err == nil {
+			rule = g.firewall.check(g.session.snapshot(), query.query)
+		}
+		if rule != nil {
+			return false, &syntheticResponse{err: firewallError(rule), rule: rule, ready: true}, false
+		}
+		g.unsynced = false
+	case msg[0] == parseMessageType:
+		rule := &Rule{Action: Deny}
+		if parse, err := decodeParseMessage(msg); err == nil {
+			rule = g.firewall.check(g.session.snapshot(), parse.query)
+		}
+		if rule != nil {
+			g.skipping = true
+			return false, &syntheticResponse{err: firewallError(rule), rule: rule}, g.unsynced
+		}
+		g.unsynced = true
+	case msg[0] == syncMessageType:
+		g.unsynced = false
+	case msg[0] == bindMessageType, msg[0] == describeMessageType, msg[0] == executeMessageType,
+		msg[0] == closeMessageType, msg[0] == flushMessageType:
+		g.unsynced = true
+	}
+	return true, nil, false
+}
+
+// Fingerprint returns the fingerprint of the statement. Statements which differ only in values
+// of literals and parameters, comments, whitespace and the case of keywords have the same fingerprint.
+func Fingerprint(statement string) string {
+	return fingerprintTokens(statementTokens(statement))
+}
+
+func fingerprintTokens(tokens []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(tokens, " ")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// command is a single SQL command a statement runs.
+type command struct {
+	// keyword is the first keyword of the command in lower case, e.g. delete.
+	keyword string
+	tokens  []string
+}
+
+// statementCommands returns the commands the statement of tokens runs, the statement itself first.
+// The statement is followed by the data-modifying commands of its WITH clause, the command EXPLAIN ANALYZE
+// executes, or the command PREPARE prepares.
+func statementCommands(tokens []string) []command {
+	switch firstToken(tokens) {
+	case "with":
+		rest, bodies := skipWithClause(tokens[1:])
+		commands := statementCommands(rest)
+		for _, body := range bodies {
+			for _, c := range statementCommands(body) {
+				switch c.keyword {
+				case "insert", "update", "delete", "merge":
+					commands = append(commands, c)
+				}
+			}
+		}
+		return commands
+	case "explain":
+		commands := []command{{keyword: "explain", tokens: tokens}}
+		if rest, analyze := skipExplainOptions(tokens[1:]); analyze {
+			commands = append(commands, statementCommands(rest)...)
+		}
+		return commands
+	case "prepare":
+		// PREPARE name [(types)] AS statement
+		rest := tokens[1:]
+		if len(rest) > 0 {
+			rest = rest[1:]
+		}
+		if firstToken(rest) == "(" {
+			rest, _ = skipParentheses(rest)
+		}
+		commands := []command{{keyword: "prepare", tokens: tokens}}
+		if firstToken(rest) == "as" {
+			commands = append(commands, statementCommands(rest[1:])...)
+		}
+		return commands
+	}
+	return []command{{keyword: firstToken(tokens), tokens: tokens}}
+}
+
+// skipWithClause returns the statement following WITH clause of tokens, which follow WITH keyword,
+// and the bodies of the common table expressions.
+func skipWithClause(tokens []string) (rest []string, bodies [][]string) {
+	if firstToken(tokens) == "recursive" {
+		tokens = tokens[1:]
+	}
+	for len(tokens) > 0 {
+		// name [(columns)] AS [[NOT] MATERIALIZED] (body)
+		tokens = tokens[1:]
+		if firstToken(tokens) == "(" {
+			tokens, _ = skipParentheses(tokens)
+		}
+		if firstToken(tokens) != "as" {
+			return tokens, bodies
+		}
+		tokens = tokens[1:]
+		if firstToken(tokens) == "not" {
+			tokens = tokens[1:]
+		}
+		if firstToken(tokens) == "materialized" {
+			tokens = tokens[1:]
+		}
+		if firstToken(tokens) != "(" {
+			return tokens, bodies
+		}
+		var body []string
+		tokens, body = skipParentheses(tokens)
+		bodies = append(bodies, body)
+
+		// SEARCH and CYCLE clauses of a recursive query end at the next expression or the statement.
+		for firstToken(tokens) == "search" || firstToken(tokens) == "cycle" {
+			for len(tokens) > 0 && tokens[0] != "," && !startsStatement(tokens[0]) {
+				tokens = tokens[1:]
+			}
+		}
+		if firstToken(tokens) != "," {
+			return tokens, bodies
+		}
+		tokens = tokens[1:]
+	}
+	return tokens, bodies
+}
+
+// skipExplainOptions returns the statement following the options of EXPLAIN in tokens,
+// and whether the options include ANALYZE, so that the statement is executed.
+func skipExplainOptions(tokens []string) (rest []string, analyze bool) {
+	if firstToken(tokens) == "(" {
+		rest, options := skipParentheses(tokens)
+		for _, option := range options {
+			analyze = analyze || option == "analyze" || option == "analyse"
+		}
+		return rest, analyze
+	}
+	for {
+		switch firstToken(tokens) {
+		case "analyze", "analyse":
+			analyze = true
+		case "verbose":
+		default:
+			return tokens, analyze
+		}
+		tokens = tokens[1:]
+	}
+}
+
+// skipParentheses returns tokens following the parenthesized group tokens start with, and the tokens inside it.
+func skipParentheses(tokens []string) (rest, inside []string) {
+	depth := 0
+	for i, token := range tokens {
+		switch token {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return tokens[i+1:], tokens[1:i]
+			}
+		}
+	}
+	return nil, tokens[1:]
+}
+
+// startsStatement returns true if the token is the first keyword of a statement which may follow WITH clause.
+func startsStatement(token string) bool {
+	switch token {
+	case "select", "insert", "update", "delete", "merge", "values", "table":
+		return true
+	}
+	return false
+}
+
+func firstToken(tokens []string) string {
+	if len(tokens) == 0 {
+		return ""
+	}
+	return tokens[0]
+}
+
+// hasWhereClause returns true if the statement has WHERE clause outside of parentheses,
+// i.e. its own rather than one of a subquery.
+func hasWhereClause(tokens []string) bool {
+	depth := 0
+	for _, token := range tokens {
+		switch token {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		case "where":
+			if depth == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// statementTokens splits the statement into lower case keywords and unquoted identifiers,
+// quoted identifiers and punctuation, with ? in place of each literal and parameter.
+// Comments and whitespace are skipped.
+func statementTokens(statement string) []string {
+	var tokens []string
+	// wordEnd is the end of the last word, which may turn out to be the prefix of a string literal, e.g. E'...'.
+	wordEnd := -1
+	for i := 0; i < len(statement); i++ {
+		c := statement[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+		case c == '-' && i+1 < len(statement) && statement[i+1] == '-':
+			for i < len(statement) && statement[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(statement) && statement[i+1] == '*':
+			depth := 0
+			for ; i+1 < len(statement); i++ {
+				if statement[i] == '/' && statement[i+1] == '*' {
+					depth++
+					i++
+				} else if statement[i] == '*' && statement[i+1] == '/' {
+					depth--
+					i++
+					if depth == 0 {
+						break
+					}
+				}
+			}
+		case c == '\'':
+			escapes := false
+			if wordEnd == i && len(tokens) > 0 {
+				prefix := tokens[len(tokens)-1]
+				escapes = prefix == "e"
+				if prefix == "e" || prefix == "b" || prefix == "x" || prefix == "n" {
+					tokens = tokens[:len(tokens)-1]
+				}
+			}
+			i = skipQuoted(statement, i, '\'', escapes)
+			tokens = append(tokens, "?")
+		case c == '"':
+			end := skipQuoted(statement, i, '"', false)
+			if end >= len(statement) {
+				end = len(statement) - 1
+			}
+			tokens = append(tokens, statement[i:end+1])
+			i = end
+		case c == '$':
+			tag := dollarQuoteTag(statement[i:])
+			switch {
+			case tag != "":
+				if end := strings.Index(statement[i+len(tag):], tag); end >= 0 {
+					i += len(tag) + end + len(tag) - 1
+				} else {
+					i = len(statement)
+				}
+			default:
+				// Positional parameter.
+				for i+1 < len(statement) && isDigit(statement[i+1]) {
+					i++
+				}
+			}
+			tokens = append(tokens, "?")
+		case isDigit(c) || (c == '.' && i+1 < len(statement) && isDigit(statement[i+1])):
+			for i+1 < len(statement) && (isIdentifierChar(statement[i+1]) || statement[i+1] == '.') {
+				i++
+			}
+			tokens = append(tokens, "?")
+		case isIdentifierChar(c):
+			start := i
+			for i+1 < len(statement) && (isIdentifierChar(statement[i+1]) || statement[i+1] == '$') {
+				i++
+			}
+			tokens = append(tokens, strings.ToLower(statement[start:i+1]))
+			wordEnd = i + 1
+		default:
+			tokens = append(tokens, string(c))
+		}
+	}
+	return tokens
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || isDigit(c) || c >= 0x80
+}
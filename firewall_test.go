@@ -0,0 +1,249 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func Test_Firewall_check(t *testing.T) {
+	firewall := &Firewall{Rules: []Rule{
+		{Name: "admin", Action: Allow, User: "admin"},
+		{Name: "drop", Action: Deny, Types: []string{"DROP", "truncate"}},
+		{Name: "delete_all", Action: Deny, Types: []string{"DELETE", "UPDATE"}, Unqualified: true},
+		{Name: "secrets", Action: Deny, Pattern: regexp.MustCompile(`(?i)\bsecrets\b`)},
+		{Name: "reporting", Action: Deny, ApplicationName: "reporting", Fingerprint: Fingerprint("SELECT * FROM orders WHERE id = 1")},
+	}}
+
+	tests := []struct {
+		name  string
+		user  string
+		app   string
+		query string
+		want  string
+	}{
+		{"Drop", "app", "", "DROP TABLE users", "drop"},
+		{"Truncate_Lower_Case", "app", "", "truncate users", "drop"},
+		{"Drop_In_Second_Statement", "app", "", "SELECT 1; DROP TABLE users", "drop"},
+		{"Drop_In_String", "app", "", "SELECT 'DROP TABLE users'", ""},
+		{"Drop_By_Admin", "admin", "", "DROP TABLE users", ""},
+		{"Delete_All", "app", "", "DELETE FROM users", "delete_all"},
+		{"Delete_With_Where", "app", "", "DELETE FROM users WHERE id = $1", ""},
+		{"Update_With_Where_In_Subquery", "app", "", "UPDATE users SET x = (SELECT 1 FROM t WHERE y)", "delete_all"},
+		{"Delete_In_CTE", "app", "", "WITH x AS (DELETE FROM t RETURNING *) SELECT * FROM x", "delete_all"},
+		{"Delete_In_Nested_CTE", "app", "", "WITH RECURSIVE x (a) AS NOT MATERIALIZED (SELECT 1), y AS (WITH z AS (DELETE FROM t RETURNING *) SELECT * FROM z) SELECT * FROM y", "delete_all"},
+		{"Delete_With_Where_In_CTE", "app", "", "WITH x AS (DELETE FROM t WHERE id = 1 RETURNING *) SELECT * FROM x", ""},
+		{"Select_In_CTE_Of_Delete", "app", "", "WITH x AS (SELECT id FROM t WHERE a) DELETE FROM t", "delete_all"},
+		{"Delete_Via_Explain_Analyze", "app", "", "EXPLAIN ANALYZE DELETE FROM t", "delete_all"},
+		{"Delete_Via_Explain_Options", "app", "", "EXPLAIN (ANALYZE, BUFFERS) DELETE FROM t", "delete_all"},
+		{"Explain_Without_Analyze", "app", "", "EXPLAIN DELETE FROM t", ""},
+		{"Prepare", "app", "", "PREPARE d (int) AS DELETE FROM t", "delete_all"},
+		{"Pattern", "app", "", "SELECT * FROM Secrets", "secrets"},
+		{"Fingerprint", "app", "reporting", "select *  from orders where id = 42 -- by id", "reporting"},
+		{"Fingerprint_Other_Application", "app", "web", "SELECT * FROM orders WHERE id = 42", ""},
+		{"Fingerprint_Other_Statement", "app", "reporting", "SELECT * FROM orders WHERE user_id = 42", ""},
+		{"Allowed", "app", "", "SELECT 1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if rule := firewall.check(SessionInfo{User: tt.user, ApplicationName: tt.app}, tt.query); rule != nil {
+				got = rule.Name
+			}
+			if got != tt.want {
+				t.Errorf("check(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Firewall_Default_Deny(t *testing.T) {
+	firewall := &Firewall{Rules: []Rule{{Action: Allow, Types: []string{"SELECT"}}}, Default: Deny}
+	if rule := firewall.check(SessionInfo{}, "SELECT 1"); rule != nil {
+		t.Errorf("SELECT blocked by %+v", rule)
+	}
+	if rule := firewall.check(SessionInfo{}, "INSERT INTO t VALUES (1)"); rule == nil || rule.Action != Deny {
+		t.Errorf("INSERT blocked by %+v, want default rule", rule)
+	}
+	// Allow rule matches only if all commands of the statement do.
+	if rule := firewall.check(SessionInfo{}, "WITH x AS (DELETE FROM t RETURNING *) SELECT * FROM x"); rule == nil || rule.Action != Deny {
+		t.Errorf("SELECT with DELETE in CTE blocked by %+v, want default rule", rule)
+	}
+}
+
+func Test_Firewall_Types_Nested_Commands(t *testing.T) {
+	firewall := &Firewall{Rules: []Rule{{Name: "delete", Action: Deny, Types: []string{"DELETE"}}}}
+	for _, query := range []string{
+		"WITH x AS (DELETE FROM t RETURNING *) SELECT * FROM x",
+		"EXPLAIN ANALYZE DELETE FROM t",
+		"EXPLAIN ANALYZE VERBOSE WITH x AS (DELETE FROM t WHERE a RETURNING *) SELECT 1",
+	} {
+		if rule := firewall.check(SessionInfo{}, query); rule == nil || rule.Name != "delete" {
+			t.Errorf("check(%q) = %+v, want rule delete", query, rule)
+		}
+	}
+}
+
+func Test_statementTokens(t *testing.T) {
+	tests := []struct {
+		statement string
+		want      string
+	}{
+		{"SELECT * FROM t WHERE a = 1", "select * from t where a = ?"},
+		{"select a, \"B\" from s.t -- comment\nwhere b = E'x\\'y' /* c /* nested */ */", "select a , \"B\" from s . t where b = ?"},
+		{"SELECT $1, $$body$$, $tag$x$tag$, 1.5e3, .5", "select ? , ? , ? , ? , ?"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(statementTokens(tt.statement), " "); got != tt.want {
+			t.Errorf("statementTokens(%q) = %q, want %q", tt.statement, got, tt.want)
+		}
+	}
+}
+
+func Test_Proxy_Firewall(t *testing.T) {
+	firewall := &Firewall{Rules: []Rule{
+		{Name: "drop", Action: Deny, Types: []string{"DROP", "TRUNCATE"}},
+		{Name: "delete_all", Action: Deny, Types: []string{"DELETE"}, Unqualified: true},
+	}}
+
+	tests := []struct {
+		name string
+		msgs [][]byte
+		// want are the types of the response messages followed by the transaction status.
+		want string
+	}{
+		{"Query_Blocked", [][]byte{testQuery("DROP TABLE users")}, "EZI"},
+		{"Query_Allowed", [][]byte{testQuery("DELETE FROM users WHERE id = 1")}, "CZI"},
+		{"Parse_Blocked", [][]byte{testParse("", "TRUNCATE users"), testBind(""), testExecute(), testSync()}, "EZI"},
+		{"Parse_Blocked_In_Batch", [][]byte{
+			testParse("s1", "SELECT 1"), testBind("s1"), testExecute(),
+			testParse("", "DELETE FROM users"), testBind(""), testExecute(), testSync(),
+		}, "12CEZI"},
+		{"Pipelined_Queries", [][]byte{testQuery("BEGIN"), testQuery("DROP TABLE users"), testQuery("COMMIT")}, "CZTEZTCZI"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := startTestPoolBackend(t)
+			recorder := newEventRecorder()
+			proxy := NewEventProxy(recorder).To(backend.Addr().String()).Firewall(firewall)
+			addr, _ := startTestProxy(t, proxy)
+			defer proxy.Shutdown(context.Background())
+
+			client := connectTestClient(t, addr, false)
+			if got := exchangeTestMessages(t, client); got != "RSKZI" {
+				t.Fatalf("startup = %s", got)
+			}
+			var got string
+			for got = exchangeTestMessages(t, client, tt.msgs...); len(got) < len(tt.want); {
+				got += exchangeTestMessages(t, client)
+			}
+			if got != tt.want {
+				t.Errorf("responses = %s, want %s", got, tt.want)
+			}
+			// The connection stays usable.
+			if got := exchangeTestMessages(t, client, testQuery("SELECT 1")); got != "CZI" {
+				t.Errorf("SELECT 1 = %s", got)
+			}
+			_ = client.Close()
+			recorder.waitClosed(t)
+
+			_, queries, _ := backend.stats()
+			for _, q := range queries {
+				if strings.HasPrefix(q, "DROP") {
+					t.Errorf("blocked statement %q reached the target", q)
+				}
+			}
+			recorder.mu.Lock()
+			defer recorder.mu.Unlock()
+			for _, e := range recorder.events {
+				q, ok := e.(*Query)
+				if !ok || q.Rule == nil {
+					continue
+				}
+				if q.PgError == nil || q.PgError.Code != "42501" {
+					t.Errorf("blocked Query = %+v, want SQLSTATE 42501", q)
+				}
+				return
+			}
+			if strings.Contains(tt.want, "E") {
+				t.Error("blocked Query wasn't written")
+			}
+		})
+	}
+}
+
+func Test_Proxy_Firewall_Malformed_Messages(t *testing.T) {
+	tests := []struct {
+		name string
+		msgs [][]byte
+	}{
+		{"Query", [][]byte{encodeMessage(queryMessageType, []byte("DROP TABLE users\x00x"))}},
+		{"Parse", [][]byte{encodeMessage(parseMessageType, []byte("\x00DROP TABLE users\x00\x00\x00x")), testBind(""), testExecute(), testSync()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := startTestPoolBackend(t)
+			recorder := newEventRecorder()
+			firewall := &Firewall{Rules: []Rule{{Name: "drop", Action: Deny, Types: []string{"DROP"}}}}
+			proxy := NewEventProxy(recorder).To(backend.Addr().String()).Firewall(firewall)
+			addr, _ := startTestProxy(t, proxy)
+			defer proxy.Shutdown(context.Background())
+
+			client := connectTestClient(t, addr, false)
+			if got := exchangeTestMessages(t, client); got != "RSKZI" {
+				t.Fatalf("startup = %s", got)
+			}
+			// The firewall can't check the statement, so the message never reaches the target.
+			if got := exchangeTestMessages(t, client, tt.msgs...); got != "EZI" {
+				t.Errorf("responses = %s, want EZI", got)
+			}
+			if got := exchangeTestMessages(t, client, testQuery("SELECT 1")); got != "CZI" {
+				t.Errorf("SELECT 1 = %s", got)
+			}
+			_ = client.Close()
+			recorder.waitClosed(t)
+
+			if _, queries, parses := backend.stats(); strings.Join(queries, ",") != "SELECT 1" || len(parses) != 0 {
+				t.Errorf("queries = %v, parses = %v, want SELECT 1 only", queries, parses)
+			}
+			recorder.mu.Lock()
+			defer recorder.mu.Unlock()
+			var blocked, reported bool
+			for _, e := range recorder.events {
+				switch e := e.(type) {
+				case *Query:
+					blocked = blocked || (e.Rule != nil && e.PgError != nil && e.PgError.Code == "42501")
+				case *ProtocolError:
+					reported = reported || (e.Frontend && errors.Is(e.Err, ErrMalformedMessage))
+				}
+			}
+			if !blocked || !reported {
+				t.Errorf("blocked Query written = %v, ProtocolError written = %v, want both", blocked, reported)
+			}
+		})
+	}
+}
+
+func Test_Proxy_Firewall_Pool(t *testing.T) {
+	backend := startTestPoolBackend(t)
+	store := CredentialMap{"app": {Password: "secret", TargetUser: "db_user"}}
+	proxy := NewEventProxy(newEventRecorder()).To(backend.Addr().String()).
+		Authenticate(AuthPassword, store).
+		Pool(PoolTransaction, 1).
+		Firewall(&Firewall{Rules: []Rule{{Name: "drop", Action: Deny, Types: []string{"DROP"}}}})
+	addr, _ := startTestProxy(t, proxy)
+	defer proxy.Shutdown(context.Background())
+
+	client, _ := connectPooledClient(t, addr)
+	if got := exchangeTestMessages(t, client, testQuery("DROP TABLE users")); got != "EZI" {
+		t.Errorf("DROP = %s, want EZI", got)
+	}
+	if got := exchangeTestMessages(t, client, testQuery("SELECT 1")); got != "CZI" {
+		t.Errorf("SELECT 1 = %s, want CZI", got)
+	}
+	if _, queries, _ := backend.stats(); strings.Join(queries, ",") != "SELECT 1" {
+		t.Errorf("queries = %v, want SELECT 1 only", queries)
+	}
+}
@@ -0,0 +1,254 @@
+package postgresql
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+const (
+	// framerStartup is the mode of a new connection. Frontend starts it with messages
+	// which don't have a type byte: StartupMessage, SSLRequest, GSSENCRequest or CancelRequest.
+	// Backend responds to encryption requests with a single byte 'S', 'G' or 'N'.
+	framerStartup = iota
+	// framerTyped is the mode of regular messages which start with a type byte followed by length.
+	framerTyped
+	// framerOpaque is the mode of a stream which can't be framed anymore,
+	// e.g. because it's encrypted or its framing is broken.
+	framerOpaque
+)
+
+var (
+	// errInvalidMessageLength is the reason a stream which isn't encrypted can't be framed.
+	errInvalidMessageLength = errors.New("postgresql: invalid message length")
+	// errMessageTooLong is the reason a stream with a message longer than the limit isn't framed any further.
+	errMessageTooLong = errors.New("postgresql: message is too long")
+)
+
+// maxStartupMessageLen is the limit of untyped message length which backend applies as well.
+const maxStartupMessageLen = 10000
+
+// tailPool keeps buffers for incomplete messages to avoid allocating them for each connection.
+var tailPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
+// framer splits a stream of bytes into separate protocol messages.
+// Each message is passed on as soon as all its bytes arrive, and only bytes of the last incomplete
+// message are kept between writes.
+type framer struct {
+	origin byte
+	mode   int
+	// maxLen is the limit of typed message length, not counting the type byte.
+	maxLen int
+	// encrypting is true if frontend requested encryption, so the stream which can't be framed
+	// anymore is expected to be encrypted rather than broken.
+	encrypting bool
+	// err is the reason the stream became opaque. It's nil if the stream is encrypted.
+	err error
+	// tail holds the beginning of the message which hasn't arrived completely yet.
+	tail *[]byte
+	// skipType is the type of messages whose content isn't needed. Only the type byte and the length
+	// of such a message are yielded, the rest of it is skipped as it arrives instead of being buffered,
+	// so it isn't subject to maxLen either. It's zero if all messages are yielded whole.
+	skipType byte
+	// skip is the number of bytes left to skip before the next message.
+	skip int
+}
+
+// newFramer creates framer of the stream sent by the origin.
+// startup must be true if the stream starts from the very beginning of the connection.
+// Messages longer than maxLen break the stream, so that they are never buffered.
+func newFramer(origin byte, startup bool, maxLen int) *framer {
+	f := &framer{origin: origin, mode: framerTyped, maxLen: maxLen}
+	if startup {
+		f.mode = framerStartup
+	}
+	return f
+}
+
+// write splits p into messages and calls yield for each complete one.
+// Messages are valid only until yield returns, so it must copy whatever it keeps.
+func (f *framer) write(p []byte, yield func(msg []byte)) {
+	for len(p) > 0 && f.mode != framerOpaque {
+		if f.skip > 0 {
+			n := f.skip
+			if n > len(p) {
+				n = len(p)
+			}
+			p = p[n:]
+			f.skip -= n
+			continue
+		}
+
+		if f.tail != nil {
+			tail := *f.tail
+			// Append either the rest of the header or the rest of the message.
+			n, ok := f.frameLen(tail)
+			if !ok {
+				n = f.headerLen()
+			}
+			if !f.valid(n, tail[0]) {
+				break
+			}
+			take := n - len(tail)
+			if take > len(p) {
+				take = len(p)
+			}
+			tail = append(tail, p[:take]...)
+			p = p[take:]
+			*f.tail = tail
+
+			// Check the length as soon as the header is complete rather than on the next write.
+			if n, ok := f.frameLen(tail); ok {
+				if !f.valid(n, tail[0]) {
+					break
+				}
+				if f.skips(tail[0]) {
+					// The tail is the header alone, since the rest of the header is all it was waiting for.
+					f.yield(tail, yield)
+					f.release()
+					f.skip = n - minPacketLen
+					continue
+				}
+				if n == len(tail) {
+					f.yield(tail, yield)
+					f.release()
+				}
+			}
+			continue
+		}
+
+		n, ok := f.frameLen(p)
+		if ok && !f.valid(n, p[0]) {
+			break
+		}
+		if ok && f.skips(p[0]) {
+			f.yield(p[:minPacketLen], yield)
+			// The header is skipped along with the rest of the message.
+			f.skip = n
+			continue
+		}
+		if !ok || n > len(p) {
+			f.tail = tailPool.Get().(*[]byte)
+			*f.tail = append((*f.tail)[:0], p...)
+			return
+		}
+		f.yield(p[:n], yield)
+		p = p[n:]
+	}
+
+	if f.mode == framerOpaque {
+		f.release()
+	}
+}
+
+// close returns the buffer of the incomplete message to the pool.
+func (f *framer) close() {
+	f.release()
+}
+
+func (f *framer) release() {
+	if f.tail != nil {
+		tailPool.Put(f.tail)
+		f.tail = nil
+	}
+}
+
+// valid returns true if n is a valid length of the next message of type t.
+// Otherwise it switches to opaque mode, because the stream can't be framed any further.
+func (f *framer) valid(n int, t byte) bool {
+	switch {
+	case n < 0:
+		if f.mode == framerTyped || !f.encrypting {
+			f.err = errInvalidMessageLength
+		}
+	case f.mode == framerTyped && n-1 > f.maxLen && !f.skips(t):
+		f.err = errMessageTooLong
+	default:
+		return true
+	}
+	f.mode = framerOpaque
+	return false
+}
+
+// skips returns true if only the header of the next message of type t is yielded.
+func (f *framer) skips(t byte) bool {
+	return f.skipType != 0 && f.mode == framerTyped && t == f.skipType
+}
+
+// headerLen returns the number of bytes required to find out the length of the next message.
+func (f *framer) headerLen() int {
+	switch {
+	case f.mode == framerTyped:
+		return minPacketLen
+	case f.origin == originFrontend:
+		return 4
+	default:
+		return 1
+	}
+}
+
+// frameLen returns the length of the message which starts at the beginning of b.
+// ok is false if b is too short to know it. Negative length means the stream can't be framed.
+func (f *framer) frameLen(b []byte) (n int, ok bool) {
+	if f.mode == framerStartup && f.origin == originBackend {
+		if len(b) < 1 {
+			return 0, false
+		}
+		switch b[0] {
+		case 'S', 'G', 'N':
+			return 1, true
+		}
+		// Backend didn't respond to an encryption request, so it's a regular message.
+		f.mode = framerTyped
+	}
+
+	if len(b) < f.headerLen() {
+		return 0, false
+	}
+
+	if f.mode == framerStartup {
+		pktLen := binary.BigEndian.Uint32(b[0:4])
+		if pktLen < 8 || pktLen > maxStartupMessageLen {
+			return -1, true
+		}
+		return int(pktLen), true
+	}
+
+	// Length includes itself, but not the type byte.
+	pktLen := binary.BigEndian.Uint32(b[1:minPacketLen])
+	if pktLen < 4 {
+		return -1, true
+	}
+	return int(pktLen) + 1, true
+}
+
+// yield passes msg on and switches the mode if msg ends the startup phase.
+func (f *framer) yield(msg []byte, yield func(msg []byte)) {
+	yield(msg)
+
+	if f.mode != framerStartup {
+		return
+	}
+	switch {
+	case f.origin == originBackend && msg[0] == 'N':
+		// Encryption was refused, so frontend goes on with either another request or StartupMessage.
+	case f.origin == originBackend:
+		// Encryption was accepted, the rest of the stream is encrypted.
+		f.mode = framerOpaque
+	case isSSLRequestMessage(msg) || isGSSENCRequestMessage(msg):
+		// Frontend waits for the response and then either starts the encryption
+		// or sends StartupMessage. Encrypted stream fails the length check of the next startup message.
+		f.encrypting = true
+	case isStartupMessage(msg):
+		f.encrypting = false
+		f.mode = framerTyped
+	default:
+		// Nothing follows CancelRequest, and unknown requests are rejected by backend.
+		f.mode = framerOpaque
+	}
+}
@@ -0,0 +1,177 @@
+package postgresql
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+const authenticationStream = "52000000080000000053000000166170706c69636174696f6e5f6e616d6500005300000019636c69656e745f656e636f64696e670055544638005300000017446174655374796c650049534f2c204d4459005300000019696e74656765725f6461746574696d6573006f6e00530000001b496e74657276616c5374796c6500706f73746772657300530000001569735f737570657275736572006f66660053000000197365727665725f656e636f64696e67005554463800530000001a7365727665725f76657273696f6e00392e362e313000530000002573657373696f6e5f617574686f72697a6174696f6e0079615f74657374696e670053000000237374616e646172645f636f6e666f726d696e675f737472696e6773006f6e00530000001154696d655a6f6e6500555443004b0000000c00000bbe3d082f545a0000000549"
+
+// frameHexStream writes chunks to f and returns hex encoded messages it yields.
+func frameHexStream(t *testing.T, f *framer, chunks ...string) []string {
+	var messages []string
+	for _, chunk := range chunks {
+		f.write(decodeHexStream(t, chunk), func(msg []byte) {
+			messages = append(messages, hex.EncodeToString(msg))
+		})
+	}
+	return messages
+}
+
+func Test_framer_With_ValidPacket_Yields_Each_Message(t *testing.T) {
+	messages := frameHexStream(t, newFramer(originBackend, false, defaultMaxMessageLen), authenticationStream)
+	if len(messages) != 14 {
+		t.Errorf("framer expected to yield 14 messages, but %d yielded", len(messages))
+	}
+}
+
+func Test_framer_With_ValidPacketChunks_Yields_Same_Messages(t *testing.T) {
+	want := frameHexStream(t, newFramer(originBackend, false, defaultMaxMessageLen), authenticationStream)
+
+	chunks := []string{"52000000080000000053000000166170", "706c69636174696f6e5f6e616d6500005300000019636c69656e745f656e636f64696e670055544638005300000017446174655374796c650049534f2c204d4459005300000019696e74656765725f6461746574696d6573006f6e00530000001b496e74657276616c5374796c6500706f73746772657300530000001569735f737570657275736572006f66660053000000197365727665725f656e636f64696e67005554463800530000001a7365727665725f76657273696f6e00392e362e313000530000002573657373696f6e5f617574686f72697a6174696f6e0079615f74657374696e670053000000237374616e646172645f636f6e666f726d696e675f737472696e6773006f6e00530000001154696d655a6f6e6500555443004b0000000c00000bbe3d082f", "545a0000000549"}
+	if got := frameHexStream(t, newFramer(originBackend, false, defaultMaxMessageLen), chunks...); !reflect.DeepEqual(got, want) {
+		t.Errorf("framer yielded %v, want %v", got, want)
+	}
+
+	// Byte by byte
+	chunks = chunks[:0]
+	for i := 0; i < len(authenticationStream); i += 2 {
+		chunks = append(chunks, authenticationStream[i:i+2])
+	}
+	if got := frameHexStream(t, newFramer(originBackend, false, defaultMaxMessageLen), chunks...); !reflect.DeepEqual(got, want) {
+		t.Errorf("framer yielded %v, want %v", got, want)
+	}
+}
+
+func Test_framer_Startup(t *testing.T) {
+	tests := []struct {
+		name     string
+		origin   byte
+		chunks   []string
+		want     []string
+		wantMode int
+		wantErr  error
+	}{
+		{
+			"Frontend_SSLRequest_Refused",
+			originFrontend,
+			[]string{"0000000804d2162f00", "00001b0003000075736572007500646174616261736500640000510000000d53454c45", "4354203100"},
+			[]string{"0000000804d2162f", "0000001b0003000075736572007500646174616261736500640000", "510000000d53454c454354203100"},
+			framerTyped,
+			nil,
+		},
+		{
+			"Frontend_SSLRequest_Accepted",
+			originFrontend,
+			[]string{"0000000804d2162f", "160301020001"},
+			[]string{"0000000804d2162f"},
+			framerOpaque,
+			nil,
+		},
+		{
+			"Frontend_CancelRequest",
+			originFrontend,
+			[]string{"0000001004d2162e00000bbe3d082f54"},
+			[]string{"0000001004d2162e00000bbe3d082f54"},
+			framerOpaque,
+			nil,
+		},
+		{
+			"Backend_SSLRequest_Refused",
+			originBackend,
+			[]string{"4e52000000", "08000000005a0000000549"},
+			[]string{"4e", "520000000800000000", "5a0000000549"},
+			framerTyped,
+			nil,
+		},
+		{
+			"Backend_SSLRequest_Accepted",
+			originBackend,
+			[]string{"53160303"},
+			[]string{"53"},
+			framerOpaque,
+			nil,
+		},
+		{
+			"Backend_Without_Encryption",
+			originBackend,
+			[]string{"5200000008000000005a0000000549"},
+			[]string{"520000000800000000", "5a0000000549"},
+			framerTyped,
+			nil,
+		},
+		{
+			"Invalid_Length",
+			originBackend,
+			[]string{"5a0000000049"},
+			nil,
+			framerOpaque,
+			errInvalidMessageLength,
+		},
+		{
+			"Frontend_Invalid_Startup_Length",
+			originFrontend,
+			[]string{"0000000400030000"},
+			nil,
+			framerOpaque,
+			errInvalidMessageLength,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFramer(tt.origin, true, defaultMaxMessageLen)
+			got := frameHexStream(t, f, tt.chunks...)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("framer yielded %v, want %v", got, tt.want)
+			}
+			if f.mode != tt.wantMode {
+				t.Errorf("framer mode = %d, want %d", f.mode, tt.wantMode)
+			}
+			if f.err != tt.wantErr {
+				t.Errorf("framer err = %v, want %v", f.err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_framer_Message_Too_Long(t *testing.T) {
+	f := newFramer(originBackend, false, 8)
+	// ReadyForQuery fits the limit, DataRow of 9 bytes doesn't, even before it arrives completely.
+	got := frameHexStream(t, f, "5a0000000549", "4400000009", "00010000")
+	if want := []string{"5a0000000549"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("framer yielded %v, want %v", got, want)
+	}
+	if f.mode != framerOpaque || f.err != errMessageTooLong {
+		t.Errorf("framer mode = %d, err = %v, want opaque mode and %v", f.mode, f.err, errMessageTooLong)
+	}
+	if f.tail != nil {
+		t.Error("framer keeps the beginning of the message")
+	}
+}
+
+func Test_framer_Skips_Bodies(t *testing.T) {
+	// CopyData with 10 bytes of data, which is longer than the limit, then CopyDone.
+	stream := "640000000e" + "00010203040506070809" + "6300000004"
+	tests := []struct {
+		name   string
+		chunks []string
+	}{
+		{"Whole", []string{stream}},
+		{"Chunks", []string{"6400", "00000e0001020304", "0506070809630000", "0004"}},
+		{"Header_Alone", []string{"640000000e", "00010203040506070809", "6300000004"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFramer(originFrontend, false, 8)
+			f.skipType = copyDataMessageType
+			got := frameHexStream(t, f, tt.chunks...)
+			if want := []string{"640000000e", "6300000004"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("framer yielded %v, want %v", got, want)
+			}
+			if f.mode != framerTyped || f.err != nil || f.tail != nil || f.skip != 0 {
+				t.Errorf("framer mode = %d, err = %v, tail = %v, skip = %d, want typed mode and nothing left", f.mode, f.err, f.tail, f.skip)
+			}
+		})
+	}
+}
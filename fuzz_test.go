@@ -0,0 +1,151 @@
+//go:build go1.18
+// +build go1.18
+
+package postgresql
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/backstage-app/postgresql/pgwire"
+)
+
+// fuzzMessages are the seeds of the fuzz targets decoding single messages.
+var fuzzMessages = []pgwire.Message{
+	&pgwire.StartupMessage{ProtocolVersion: pgwire.ProtocolVersion30, Parameters: map[string]string{"user": "u", "database": "d"}},
+	&pgwire.CancelRequest{ProcessID: 1, SecretKey: []byte{1, 2, 3, 4}},
+	&pgwire.SSLRequest{},
+	&pgwire.Query{String: "SELECT 1; SELECT 2"},
+	&pgwire.Parse{Name: "s", Query: "SELECT $1", ParameterOIDs: []uint32{23}},
+	&pgwire.Bind{Portal: "p", Statement: "s", ParameterFormats: []pgwire.Format{pgwire.BinaryFormat}, Parameters: [][]byte{{0, 0, 0, 1}, nil},
+		ResultFormats: []pgwire.Format{pgwire.TextFormat}},
+	&pgwire.Describe{ObjectType: pgwire.ObjectStatement, Name: "s"},
+	&pgwire.Execute{Portal: "p", MaxRows: 10},
+	&pgwire.Close{ObjectType: pgwire.ObjectPortal, Name: "p"},
+	&pgwire.Sync{},
+	&pgwire.Flush{},
+	&pgwire.AuthenticationSASL{Mechanisms: []string{"SCRAM-SHA-256"}},
+	&pgwire.AuthenticationMD5Password{Salt: [4]byte{1, 2, 3, 4}},
+	&pgwire.ParameterStatus{Name: "TimeZone", Value: "UTC"},
+	&pgwire.BackendKeyData{ProcessID: 1, SecretKey: []byte{1, 2, 3, 4}},
+	&pgwire.ParameterDescription{ParameterOIDs: []uint32{23, 25}},
+	&pgwire.RowDescription{Fields: []pgwire.FieldDescription{{Name: "a", DataTypeOID: 23, DataTypeSize: 4, TypeModifier: -1}}},
+	&pgwire.DataRow{Values: [][]byte{[]byte("1"), nil}},
+	&pgwire.CommandComplete{Tag: "INSERT 0 1"},
+	&pgwire.ErrorResponse{Severity: "ERROR", Code: "42601", Message: "m", Position: 1, Line: 2},
+	&pgwire.NoticeResponse{Severity: "NOTICE", Message: "n"},
+	&pgwire.ReadyForQuery{TxStatus: pgwire.TxIdle},
+	&pgwire.ParseComplete{},
+	&pgwire.CopyInResponse{Format: pgwire.TextFormat, ColumnFormats: []pgwire.Format{pgwire.TextFormat}},
+	&pgwire.CopyData{Data: []byte("1,a\n")},
+	&pgwire.CopyDone{},
+	&pgwire.CopyFail{Message: "aborted"},
+}
+
+func Fuzz_decodeMessage(f *testing.F) {
+	for _, m := range fuzzMessages {
+		f.Add(m.Encode(nil), true)
+		f.Add(m.Encode(nil), false)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, frontend bool) {
+		origin := byte(originBackend)
+		if frontend {
+			origin = originFrontend
+		}
+		m, err := decodeMessage(data, origin)
+		if err != nil {
+			if frontend {
+				_ = newUndecodedMessage(data)
+			}
+			return
+		}
+		_ = limitFieldLen(m, 8)
+		if b, ok := m.(*bindMessage); ok {
+			_ = decodeParams([]oid{oidInt4, oidNumeric, oidTextArray}, b)
+		}
+	})
+}
+
+func Fuzz_decodeParam(f *testing.F) {
+	f.Add(uint32(oidInt4), true, []byte{0, 0, 0, 1})
+	f.Add(uint32(oidNumeric), true, []byte{0, 2, 0, 0, 0, 0, 0, 4, 0, 1, 0x09, 0x29})
+	f.Add(uint32(oidTimestamp), true, []byte{0, 0, 0, 0, 0, 0, 0, 1})
+	f.Add(uint32(oidInt4Array), true, decodeHexStream(f, "00000001000000000000001700000002000000010000000400000001ffffffff"))
+	f.Add(uint32(oidText), false, []byte("text"))
+	f.Fuzz(func(t *testing.T, typ uint32, binary bool, value []byte) {
+		format := formatText
+		if binary {
+			format = formatBinary
+		}
+		_, _ = decodeParam(oid(typ), format, value)
+	})
+}
+
+func Fuzz_decodeAuthenticationMessages(f *testing.F) {
+	f.Add([]byte("md5abc\x00"))
+	f.Add([]byte("SCRAM-SHA-256\x00\x00\x00\x00\x03n,,"))
+	f.Add([]byte("\x00\x00\x00\x0aSCRAM-SHA-256\x00\x00"))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		msg := encodeMessage(passwordMessageType, body)
+		_ = decodePasswordMessage(msg, true)
+		_ = decodePasswordMessage(msg, false)
+		_, _ = decodeSASLInitialResponseMessage(msg)
+
+		msg = encodeMessage(authenticationMessageType, body)
+		if isAuthenticationMessage(msg) {
+			_ = decodeSASLMechanisms(decodeAuthenticationMessage(msg))
+		}
+	})
+}
+
+func Fuzz_scramServer(f *testing.F) {
+	verifier := newSCRAMVerifier("password", []byte("salt"), 1)
+	f.Add("n,,n=,r=abc", "c=biws,r=abcdef,p=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", "SCRAM-SHA-256$4096:c2FsdA==$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+	f.Fuzz(func(t *testing.T, clientFirst, clientFinal, stored string) {
+		s := newSCRAMServer(verifier, "def")
+		if _, err := s.first(clientFirst); err == nil {
+			_, _ = s.final(clientFinal)
+		}
+		_, _ = parseSCRAMVerifier(stored)
+	})
+}
+
+func Fuzz_framer(f *testing.F) {
+	f.Add(decodeHexStream(f, authenticationStream), false, false, 7)
+	f.Add(decodeHexStream(f, "0000000804d2162f"+"0000001b0003000075736572007500646174616261736500640000"+"510000000d53454c454354203100"), true, true, 10)
+	f.Add(decodeHexStream(f, "4e"+"520000000800000000"+"5a0000000549"), false, true, 1)
+	f.Add(decodeHexStream(f, "640000000e"+"00010203040506070809"+"6300000004"), true, false, 3)
+	f.Fuzz(func(t *testing.T, stream []byte, frontend, startup bool, split int) {
+		origin := byte(originBackend)
+		if frontend {
+			origin = originFrontend
+		}
+		frame := func(skipType byte, chunks ...[]byte) ([][]byte, error) {
+			var messages [][]byte
+			fr := newFramer(origin, startup, 1<<16)
+			fr.skipType = skipType
+			defer fr.close()
+			for _, chunk := range chunks {
+				fr.write(chunk, func(msg []byte) {
+					messages = append(messages, append([]byte(nil), msg...))
+				})
+			}
+			return messages, fr.err
+		}
+
+		for _, skipType := range []byte{0, copyDataMessageType} {
+			whole, wholeErr := frame(skipType, stream)
+			if framed := bytes.Join(whole, nil); skipType == 0 && !bytes.HasPrefix(stream, framed) {
+				t.Fatalf("framed %x isn't the beginning of %x", framed, stream)
+			}
+			if split < 0 || split > len(stream) {
+				return
+			}
+			chunked, chunkedErr := frame(skipType, stream[:split], stream[split:])
+			if !reflect.DeepEqual(chunked, whole) || chunkedErr != wholeErr {
+				t.Fatalf("framed in chunks %x, %v, want %x, %v", chunked, chunkedErr, whole, wholeErr)
+			}
+		}
+	})
+}
@@ -1,5 +1,5 @@
 module github.com/backstage-app/postgresql
 
-go 1.13
+go 1.16
 
 require github.com/golang-collections/collections v0.0.0-20130729185459-604e922904d3
@@ -0,0 +1,238 @@
+package postgresql
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/backstage-app/postgresql/pgwire"
+)
+
+// ErrUntypedMessage is returned by SendMessageToClient and SendMessageToServer for the messages which aren't
+// encoded as complete typed messages, e.g. the untyped StartupMessage or EncryptionResponse.
+var ErrUntypedMessage = errors.New("postgresql: message isn't a complete typed message")
+
+// Interceptor inspects and changes protocol messages passing through Proxy.
+// Frontend is called for each message the client sends before it's passed on to the target,
+// Backend is called for each message the target sends before it's passed on to the client.
+// Both are called from the goroutines serving the connection, so they must not block for long.
+type Interceptor interface {
+	Frontend(m *Message)
+	Backend(m *Message)
+}
+
+// Message is a protocol message intercepted by Interceptor. The interceptor may pass it on unchanged,
+// change its Body, drop it or send extra messages in either direction.
+//
+// Messages sent in the direction of the intercepted message precede it. Messages sent to the client
+// while a frontend message is intercepted follow the responses to all messages the target got before.
+// Messages sent to the target while a backend message is intercepted are sent right away.
+// Sent messages aren't intercepted, and the target's responses to them are passed on to the client
+// as any other, so the interceptor which sends queries to the target has to drop the responses itself.
+//
+// The statements reported by Proxy are the ones the client sends and gets responses to,
+// i.e. the frontend messages before interception and the backend messages after it.
+type Message struct {
+	// Session describes the connection the message is sent in.
+	Session SessionInfo
+	// Type is the type byte of the message. It's zero for the untyped messages frontend starts
+	// the connection with, e.g. StartupMessage.
+	Type byte
+	// Body is the content of the message following its length. The interceptor may change it in place
+	// or replace it, the length of the message is recomputed. Body is valid only until the interceptor returns.
+	Body []byte
+
+	dropped  bool
+	toClient []byte
+	toServer []byte
+}
+
+// Drop drops the message, so that it reaches neither the rest of interceptors nor its recipient.
+func (m *Message) Drop() {
+	m.dropped = true
+}
+
+// Dropped returns true if the message was dropped by one of the interceptors.
+func (m *Message) Dropped() bool {
+	return m.dropped
+}
+
+// SendToClient sends a message of the type with the body to the client.
+func (m *Message) SendToClient(typ byte, body []byte) {
+	m.toClient = append(m.toClient, encodeMessage(typ, body)...)
+}
+
+// SendToServer sends a message of the type with the body to the target.
+func (m *Message) SendToServer(typ byte, body []byte) {
+	m.toServer = append(m.toServer, encodeMessage(typ, body)...)
+}
+
+// SendMessageToClient sends the message encoded by pgwire to the client, e.g. pgwire.NoticeResponse.
+// It returns an error wrapping ErrUntypedMessage and sends nothing if msg isn't encoded as typed messages.
+func (m *Message) SendMessageToClient(msg pgwire.Message) error {
+	var err error
+	m.toClient, err = appendEncoded(m.toClient, msg)
+	return err
+}
+
+// SendMessageToServer sends the message encoded by pgwire to the target, e.g. pgwire.Query.
+// It returns an error wrapping ErrUntypedMessage and sends nothing if msg isn't encoded as typed messages.
+func (m *Message) SendMessageToServer(msg pgwire.Message) error {
+	var err error
+	m.toServer, err = appendEncoded(m.toServer, msg)
+	return err
+}
+
+// appendEncoded appends msg to dst unless it isn't encoded as one or more complete typed messages.
+func appendEncoded(dst []byte, msg pgwire.Message) ([]byte, error) {
+	start := len(dst)
+	dst = msg.Encode(dst)
+	if n, err := typedMessagesLen(dst[start:]); err != nil || n == 0 {
+		return dst[:start], fmt.Errorf("%w: %T", ErrUntypedMessage, msg)
+	}
+	return dst, nil
+}
+
+// interceptorChain runs the messages of a single connection through interceptors.
+// The first interceptor is the closest one to the client: it gets frontend messages first
+// and backend messages last.
+type interceptorChain struct {
+	interceptors []Interceptor
+	session      *session
+	message      Message
+}
+
+func newInterceptorChain(interceptors []Interceptor, s *session) *interceptorChain {
+	if len(interceptors) == 0 {
+		return nil
+	}
+	return &interceptorChain{interceptors: interceptors, session: s}
+}
+
+// frontend runs the message of the client through the chain and appends the resulting messages
+// to the ones for the target and the ones for the client. A nil chain passes the message on unchanged.
+// typed is false for the untyped messages of the startup phase.
+func (c *interceptorChain) frontend(msg []byte, typed bool, toServer, toClient []byte) ([]byte, []byte) {
+	if c == nil {
+		return append(toServer, msg...), toClient
+	}
+	m := c.intercept(msg, typed, true)
+	toServer = c.check(append(toServer, m.toServer...), len(toServer), true)
+	if !m.dropped {
+		start := len(toServer)
+		toServer = appendMessage(toServer, msg, typed, m)
+		if typed {
+			toServer = c.check(toServer, start, true)
+		}
+	}
+	return toServer, c.check(append(toClient, m.toClient...), len(toClient), false)
+}
+
+// backend runs the message of the target through the chain and appends the resulting messages
+// to the ones for the client and the ones for the target. A nil chain passes the message on unchanged.
+func (c *interceptorChain) backend(msg, toClient, toServer []byte) ([]byte, []byte) {
+	if c == nil {
+		return append(toClient, msg...), toServer
+	}
+	m := c.intercept(msg, true, false)
+	toClient = c.check(append(toClient, m.toClient...), len(toClient), false)
+	if !m.dropped {
+		start := len(toClient)
+		toClient = c.check(appendMessage(toClient, msg, true, m), start, false)
+	}
+	return toClient, c.check(append(toServer, m.toServer...), len(toServer), true)
+}
+
+// check cuts the messages the interceptors appended to out past start at the first one which isn't
+// a complete typed message, since the messages following it can't be told apart. The cut is reported
+// as ProtocolError, frontend tells whether the messages go to the target.
+func (c *interceptorChain) check(out []byte, start int, frontend bool) []byte {
+	n, err := typedMessagesLen(out[start:])
+	if err != nil {
+		c.session.protocolError(frontend, err)
+		return out[:start+n]
+	}
+	return out
+}
+
+func (c *interceptorChain) intercept(msg []byte, typed, frontend bool) *Message {
+	m := &c.message
+	*m = Message{Session: c.session.snapshot(), toClient: m.toClient[:0], toServer: m.toServer[:0]}
+	if typed {
+		m.Type = msg[0]
+		m.Body = msg[minPacketLen:]
+	} else {
+		m.Body = msg[4:]
+	}
+
+	for i := range c.interceptors {
+		if frontend {
+			c.interceptors[i].Frontend(m)
+		} else {
+			c.interceptors[len(c.interceptors)-1-i].Backend(m)
+		}
+		if m.dropped {
+			break
+		}
+	}
+	return m
+}
+
+// appendMessage appends msg with the type and the body changed by the interceptors to out.
+func appendMessage(out, msg []byte, typed bool, m *Message) []byte {
+	var typ byte
+	body := msg[4:]
+	if typed {
+		typ = msg[0]
+		body = msg[minPacketLen:]
+	}
+	if m.Type == typ && len(m.Body) == len(body) && (len(body) == 0 || &m.Body[0] == &body[0]) {
+		// The message is either unchanged or changed in place.
+		return append(out, msg...)
+	}
+	if m.Type != 0 {
+		return append(out, encodeMessage(m.Type, m.Body)...)
+	}
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(4+len(m.Body)))
+	return append(append(out, length...), m.Body...)
+}
+
+// typedMessagesLen returns the length of the complete typed messages msgs starts with.
+// It returns an error wrapping ErrMalformedMessage if they are followed by anything else.
+func typedMessagesLen(msgs []byte) (int, error) {
+	n := 0
+	for n < len(msgs) {
+		length := typedMessageLen(msgs[n:])
+		if length == 0 {
+			return n, fmt.Errorf("%w: interceptor sent an incomplete or untyped message", ErrMalformedMessage)
+		}
+		n += length
+	}
+	return n, nil
+}
+
+// typedMessageLen returns the length of the complete typed message msgs starts with, or zero if there is none.
+func typedMessageLen(msgs []byte) int {
+	if len(msgs) < minPacketLen || msgs[0] == 0 {
+		return 0
+	}
+	length := binary.BigEndian.Uint32(msgs[1:minPacketLen])
+	if length < 4 || int64(length) > int64(len(msgs)-1) {
+		return 0
+	}
+	return 1 + int(length)
+}
+
+// forEachMessage calls yield for each of the complete typed messages msgs starts with.
+// The interceptor chain checks its output, so anything else never follows them.
+func forEachMessage(msgs []byte, yield func(msg []byte)) {
+	for {
+		n := typedMessageLen(msgs)
+		if n == 0 {
+			return
+		}
+		yield(msgs[:n])
+		msgs = msgs[n:]
+	}
+}
@@ -0,0 +1,194 @@
+package postgresql
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/backstage-app/postgresql/pgwire"
+)
+
+// testInterceptor tags queries with a comment, answers forbidden ones itself
+// and raises a notice before each CommandComplete.
+type testInterceptor struct{}
+
+func (testInterceptor) Frontend(m *Message) {
+	if m.Type != queryMessageType {
+		return
+	}
+	if bytes.HasPrefix(m.Body, []byte("SELECT secret")) {
+		m.Drop()
+		m.SendToClient(errorMessageType, encodeErrorResponse("ERROR", "42501", "secret")[minPacketLen:])
+		m.SendToClient(readyForQueryMessageType, []byte{'I'})
+		return
+	}
+	m.Body = append([]byte("/* tagged */ "), m.Body...)
+}
+
+func (testInterceptor) Backend(m *Message) {
+	if m.Type == commandCompleteMessageType {
+		m.SendToClient(noticeMessageType, encodeErrorResponse("NOTICE", "00000", "intercepted")[minPacketLen:])
+	}
+}
+
+func Test_Proxy_Intercept(t *testing.T) {
+	for _, pooled := range []bool{false, true} {
+		name := "Direct"
+		if pooled {
+			name = "Pooled"
+		}
+		t.Run(name, func(t *testing.T) {
+			backend := startTestPoolBackend(t)
+			recorder := newEventRecorder()
+			proxy := NewEventProxy(recorder).To(backend.Addr().String()).Intercept(testInterceptor{})
+			if pooled {
+				proxy.Authenticate(AuthPassword, CredentialMap{"app": {Password: "secret", TargetUser: "db_user"}}).Pool(PoolTransaction, 1)
+			}
+			addr, _ := startTestProxy(t, proxy)
+			defer proxy.Shutdown(context.Background())
+
+			var conn net.Conn
+			if pooled {
+				conn, _ = connectPooledClient(t, addr)
+			} else {
+				conn = connectTestClient(t, addr, false)
+				if got := exchangeTestMessages(t, conn); got != "RSKZI" {
+					t.Fatalf("startup = %s", got)
+				}
+			}
+
+			if got := exchangeTestMessages(t, conn, testQuery("SELECT 1")); got != "NCZI" {
+				t.Errorf("SELECT 1 = %s, want NCZI", got)
+			}
+			if got := exchangeTestMessages(t, conn, testQuery("SELECT secret")); got != "EZI" {
+				t.Errorf("SELECT secret = %s, want EZI", got)
+			}
+			_, queries, _ := backend.stats()
+			if want := "/* tagged */ SELECT 1"; strings.Join(queries, ",") != want {
+				t.Errorf("queries = %v, want %s", queries, want)
+			}
+
+			recorder.mu.Lock()
+			defer recorder.mu.Unlock()
+			var reported []string
+			for _, e := range recorder.events {
+				if q, ok := e.(*Query); ok {
+					reported = append(reported, q.Query)
+				}
+			}
+			if want := "SELECT 1,SELECT secret"; strings.Join(reported, ",") != want {
+				t.Errorf("reported = %v, want %s", reported, want)
+			}
+		})
+	}
+}
+
+func Test_Message_Send_Encoded(t *testing.T) {
+	var m Message
+	m.SendMessageToClient(&pgwire.ReadyForQuery{TxStatus: pgwire.TxIdle})
+	m.SendMessageToServer(&pgwire.Sync{})
+	m.SendMessageToServer(&pgwire.Query{String: "SELECT 1"})
+	if want := decodeHexStream(t, "5a0000000549"); !bytes.Equal(m.toClient, want) {
+		t.Errorf("toClient = %x, want %x", m.toClient, want)
+	}
+	if want := decodeHexStream(t, "5300000004"+"510000000d53454c454354203100"); !bytes.Equal(m.toServer, want) {
+		t.Errorf("toServer = %x, want %x", m.toServer, want)
+	}
+
+	for _, msg := range []pgwire.Message{&pgwire.StartupMessage{ProtocolVersion: pgwire.ProtocolVersion30}, &pgwire.EncryptionResponse{}} {
+		if err := m.SendMessageToServer(msg); !errors.Is(err, ErrUntypedMessage) {
+			t.Errorf("SendMessageToServer(%T) = %v, want ErrUntypedMessage", msg, err)
+		}
+		if err := m.SendMessageToClient(msg); !errors.Is(err, ErrUntypedMessage) {
+			t.Errorf("SendMessageToClient(%T) = %v, want ErrUntypedMessage", msg, err)
+		}
+	}
+	if want := decodeHexStream(t, "5a0000000549"); !bytes.Equal(m.toClient, want) {
+		t.Errorf("toClient after untyped messages = %x, want %x", m.toClient, want)
+	}
+}
+
+// untypedInterceptor sends a message without the type byte to the target before each query.
+type untypedInterceptor struct{}
+
+func (untypedInterceptor) Frontend(m *Message) {
+	if m.Type == queryMessageType {
+		m.SendToServer(0, []byte("x"))
+	}
+}
+
+func (untypedInterceptor) Backend(m *Message) {}
+
+func Test_Proxy_Intercept_Untyped_Message(t *testing.T) {
+	for _, pooled := range []bool{false, true} {
+		name := "Direct"
+		if pooled {
+			name = "Pooled"
+		}
+		t.Run(name, func(t *testing.T) {
+			backend := startTestPoolBackend(t)
+			recorder := newEventRecorder()
+			proxy := NewEventProxy(recorder).To(backend.Addr().String()).Intercept(untypedInterceptor{})
+			if pooled {
+				proxy.Authenticate(AuthPassword, CredentialMap{"app": {Password: "secret", TargetUser: "db_user"}}).Pool(PoolTransaction, 1)
+			}
+			addr, _ := startTestProxy(t, proxy)
+			defer proxy.Shutdown(context.Background())
+
+			var conn net.Conn
+			if pooled {
+				conn, _ = connectPooledClient(t, addr)
+			} else {
+				conn = connectTestClient(t, addr, false)
+				if got := exchangeTestMessages(t, conn); got != "RSKZI" {
+					t.Fatalf("startup = %s", got)
+				}
+			}
+
+			// The untyped message is dropped, the query of the client goes on.
+			if got := exchangeTestMessages(t, conn, testQuery("SELECT 1")); got != "CZI" {
+				t.Errorf("SELECT 1 = %s, want CZI", got)
+			}
+
+			recorder.mu.Lock()
+			defer recorder.mu.Unlock()
+			reported := false
+			for _, e := range recorder.events {
+				if e, ok := e.(*ProtocolError); ok && e.Frontend && errors.Is(e.Err, ErrMalformedMessage) {
+					reported = true
+				}
+			}
+			if !reported {
+				t.Errorf("events = %v, want ProtocolError about the untyped message", recorder.events)
+			}
+		})
+	}
+}
+
+func Test_typedMessagesLen(t *testing.T) {
+	tests := []struct {
+		name  string
+		msgs  string
+		want  int
+		valid bool
+	}{
+		{name: "Empty", msgs: "", want: 0, valid: true},
+		{name: "Messages", msgs: "5300000004" + "510000000d53454c454354203100", want: 19, valid: true},
+		{name: "Untyped", msgs: "5300000004" + "0000000804d2162f", want: 5},
+		{name: "Length_Past_End", msgs: "5300000004" + "51ffffffff00", want: 5},
+		{name: "Length_Below_Minimum", msgs: "5100000003", want: 0},
+		{name: "Incomplete_Header", msgs: "5300000004" + "5a0000", want: 5},
+		{name: "Single_Byte", msgs: "4e", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := typedMessagesLen(decodeHexStream(t, tt.msgs))
+			if got != tt.want || (err == nil) != tt.valid {
+				t.Errorf("typedMessagesLen() = %d, %v, want %d, valid %v", got, err, tt.want, tt.valid)
+			}
+		})
+	}
+}
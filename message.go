@@ -3,31 +3,97 @@ package postgresql
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
-	"fmt"
-	"io"
+	"strconv"
+	"strings"
+
+	"github.com/backstage-app/postgresql/pgwire"
 )
 
 type oid uint32
 type format uint16
 
 const (
-	oidInt8   oid = 20
-	oidFloat8 oid = 701
-	oidJsonb  oid = 3802
-
-	fieldSeverity1 = 0x53 //S
-	fieldSeverity2 = 0x56 //V
-	fieldCode      = 0x34 //C
-	fieldMessage   = 0x4d //M
+	oidUnspecified oid = 0
+	oidBool        oid = 16
+	oidBytea       oid = 17
+	oidChar        oid = 18
+	oidName        oid = 19
+	oidInt8        oid = 20
+	oidInt2        oid = 21
+	oidInt4        oid = 23
+	oidText        oid = 25
+	oidOid         oid = 26
+	oidJson        oid = 114
+	oidFloat4      oid = 700
+	oidFloat8      oid = 701
+	oidUnknown     oid = 705
+	oidBpchar      oid = 1042
+	oidVarchar     oid = 1043
+	oidDate        oid = 1082
+	oidTimestamp   oid = 1114
+	oidTimestamptz oid = 1184
+	oidNumeric     oid = 1700
+	oidUUID        oid = 2950
+	oidJsonb       oid = 3802
+
+	oidJsonArray        oid = 199
+	oidBoolArray        oid = 1000
+	oidByteaArray       oid = 1001
+	oidInt2Array        oid = 1005
+	oidInt4Array        oid = 1007
+	oidTextArray        oid = 1009
+	oidBpcharArray      oid = 1014
+	oidVarcharArray     oid = 1015
+	oidInt8Array        oid = 1016
+	oidFloat4Array      oid = 1021
+	oidFloat8Array      oid = 1022
+	oidOidArray         oid = 1028
+	oidTimestampArray   oid = 1115
+	oidDateArray        oid = 1182
+	oidTimestamptzArray oid = 1185
+	oidNumericArray     oid = 1231
+	oidUUIDArray        oid = 2951
+	oidJsonbArray       oid = 3807
 
 	formatText   format = 0x00
 	formatBinary format = 0x01
 
-	bindMessageType            = 0x42
-	parseMessageType           = 0x50
-	errorMessageType           = 0x45
-	commandCompleteMessageType = 0x43
+	bindMessageType                 = 0x42
+	closeMessageType                = 0x43
+	describeMessageType             = 0x44
+	executeMessageType              = 0x45
+	flushMessageType                = 0x48
+	parseMessageType                = 0x50
+	queryMessageType                = 0x51
+	syncMessageType                 = 0x53
+	terminateMessageType            = 0x58
+	errorMessageType                = 0x45
+	noticeMessageType               = 0x4e
+	commandCompleteMessageType      = 0x43
+	dataRowMessageType              = 0x44
+	emptyQueryResponseMessageType   = 0x49
+	parseCompleteMessageType        = 0x31
+	bindCompleteMessageType         = 0x32
+	closeCompleteMessageType        = 0x33
+	noDataMessageType               = 0x6e
+	portalSuspendedMessageType      = 0x73
+	parameterDescriptionMessageType = 0x74
+	rowDescriptionMessageType       = 0x54
+	readyForQueryMessageType        = 0x5a
+	parameterStatusMessageType      = 0x53
+	backendKeyDataMessageType       = 0x4b
+	authenticationMessageType       = 0x52
+	passwordMessageType             = 0x70
+	copyInResponseMessageType       = 0x47
+	copyOutResponseMessageType      = 0x48
+	copyBothResponseMessageType     = 0x57
+	copyDataMessageType             = 0x64
+	copyDoneMessageType             = 0x63
+	copyFailMessageType             = 0x66
+
+	// Kinds of objects targeted by Close and Describe messages.
+	targetStatement = 0x53 //S
+	targetPortal    = 0x50 //P
 )
 
 // CommandComplete (B)
@@ -37,36 +103,161 @@ type commandCompleteMessage struct {
 	tag string
 }
 
-// isCommandCompleteMessage returns true if data is CommandComplete message.
-func isCommandCompleteMessage(data []byte) bool {
-	if len(data) < 5 {
-		return false
+func decodeCommandCompleteMessage(data []byte) (*commandCompleteMessage, error) {
+	var m pgwire.CommandComplete
+	if err := m.Decode(data[minPacketLen:]); err != nil {
+		return nil, err
 	}
-	if data[0] != commandCompleteMessageType {
-		return false
+	return &commandCompleteMessage{tag: m.Tag}, nil
+}
+
+// parseCommandTag splits command tag into the command name and the number of rows it processed.
+// Possible tag formats are:
+//
+//	INSERT oid rows
+//	DELETE rows, UPDATE rows, MERGE rows, SELECT rows, MOVE rows, FETCH rows, COPY rows
+//	COPY (servers prior to 8.2 don't report rows count for COPY)
+//	any other command name, e.g. CREATE TABLE or BEGIN, without rows count.
+func parseCommandTag(tag string) (command string, rows uint) {
+	fields := strings.Fields(tag)
+	if len(fields) == 0 {
+		return "", 0
 	}
-	pktLen := binary.BigEndian.Uint32(data[1:5]) + 1
-	return pktLen == uint32(len(data))
+
+	command = fields[0]
+	switch command {
+	case "INSERT":
+		if len(fields) != 3 {
+			return command, 0
+		}
+	case "DELETE", "UPDATE", "MERGE", "SELECT", "MOVE", "FETCH", "COPY":
+		if len(fields) != 2 {
+			return command, 0
+		}
+	default:
+		return strings.Join(fields, " "), 0
+	}
+
+	n, err := strconv.ParseUint(fields[len(fields)-1], 10, 64)
+	if err != nil {
+		return command, 0
+	}
+	return command, uint(n)
 }
 
-func decodeCommandCompleteMessage(data []byte) (*commandCompleteMessage, error) {
-	c := &commandCompleteMessage{}
+// DataRow (B)
+// Only the fact of arrival of DataRow is interesting, so its content isn't decoded.
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type dataRowMessage struct{}
+
+// EmptyQueryResponse (B)
+// It's sent instead of CommandComplete in response to an empty query string.
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type emptyQueryResponseMessage struct{}
+
+// ParseComplete (B)
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type parseCompleteMessage struct{}
+
+// isParseCompleteMessage returns true if data is ParseComplete message.
+func isParseCompleteMessage(data []byte) bool {
+	return len(data) == 5 && isMessageOfType(data, parseCompleteMessageType)
+}
 
-	r := bytes.NewReader(data)
+// BindComplete (B)
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type bindCompleteMessage struct{}
 
-	// Skip packet header
-	if _, err := r.Seek(5, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("decodeParseMessage: %w", err)
+// CloseComplete (B)
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type closeCompleteMessage struct{}
+
+// NoData (B)
+// It's sent in response to Describe of a statement or portal which doesn't return rows.
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type noDataMessage struct{}
+
+// RowDescription (B)
+// Only the fact of arrival of RowDescription is interesting, so its content isn't decoded.
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type rowDescriptionMessage struct{}
+
+// PortalSuspended (B)
+// It's sent instead of CommandComplete when Execute's row-count limit was reached.
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type portalSuspendedMessage struct{}
+
+// ParameterDescription (B)
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type parameterDescriptionMessage struct {
+	// Specifies the object ID of each parameter data type.
+	oids []oid
+}
+
+func decodeParameterDescriptionMessage(data []byte) (*parameterDescriptionMessage, error) {
+	var m pgwire.ParameterDescription
+	if err := m.Decode(data[minPacketLen:]); err != nil {
+		return nil, err
+	}
+	return &parameterDescriptionMessage{oids: convertOIDs(m.ParameterOIDs)}, nil
+}
+
+// Query (F)
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type queryMessage struct {
+	// The query string itself. It may contain several statements separated by semicolons.
+	query string
+}
+
+func decodeQueryMessage(data []byte) (*queryMessage, error) {
+	var m pgwire.Query
+	if err := m.Decode(data[minPacketLen:]); err != nil {
+		return nil, err
 	}
+	return &queryMessage{query: m.String}, nil
+}
+
+// Sync (F)
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type syncMessage struct{}
+
+// Flush (F)
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type flushMessage struct{}
 
-	c.tag = readNullTerminatedString(r)
+// ReadyForQuery (B)
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type readyForQueryMessage struct {
+	// Current backend transaction status indicator.
+	// Possible values are 'I' if idle (not in a transaction block);
+	// 'T' if in a transaction block; or 'E' if in a failed transaction block.
+	status byte
+}
+
+// isReadyForQueryMessage returns true if data is ReadyForQuery message.
+func isReadyForQueryMessage(data []byte) bool {
+	if len(data) != 6 {
+		return false
+	}
+	if data[0] != readyForQueryMessageType {
+		return false
+	}
+	return binary.BigEndian.Uint32(data[1:5]) == 5
+}
 
-	return c, nil
+func decodeReadyForQueryMessage(data []byte) (*readyForQueryMessage, error) {
+	var m pgwire.ReadyForQuery
+	if err := m.Decode(data[minPacketLen:]); err != nil {
+		return nil, err
+	}
+	return &readyForQueryMessage{status: m.TxStatus}, nil
 }
 
 // Parse (F)
 // See https://www.postgresql.org/docs/current/protocol-message-formats.html
 type parseMessage struct {
+	// The name of the destination prepared statement (an empty string selects the unnamed prepared statement).
+	name string
 	// The query string to be parsed.
 	query string
 	// The number of parameter data types specified (can be zero).
@@ -78,195 +269,191 @@ type parseMessage struct {
 	oids []oid
 }
 
-// isParseMessage returns true if data is Parse message.
-func isParseMessage(data []byte) bool {
-	if len(data) < 5 {
-		return false
-	}
-	if data[0] != parseMessageType {
-		return false
-	}
-	pktLen := binary.BigEndian.Uint32(data[1:5]) + 1
-	return pktLen == uint32(len(data))
-}
-
 func decodeParseMessage(data []byte) (*parseMessage, error) {
-	p := &parseMessage{}
-
-	r := bytes.NewReader(data)
-
-	// Skip packet header
-	if _, err := r.Seek(5, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("decodeParseMessage: %w", err)
+	var m pgwire.Parse
+	if err := m.Decode(data[minPacketLen:]); err != nil {
+		return nil, err
 	}
-
-	// Skip name of the destination prepared statement
-	skipNullTerminatedString(r)
-
-	// Parsing query string
-	p.query = readNullTerminatedString(r)
-
-	// Parsing number of parameters
-	paramsBuf := make([]byte, 2)
-	n, err := r.Read(paramsBuf)
-	if n < len(paramsBuf) {
-		return nil, errors.New("decodeParseMessage: read to paramsBuf failed")
-	}
-	if err != nil {
-		return nil, fmt.Errorf("decodeParseMessage: %w", err)
-	}
-	p.paramsNum = binary.BigEndian.Uint16(paramsBuf)
-
-	// Parsing parameters OIDs
-	oidBuf := make([]byte, 4)
-	for i := uint16(1); i <= p.paramsNum; i++ {
-		n, err = r.Read(oidBuf)
-		if n < len(oidBuf) {
-			return nil, errors.New("decodeParseMessage: read to oidBuf failed")
-		}
-		if err != nil {
-			return nil, fmt.Errorf("decodeParseMessage: %w", err)
-		}
-		p.oids = append(p.oids, oid(binary.BigEndian.Uint32(oidBuf)))
+	var oids []oid
+	if len(m.ParameterOIDs) > 0 {
+		oids = convertOIDs(m.ParameterOIDs)
 	}
-
-	return p, nil
+	return &parseMessage{name: m.Name, query: m.Query, paramsNum: uint16(len(oids)), oids: oids}, nil
 }
 
 // Bind (F)
 // See https://www.postgresql.org/docs/current/protocol-message-formats.html
 type bindMessage struct {
+	portal     string
 	statement  string
 	formatsNum uint16
 	valuesNum  uint16
 	formats    []format
 	values     [][]byte
+	// resultFormatsNum and resultFormats are the format codes of the result columns.
+	// They follow the same rules as the formats of parameters.
+	resultFormatsNum uint16
+	resultFormats    []format
 }
 
-func isBindMessage(data []byte) bool {
-	if len(data) < 5 {
-		return false
+func decodeBindMessage(data []byte) (*bindMessage, error) {
+	var m pgwire.Bind
+	if err := m.Decode(data[minPacketLen:]); err != nil {
+		return nil, err
 	}
-	if data[0] != bindMessageType {
-		return false
+	b := &bindMessage{
+		portal:           m.Portal,
+		statement:        m.Statement,
+		formatsNum:       uint16(len(m.ParameterFormats)),
+		valuesNum:        uint16(len(m.Parameters)),
+		formats:          convertFormats(m.ParameterFormats),
+		values:           make([][]byte, len(m.Parameters)),
+		resultFormatsNum: uint16(len(m.ResultFormats)),
+		resultFormats:    convertFormats(m.ResultFormats),
 	}
-	pktLen := binary.BigEndian.Uint32(data[1:5]) + 1
-	return pktLen == uint32(len(data))
+	// The values refer to data, which is reused once the message is decoded.
+	for i, value := range m.Parameters {
+		if value != nil {
+			b.values[i] = append([]byte{}, value...)
+		}
+	}
+	return b, nil
 }
 
-func decodeBindMessage(data []byte) (*bindMessage, error) {
-	b := &bindMessage{}
-
-	r := bytes.NewReader(data)
-
-	// Skip packet header
-	if _, err := r.Seek(5, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("decodeBindMessage: %w", err)
+// convertFormats converts pgwire formats, the result isn't nil even if there are no formats.
+func convertFormats(formats []pgwire.Format) []format {
+	converted := make([]format, len(formats))
+	for i, f := range formats {
+		converted[i] = format(f)
 	}
+	return converted
+}
 
-	// Skip name of the destination portal
-	skipNullTerminatedString(r)
-
-	// Parse statement string
-	b.statement = readNullTerminatedString(r)
-
-	twoBytesBuf := make([]byte, 2)
-	fourBytesBuf := make([]byte, 4)
-
-	// Parsing number of parameters formats
-	n, err := r.Read(twoBytesBuf)
-	if n < len(twoBytesBuf) {
-		return nil, errors.New("decodeBindMessage: read to formatsNumBuf failed")
+// convertOIDs converts pgwire OIDs, the result isn't nil even if there are no OIDs.
+func convertOIDs(oids []uint32) []oid {
+	converted := make([]oid, len(oids))
+	for i, o := range oids {
+		converted[i] = oid(o)
 	}
-	if err != nil {
-		return nil, fmt.Errorf("decodeBindMessage: %w", err)
-	}
-
-	b.formatsNum = binary.BigEndian.Uint16(twoBytesBuf)
-	b.formats = make([]format, b.formatsNum)
+	return converted
+}
 
-	// Parsing each parameter format
-	for i := uint16(0); i < b.formatsNum; i++ {
-		n, err = r.Read(twoBytesBuf)
-		if n < len(twoBytesBuf) {
-			return nil, errors.New("decodeBindMessage: read to formatsBuf failed")
-		}
-		if err != nil {
-			return nil, fmt.Errorf("decodeBindMessage: %w", err)
-		}
-		b.formats[i] = format(binary.BigEndian.Uint16(twoBytesBuf))
-	}
+// Close (F)
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type closeMessage struct {
+	// 'S' to close a prepared statement; or 'P' to close a portal.
+	target byte
+	// The name of the prepared statement or portal to close
+	// (an empty string selects the unnamed prepared statement or portal).
+	name string
+}
 
-	// Parsing number of parameters values
-	n, err = r.Read(twoBytesBuf)
-	if n < len(twoBytesBuf) {
-		return nil, errors.New("decodeBindMessage: read to twoBytesBuf failed")
-	}
-	if err != nil {
-		return nil, fmt.Errorf("decodeBindMessage: %w", err)
+func decodeCloseMessage(data []byte) (*closeMessage, error) {
+	var m pgwire.Close
+	if err := m.Decode(data[minPacketLen:]); err != nil {
+		return nil, err
 	}
+	return &closeMessage{target: m.ObjectType, name: m.Name}, nil
+}
 
-	b.valuesNum = binary.BigEndian.Uint16(twoBytesBuf)
-	b.values = make([][]byte, b.valuesNum)
+// Describe (F)
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type describeMessage struct {
+	// 'S' to describe a prepared statement; or 'P' to describe a portal.
+	target byte
+	// The name of the prepared statement or portal to describe
+	// (an empty string selects the unnamed prepared statement or portal).
+	name string
+}
 
-	// Parsing parameters values
-	for i := uint16(0); i < b.valuesNum; i++ {
-		n, err = r.Read(fourBytesBuf)
-		if n < len(fourBytesBuf) {
-			return nil, errors.New("decodeBindMessage: read to fourBytesBuf failed")
-		}
-		if err != nil {
-			return nil, fmt.Errorf("decodeBindMessage: %w", err)
-		}
+func decodeDescribeMessage(data []byte) (*describeMessage, error) {
+	var m pgwire.Describe
+	if err := m.Decode(data[minPacketLen:]); err != nil {
+		return nil, err
+	}
+	return &describeMessage{target: m.ObjectType, name: m.Name}, nil
+}
 
-		valueBuf := make([]byte, binary.BigEndian.Uint32(fourBytesBuf))
-		n, err = r.Read(valueBuf)
-		if n < len(valueBuf) {
-			return nil, errors.New("decodeBindMessage: read to formatsBuf failed")
-		}
-		if err != nil {
-			return nil, fmt.Errorf("decodeBindMessage: %w", err)
-		}
+// Execute (F)
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type executeMessage struct {
+	// The name of the portal to execute (an empty string selects the unnamed portal).
+	portal string
+	// Maximum number of rows to return, if portal contains a query that returns rows.
+	// Zero denotes "no limit".
+	maxRows uint32
+}
 
-		b.values[i] = valueBuf
+func decodeExecuteMessage(data []byte) (*executeMessage, error) {
+	var m pgwire.Execute
+	if err := m.Decode(data[minPacketLen:]); err != nil {
+		return nil, err
 	}
-
-	return b, nil
+	return &executeMessage{portal: m.Portal, maxRows: m.MaxRows}, nil
 }
 
 // ErrorResponse (B)
 // See https://www.postgresql.org/docs/current/protocol-message-formats.html
 type errorMessage struct {
 	message string
+	// fields are all the fields of the message.
+	fields *PgError
+	// rule is the firewall rule the error is made up for by Proxy. It's nil for errors of backend.
+	rule *Rule
 }
 
 func decodeErrorMessage(data []byte) *errorMessage {
-	e := &errorMessage{}
+	fields := decodeErrorFields(data)
+	return &errorMessage{message: fields.Message, fields: fields}
+}
 
-	r := bytes.NewReader(data)
+// NoticeResponse (B)
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type noticeMessage struct {
+	fields *PgError
+}
 
-	// Skip packet header
-	if _, err := r.Seek(5, io.SeekStart); err != nil {
-		return nil
-	}
+func decodeNoticeMessage(data []byte) *noticeMessage {
+	return &noticeMessage{fields: decodeErrorFields(data)}
+}
 
-	for {
-		b, err := r.ReadByte()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			println(err)
-		}
-		switch b {
-		case fieldMessage:
-			e.message = readNullTerminatedString(r)
-		default:
-			skipNullTerminatedString(r)
-		}
-	}
+// isNoticeMessage returns true if data is NoticeResponse message.
+func isNoticeMessage(data []byte) bool {
+	return isMessageOfType(data, noticeMessageType)
+}
 
-	return e
+// decodeErrorFields decodes fields of ErrorResponse or NoticeResponse. The message is reported
+// even if it doesn't match its format, so the fields decoded before the mismatch are kept.
+func decodeErrorFields(data []byte) *PgError {
+	var m pgwire.ErrorResponse
+	if len(data) >= minPacketLen {
+		_ = m.Decode(data[minPacketLen:])
+	}
+	e := PgError{
+		Severity:          m.Severity,
+		SeverityLocalized: m.SeverityLocalized,
+		Code:              m.Code,
+		Message:           m.Message,
+		Detail:            m.Detail,
+		Hint:              m.Hint,
+		Position:          m.Position,
+		InternalPosition:  m.InternalPosition,
+		InternalQuery:     m.InternalQuery,
+		Where:             m.Where,
+		SchemaName:        m.SchemaName,
+		TableName:         m.TableName,
+		ColumnName:        m.ColumnName,
+		DataTypeName:      m.DataTypeName,
+		ConstraintName:    m.ConstraintName,
+		File:              m.File,
+		Line:              m.Line,
+		Routine:           m.Routine,
+	}
+	// Servers prior to 9.6 send only the localized severity.
+	if e.Severity == "" {
+		e.Severity = e.SeverityLocalized
+	}
+	return &e
 }
 
 func isErrorMessage(data []byte) bool {
@@ -298,6 +485,23 @@ func isCancelRequestMessage(data []byte) bool {
 	return requestCode == 80877102
 }
 
+// CancelRequest (F)
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type cancelRequestMessage struct {
+	// The process ID of the target backend.
+	pid uint32
+	// The secret key for the target backend.
+	secret []byte
+}
+
+func decodeCancelRequestMessage(data []byte) (*cancelRequestMessage, error) {
+	var m pgwire.CancelRequest
+	if err := m.Decode(data[4:]); err != nil {
+		return nil, err
+	}
+	return &cancelRequestMessage{pid: m.ProcessID, secret: append([]byte(nil), m.SecretKey...)}, nil
+}
+
 // isSSLRequest возвращает true если пакет является SSLRequest.
 // SSLRequest не содержит тип пакета в заголовке.
 // Первые 4 байта содержат длину пакета, которая всегда равна 8.
@@ -315,6 +519,20 @@ func isSSLRequestMessage(data []byte) bool {
 	return requestCode == 80877103
 }
 
+// isGSSENCRequestMessage returns true if data is GSSENCRequest.
+// GSSENCRequest has the same layout as SSLRequest, but its request code is 80877104.
+func isGSSENCRequestMessage(data []byte) bool {
+	if len(data) != 8 {
+		return false
+	}
+	pktLen := binary.BigEndian.Uint32(data[0:4])
+	if pktLen != 8 {
+		return false
+	}
+	requestCode := binary.BigEndian.Uint32(data[4:8])
+	return requestCode == 80877104
+}
+
 // isStartupMessage возвращает true если пакет является StartupMessage.
 // StartupMessage не содержит тип пакета в заголовке.
 // Первые 4 байта содержат длину пакета.
@@ -332,6 +550,226 @@ func isStartupMessage(data []byte) bool {
 	return protoVer == 196608 //v3.0
 }
 
-func isNoOpMessage(data []byte) bool {
-	return len(data) == 1
+// StartupMessage (F)
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type startupMessage struct {
+	// The protocol version number. The most significant 16 bits are the major version number,
+	// the least significant 16 bits are the minor version number.
+	version uint32
+	// Run-time parameters: user, database, options, replication, application_name and others.
+	params map[string]string
+}
+
+func decodeStartupMessage(data []byte) (*startupMessage, error) {
+	var m pgwire.StartupMessage
+	if err := m.Decode(data[4:]); err != nil {
+		return nil, err
+	}
+	return &startupMessage{version: m.ProtocolVersion, params: m.Parameters}, nil
+}
+
+// ParameterStatus (B)
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type parameterStatusMessage struct {
+	// The name of the run-time parameter being reported.
+	name string
+	// The current value of the parameter.
+	value string
+}
+
+// isParameterStatusMessage returns true if data is ParameterStatus message.
+// ParameterStatus has the same type byte as Sync, so origin of data must be checked by the caller.
+func isParameterStatusMessage(data []byte) bool {
+	return len(data) >= 7 && isMessageOfType(data, parameterStatusMessageType)
+}
+
+func decodeParameterStatusMessage(data []byte) (*parameterStatusMessage, error) {
+	var m pgwire.ParameterStatus
+	if err := m.Decode(data[minPacketLen:]); err != nil {
+		return nil, err
+	}
+	return &parameterStatusMessage{name: m.Name, value: m.Value}, nil
+}
+
+// BackendKeyData (B)
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type backendKeyDataMessage struct {
+	// The process ID of this backend.
+	pid uint32
+	// The secret key of this backend. It's 4 bytes long in protocol 3.0 and up to 256 bytes since 3.2.
+	secret []byte
+}
+
+// isBackendKeyDataMessage returns true if data is BackendKeyData message.
+func isBackendKeyDataMessage(data []byte) bool {
+	return len(data) >= 13 && isMessageOfType(data, backendKeyDataMessageType)
+}
+
+func decodeBackendKeyDataMessage(data []byte) (*backendKeyDataMessage, error) {
+	var m pgwire.BackendKeyData
+	if err := m.Decode(data[minPacketLen:]); err != nil {
+		return nil, err
+	}
+	return &backendKeyDataMessage{pid: m.ProcessID, secret: append([]byte(nil), m.SecretKey...)}, nil
+}
+
+// Codes of Authentication messages.
+const (
+	authenticationOk                = 0
+	authenticationKerberosV5        = 2
+	authenticationCleartextPassword = 3
+	authenticationMD5Password       = 5
+	authenticationGSS               = 7
+	authenticationGSSContinue       = 8
+	authenticationSSPI              = 9
+	authenticationSASL              = 10
+	authenticationSASLContinue      = 11
+	authenticationSASLFinal         = 12
+)
+
+// Authentication (B) is the family of messages backend sends during authentication.
+// All of them share the type byte and differ in the code which follows the length.
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type authenticationMessage struct {
+	code uint32
+	// data is the rest of the message, e.g. the salt of AuthenticationMD5Password
+	// or the list of SASL mechanisms of AuthenticationSASL.
+	data []byte
+}
+
+// isAuthenticationMessage returns true if data is one of Authentication messages.
+func isAuthenticationMessage(data []byte) bool {
+	return len(data) >= 9 && isMessageOfType(data, authenticationMessageType)
+}
+
+func decodeAuthenticationMessage(data []byte) *authenticationMessage {
+	return &authenticationMessage{
+		code: binary.BigEndian.Uint32(data[5:9]),
+		data: append([]byte(nil), data[9:]...),
+	}
+}
+
+// decodeSASLMechanisms returns the names of SASL mechanisms listed by AuthenticationSASL message.
+func decodeSASLMechanisms(m *authenticationMessage) []string {
+	var mechanisms []string
+	r := bytes.NewReader(m.data)
+	for r.Len() > 0 {
+		mechanism := readNullTerminatedString(r)
+		if mechanism == "" {
+			break
+		}
+		mechanisms = append(mechanisms, mechanism)
+	}
+	return mechanisms
+}
+
+// PasswordMessage, SASLInitialResponse, SASLResponse and GSSResponse (F) share the type byte,
+// which one frontend sent depends on the Authentication message it responds to.
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type passwordMessage struct {
+	// data is the password of PasswordMessage without the terminating zero byte
+	// or the SASL data of SASLResponse.
+	data []byte
+}
+
+// isPasswordMessage returns true if data is one of the messages of type 'p'.
+func isPasswordMessage(data []byte) bool {
+	return isMessageOfType(data, passwordMessageType)
+}
+
+// decodePasswordMessage decodes data as PasswordMessage if password is true and as SASLResponse otherwise.
+func decodePasswordMessage(data []byte, password bool) *passwordMessage {
+	body := data[5:]
+	if password && len(body) > 0 && body[len(body)-1] == 0x00 {
+		body = body[:len(body)-1]
+	}
+	return &passwordMessage{data: append([]byte(nil), body...)}
+}
+
+// SASLInitialResponse (F)
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type saslInitialResponseMessage struct {
+	// Name of the SASL authentication mechanism that the client selected.
+	mechanism string
+	// SASL mechanism specific "Initial Response", nil if there is none.
+	data []byte
+}
+
+func decodeSASLInitialResponseMessage(data []byte) (*saslInitialResponseMessage, error) {
+	var m pgwire.SASLInitialResponse
+	if err := m.Decode(data[minPacketLen:]); err != nil {
+		return nil, err
+	}
+	r := &saslInitialResponseMessage{mechanism: m.Mechanism}
+	if m.Data != nil {
+		r.data = append([]byte{}, m.Data...)
+	}
+	return r, nil
+}
+
+// CopyInResponse, CopyOutResponse and CopyBothResponse (B) switch the connection to the copy mode.
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type copyResponseMessage struct {
+	// direction tells which way the data go in the copy mode started by the message.
+	direction CopyDirection
+	// binary is true if the overall COPY format is binary and false if it's textual, i.e. text or csv.
+	binary bool
+}
+
+func decodeCopyResponseMessage(data []byte, direction CopyDirection) (*copyResponseMessage, error) {
+	var format pgwire.Format
+	var err error
+	switch direction {
+	case CopyIn:
+		var m pgwire.CopyInResponse
+		err = m.Decode(data[minPacketLen:])
+		format = m.Format
+	case CopyOut:
+		var m pgwire.CopyOutResponse
+		err = m.Decode(data[minPacketLen:])
+		format = m.Format
+	default:
+		var m pgwire.CopyBothResponse
+		err = m.Decode(data[minPacketLen:])
+		format = m.Format
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &copyResponseMessage{direction: direction, binary: format == pgwire.BinaryFormat}, nil
+}
+
+// CopyData (F & B)
+// Only the size of the data is interesting, so collector gets the header of CopyData alone
+// and its content isn't decoded.
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type copyDataMessage struct {
+	// size is the number of bytes of data the message carries.
+	size int64
+}
+
+func decodeCopyDataMessage(data []byte) *copyDataMessage {
+	return &copyDataMessage{size: int64(binary.BigEndian.Uint32(data[1:5])) - 4}
+}
+
+// CopyDone (F & B) ends the data sent in the copy mode.
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type copyDoneMessage struct{}
+
+// CopyFail (F) aborts COPY FROM STDIN. Its error message isn't decoded,
+// since backend reports it in ErrorResponse anyway.
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+type copyFailMessage struct{}
+
+// isMessageOfType returns true if data is a single message of type msgType
+// and its actual length matches the length from the header.
+func isMessageOfType(data []byte, msgType byte) bool {
+	if len(data) < 5 {
+		return false
+	}
+	if data[0] != msgType {
+		return false
+	}
+	pktLen := binary.BigEndian.Uint32(data[1:5]) + 1
+	return pktLen == uint32(len(data))
 }
@@ -1,96 +1,212 @@
 package postgresql
 
 import (
-	"encoding/binary"
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/backstage-app/postgresql/pgwire"
 )
 
 const (
 	minPacketLen   = 5
 	originBackend  = 0x01
 	originFrontend = 0x02
-)
 
-type packet struct {
-	Payload []byte
-	Origin  byte
-}
+	// defaultMaxMessageLen is the default limit of message and field length.
+	defaultMaxMessageLen = pgwire.DefaultMaxMessageLen
+)
 
-func (p *packet) messages() []interface{} {
-	if isStartupMessage(p.Payload) || isSSLRequestMessage(p.Payload) || isCancelRequestMessage(p.Payload) {
-		return nil
-	}
+var (
+	// ErrMalformedMessage is wrapped by Err of ProtocolError about a single message which doesn't match its format.
+	ErrMalformedMessage = errors.New("postgresql: malformed message")
+	// ErrFieldTooLong is wrapped by Err of ProtocolError about a single message with a field longer than MaxFieldSize.
+	ErrFieldTooLong = errors.New("postgresql: field is too long")
+)
 
-	var offset uint32
-	var messages []interface{}
-	for {
-		if len(p.Payload[offset:]) < minPacketLen {
-			break
-		}
+// truncatedMark ends a query string truncated to MaxFieldSize.
+const truncatedMark = "...(truncated)"
 
-		pktLen := binary.BigEndian.Uint32(p.Payload[offset+1:offset+minPacketLen]) + 1
-		packet := p.Payload[offset : offset+pktLen]
-		offset = offset + pktLen
+// decodeMessage decodes a single message sent by the origin. It returns nil if the message
+// isn't interesting for the proxy, and an error wrapping ErrMalformedMessage if it doesn't match its format.
+func decodeMessage(data []byte, origin byte) (interface{}, error) {
+	var msg interface{}
+	var err error
+	if origin == originFrontend {
+		msg, err = decodeFrontendMessage(data)
+	} else {
+		msg, err = decodeBackendMessage(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	return msg, nil
+}
 
-		if p.Origin == originFrontend && isParseMessage(packet) {
-			msg, _ := decodeParseMessage(packet)
-			messages = append(messages, msg)
-			continue
-		}
-		if p.Origin == originFrontend && isBindMessage(packet) {
-			msg, _ := decodeBindMessage(packet)
-			messages = append(messages, msg)
-			continue
-		}
-		if p.Origin == originBackend && isErrorMessage(packet) {
-			messages = append(messages, decodeErrorMessage(packet))
-			continue
-		}
-		if p.Origin == originBackend && isCommandCompleteMessage(packet) {
-			msg, _ := decodeCommandCompleteMessage(packet)
-			messages = append(messages, msg)
-			continue
+func decodeFrontendMessage(data []byte) (interface{}, error) {
+	if len(data) < minPacketLen {
+		return nil, nil
+	}
+	// Messages of the startup phase start with their length rather than a type byte.
+	// It's below maxStartupMessageLen, so the first byte is zero unlike any type byte.
+	if data[0] == 0 {
+		switch {
+		case isStartupMessage(data):
+			return decodeStartupMessage(data)
+		case isCancelRequestMessage(data):
+			return decodeCancelRequestMessage(data)
 		}
+		return nil, nil
 	}
 
-	return messages
+	switch data[0] {
+	case parseMessageType:
+		return decodeParseMessage(data)
+	case queryMessageType:
+		return decodeQueryMessage(data)
+	case syncMessageType:
+		return decodeEmptyMessage(data, &pgwire.Sync{}, &syncMessage{})
+	case flushMessageType:
+		return decodeEmptyMessage(data, &pgwire.Flush{}, &flushMessage{})
+	case bindMessageType:
+		return decodeBindMessage(data)
+	case executeMessageType:
+		return decodeExecuteMessage(data)
+	case closeMessageType:
+		return decodeCloseMessage(data)
+	case describeMessageType:
+		return decodeDescribeMessage(data)
+	case copyDataMessageType:
+		return decodeCopyDataMessage(data), nil
+	case copyDoneMessageType:
+		return decodeEmptyMessage(data, &pgwire.CopyDone{}, &copyDoneMessage{})
+	case copyFailMessageType:
+		return &copyFailMessage{}, nil
+	}
+	return nil, nil
 }
 
-// isValidPacket возвращает true если data это валидный пакет.
-// Учитывается, что data может состоять как из одного пакета, так и из множества пакетов.
-// В последнем случае data валиден если каждый пакет из data валиден.
-func isValidPacket(data []byte) bool {
-	if isNoOpMessage(data) {
-		return true
+func decodeBackendMessage(data []byte) (interface{}, error) {
+	if len(data) < minPacketLen {
+		// Backend responds to encryption requests with a single byte.
+		return nil, nil
 	}
 
-	if len(data) < minPacketLen {
-		return false
+	switch data[0] {
+	case parseCompleteMessageType:
+		return decodeEmptyMessage(data, &pgwire.ParseComplete{}, &parseCompleteMessage{})
+	case bindCompleteMessageType:
+		return decodeEmptyMessage(data, &pgwire.BindComplete{}, &bindCompleteMessage{})
+	case closeCompleteMessageType:
+		return decodeEmptyMessage(data, &pgwire.CloseComplete{}, &closeCompleteMessage{})
+	case noDataMessageType:
+		return decodeEmptyMessage(data, &pgwire.NoData{}, &noDataMessage{})
+	case rowDescriptionMessageType:
+		return &rowDescriptionMessage{}, nil
+	case parameterDescriptionMessageType:
+		return decodeParameterDescriptionMessage(data)
+	case emptyQueryResponseMessageType:
+		return decodeEmptyMessage(data, &pgwire.EmptyQueryResponse{}, &emptyQueryResponseMessage{})
+	case portalSuspendedMessageType:
+		return decodeEmptyMessage(data, &pgwire.PortalSuspended{}, &portalSuspendedMessage{})
+	case dataRowMessageType:
+		return &dataRowMessage{}, nil
+	case errorMessageType:
+		return decodeErrorMessage(data), nil
+	case authenticationMessageType:
+		if !isAuthenticationMessage(data) {
+			return nil, errors.New("decodeBackendMessage: Authentication is too short")
+		}
+		return decodeAuthenticationMessage(data), nil
+	case parameterStatusMessageType:
+		return decodeParameterStatusMessage(data)
+	case backendKeyDataMessageType:
+		return decodeBackendKeyDataMessage(data)
+	case noticeMessageType:
+		return decodeNoticeMessage(data), nil
+	case commandCompleteMessageType:
+		return decodeCommandCompleteMessage(data)
+	case readyForQueryMessageType:
+		return decodeReadyForQueryMessage(data)
+	case copyInResponseMessageType:
+		return decodeCopyResponseMessage(data, CopyIn)
+	case copyOutResponseMessageType:
+		return decodeCopyResponseMessage(data, CopyOut)
+	case copyBothResponseMessageType:
+		return decodeCopyResponseMessage(data, CopyBoth)
+	case copyDataMessageType:
+		return decodeCopyDataMessage(data), nil
+	case copyDoneMessageType:
+		return decodeEmptyMessage(data, &pgwire.CopyDone{}, &copyDoneMessage{})
 	}
+	return nil, nil
+}
 
-	// Эти типы сообщений в заголовке не содержат байт типа пакета, поэтому их нужно обработать сразу
-	if isStartupMessage(data) || isSSLRequestMessage(data) || isCancelRequestMessage(data) {
-		return true
+// decodeEmptyMessage returns m if data is decoded as the message w of pgwire,
+// which consists of the type byte and the length only.
+func decodeEmptyMessage(data []byte, w interface{ Decode([]byte) error }, m interface{}) (interface{}, error) {
+	if err := w.Decode(data[minPacketLen:]); err != nil {
+		return nil, err
 	}
+	return m, nil
+}
 
-	var offset uint32
-	for {
-		// Если длина остатка пакета меньше пяти, то это однозначно неверный пакет.
-		// Минимальный пакет состоит из типа пакета(1 байт) и длины пакета(4 байта).
-		if len(data[offset:]) < minPacketLen {
-			break
+// limitFieldLen truncates the fields of the decoded message m, which Proxy keeps after the message is gone,
+// to max bytes. Truncated query strings end with truncatedMark, so that they aren't taken for complete statements.
+// It returns an error wrapping ErrFieldTooLong if any field was truncated.
+func limitFieldLen(m interface{}, max int) error {
+	longest := 0
+	truncate := func(s string) string {
+		if len(s) <= max {
+			return s
 		}
-		pktLen := binary.BigEndian.Uint32(data[offset+1:offset+minPacketLen]) + 1
-		// Если ожидаемая длина остатка пакета совпадает с фактической длиной остатка пакета,
-		// то либо Payload это всего один пакет и он валидный, либо цикл дошел уже до последнего пакета в Payload и
-		// это автоматически значит, что все пакеты в Payload так же валидны.
-		if pktLen == uint32(len(data[offset:])) {
-			return true
+		if len(s) > longest {
+			longest = len(s)
+		}
+		return s[:max] + truncatedMark
+	}
+	switch m := m.(type) {
+	case *queryMessage:
+		m.query = truncate(m.query)
+	case *parseMessage:
+		m.query = truncate(m.query)
+	case *bindMessage:
+		for i, value := range m.values {
+			if len(value) > max {
+				if len(value) > longest {
+					longest = len(value)
+				}
+				m.values[i] = append([]byte(nil), value[:max]...)
+			}
 		}
-		// Ожидаемая длина пакета не может быть больше фактической длины пакета.
-		if pktLen > uint32(len(data[offset:])) {
-			break
+	}
+	if longest == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: field of %d bytes exceeds the limit of %d", ErrFieldTooLong, longest, max)
+}
+
+// undecodedMessage stands for Parse or Query message which doesn't match its format. Backend answers it
+// all the same, so the session keeps the place of the response and forgets the statement the message replaces.
+type undecodedMessage struct {
+	msgType byte
+	// name is the name of the statement Parse creates, named is false if even the name can't be read.
+	name  string
+	named bool
+}
+
+// newUndecodedMessage returns undecodedMessage for the frontend message data which can't be decoded,
+// or nil if the session doesn't need to know about it.
+func newUndecodedMessage(data []byte) *undecodedMessage {
+	switch data[0] {
+	case queryMessageType:
+		return &undecodedMessage{msgType: queryMessageType}
+	case parseMessageType:
+		m := &undecodedMessage{msgType: parseMessageType}
+		if end := bytes.IndexByte(data[minPacketLen:], 0); end >= 0 {
+			m.name, m.named = string(data[minPacketLen:minPacketLen+end]), true
 		}
-		offset = offset + pktLen
+		return m
 	}
-	return false
+	return nil
 }
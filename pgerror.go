@@ -0,0 +1,60 @@
+package postgresql
+
+// PgError is the content of ErrorResponse or NoticeResponse sent by backend.
+// See https://www.postgresql.org/docs/current/protocol-error-fields.html
+type PgError struct {
+	// Severity is ERROR, FATAL or PANIC in an error message, or WARNING, NOTICE, DEBUG, INFO or LOG
+	// in a notice message. It's never localized.
+	Severity string
+	// SeverityLocalized is the severity translated to the language of the server messages.
+	SeverityLocalized string
+	// Code is the SQLSTATE code of the error.
+	// See https://www.postgresql.org/docs/current/errcodes-appendix.html
+	Code string
+	// Message is the primary human-readable error message.
+	Message string
+	// Detail is an optional secondary error message carrying more detail about the problem.
+	Detail string
+	// Hint is an optional suggestion what to do about the problem.
+	Hint string
+	// Position is the error cursor position as an index into the original query string.
+	// The first character has index 1. It's zero if not present.
+	Position int32
+	// InternalPosition is the same as Position, but it's used when the cursor position
+	// refers to an internally generated command rather than the one submitted by the client.
+	InternalPosition int32
+	// InternalQuery is the text of a failed internally-generated command.
+	InternalQuery string
+	// Where is the context in which the error occurred, e.g. a call stack traceback of PL functions.
+	Where string
+	// SchemaName, TableName, ColumnName, DataTypeName and ConstraintName identify
+	// the database object associated with the error, if any.
+	SchemaName     string
+	TableName      string
+	ColumnName     string
+	DataTypeName   string
+	ConstraintName string
+	// File, Line and Routine locate the error in the server source code.
+	File    string
+	Line    int32
+	Routine string
+}
+
+// Error implements error interface.
+func (e *PgError) Error() string {
+	return e.Severity + ": " + e.Message + " (SQLSTATE " + e.Code + ")"
+}
+
+// SQLState returns the SQLSTATE code of the error.
+func (e *PgError) SQLState() string {
+	return e.Code
+}
+
+// Class returns the class of the SQLSTATE code, which is its first two characters,
+// e.g. 23 for integrity constraint violations or 40 for transaction rollbacks.
+func (e *PgError) Class() string {
+	if len(e.Code) < 2 {
+		return e.Code
+	}
+	return e.Code[:2]
+}
@@ -0,0 +1,837 @@
+package pgwire
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+const (
+	authenticationType       = 'R'
+	backendKeyDataType       = 'K'
+	bindCompleteType         = '2'
+	closeCompleteType        = '3'
+	commandCompleteType      = 'C'
+	copyInResponseType       = 'G'
+	copyOutResponseType      = 'H'
+	copyBothResponseType     = 'W'
+	dataRowType              = 'D'
+	emptyQueryResponseType   = 'I'
+	errorResponseType        = 'E'
+	functionCallResponseType = 'V'
+	negotiateProtocolType    = 'v'
+	noDataType               = 'n'
+	noticeResponseType       = 'N'
+	notificationResponseType = 'A'
+	parameterDescriptionType = 't'
+	parameterStatusType      = 'S'
+	parseCompleteType        = '1'
+	portalSuspendedType      = 's'
+	readyForQueryType        = 'Z'
+	rowDescriptionType       = 'T'
+)
+
+// Codes of Authentication messages.
+const (
+	authenticationOk                = 0
+	authenticationKerberosV5        = 2
+	authenticationCleartextPassword = 3
+	authenticationMD5Password       = 5
+	authenticationGSS               = 7
+	authenticationGSSContinue       = 8
+	authenticationSSPI              = 9
+	authenticationSASL              = 10
+	authenticationSASLContinue      = 11
+	authenticationSASLFinal         = 12
+)
+
+// encodeAuthentication appends Authentication message with the code followed by data.
+func encodeAuthentication(dst []byte, code uint32, data []byte) []byte {
+	dst, start := beginMessage(dst, authenticationType)
+	dst = appendUint32(dst, code)
+	return finishMessage(append(dst, data...), start)
+}
+
+// authenticationReader returns the reader of the data following the code of Authentication message.
+func authenticationReader(body []byte, code uint32) reader {
+	r := reader{buf: body}
+	if r.uint32() != code && r.err == nil {
+		r.fail("invalid authentication code")
+	}
+	return r
+}
+
+// AuthenticationOk (B) reports successful authentication.
+type AuthenticationOk struct{}
+
+func (m *AuthenticationOk) Encode(dst []byte) []byte {
+	return encodeAuthentication(dst, authenticationOk, nil)
+}
+
+func (m *AuthenticationOk) Decode(body []byte) error {
+	r := authenticationReader(body, authenticationOk)
+	return r.finish("AuthenticationOk")
+}
+
+func (m *AuthenticationOk) Backend() {}
+
+// AuthenticationKerberosV5 (B) requests Kerberos V5 authentication.
+type AuthenticationKerberosV5 struct{}
+
+func (m *AuthenticationKerberosV5) Encode(dst []byte) []byte {
+	return encodeAuthentication(dst, authenticationKerberosV5, nil)
+}
+
+func (m *AuthenticationKerberosV5) Decode(body []byte) error {
+	r := authenticationReader(body, authenticationKerberosV5)
+	return r.finish("AuthenticationKerberosV5")
+}
+
+func (m *AuthenticationKerberosV5) Backend() {}
+
+// AuthenticationCleartextPassword (B) requests the password in clear text.
+type AuthenticationCleartextPassword struct{}
+
+func (m *AuthenticationCleartextPassword) Encode(dst []byte) []byte {
+	return encodeAuthentication(dst, authenticationCleartextPassword, nil)
+}
+
+func (m *AuthenticationCleartextPassword) Decode(body []byte) error {
+	r := authenticationReader(body, authenticationCleartextPassword)
+	return r.finish("AuthenticationCleartextPassword")
+}
+
+func (m *AuthenticationCleartextPassword) Backend() {}
+
+// AuthenticationMD5Password (B) requests the password hashed with md5.
+type AuthenticationMD5Password struct {
+	// Salt is used to hash the password.
+	Salt [4]byte
+}
+
+func (m *AuthenticationMD5Password) Encode(dst []byte) []byte {
+	return encodeAuthentication(dst, authenticationMD5Password, m.Salt[:])
+}
+
+func (m *AuthenticationMD5Password) Decode(body []byte) error {
+	r := authenticationReader(body, authenticationMD5Password)
+	*m = AuthenticationMD5Password{}
+	copy(m.Salt[:], r.next(4))
+	return r.finish("AuthenticationMD5Password")
+}
+
+func (m *AuthenticationMD5Password) Backend() {}
+
+// AuthenticationGSS (B) requests GSSAPI authentication.
+type AuthenticationGSS struct{}
+
+func (m *AuthenticationGSS) Encode(dst []byte) []byte {
+	return encodeAuthentication(dst, authenticationGSS, nil)
+}
+
+func (m *AuthenticationGSS) Decode(body []byte) error {
+	r := authenticationReader(body, authenticationGSS)
+	return r.finish("AuthenticationGSS")
+}
+
+func (m *AuthenticationGSS) Backend() {}
+
+// AuthenticationGSSContinue (B) carries GSSAPI or SSPI authentication data.
+type AuthenticationGSSContinue struct {
+	Data []byte
+}
+
+func (m *AuthenticationGSSContinue) Encode(dst []byte) []byte {
+	return encodeAuthentication(dst, authenticationGSSContinue, m.Data)
+}
+
+func (m *AuthenticationGSSContinue) Decode(body []byte) error {
+	r := authenticationReader(body, authenticationGSSContinue)
+	*m = AuthenticationGSSContinue{Data: r.rest()}
+	return r.finish("AuthenticationGSSContinue")
+}
+
+func (m *AuthenticationGSSContinue) Backend() {}
+
+// AuthenticationSSPI (B) requests SSPI authentication.
+type AuthenticationSSPI struct{}
+
+func (m *AuthenticationSSPI) Encode(dst []byte) []byte {
+	return encodeAuthentication(dst, authenticationSSPI, nil)
+}
+
+func (m *AuthenticationSSPI) Decode(body []byte) error {
+	r := authenticationReader(body, authenticationSSPI)
+	return r.finish("AuthenticationSSPI")
+}
+
+func (m *AuthenticationSSPI) Backend() {}
+
+// AuthenticationSASL (B) requests SASL authentication.
+type AuthenticationSASL struct {
+	// Mechanisms are the names of SASL mechanisms in the order of the server's preference.
+	Mechanisms []string
+}
+
+func (m *AuthenticationSASL) Encode(dst []byte) []byte {
+	var data []byte
+	for _, mechanism := range m.Mechanisms {
+		data = appendString(data, mechanism)
+	}
+	return encodeAuthentication(dst, authenticationSASL, append(data, 0))
+}
+
+func (m *AuthenticationSASL) Decode(body []byte) error {
+	r := authenticationReader(body, authenticationSASL)
+	*m = AuthenticationSASL{}
+	// The list of mechanisms is terminated by an empty name.
+	for r.err == nil {
+		mechanism := r.string()
+		if mechanism == "" {
+			break
+		}
+		m.Mechanisms = append(m.Mechanisms, mechanism)
+	}
+	return r.finish("AuthenticationSASL")
+}
+
+func (m *AuthenticationSASL) Backend() {}
+
+// AuthenticationSASLContinue (B) carries SASL challenge.
+type AuthenticationSASLContinue struct {
+	Data []byte
+}
+
+func (m *AuthenticationSASLContinue) Encode(dst []byte) []byte {
+	return encodeAuthentication(dst, authenticationSASLContinue, m.Data)
+}
+
+func (m *AuthenticationSASLContinue) Decode(body []byte) error {
+	r := authenticationReader(body, authenticationSASLContinue)
+	*m = AuthenticationSASLContinue{Data: r.rest()}
+	return r.finish("AuthenticationSASLContinue")
+}
+
+func (m *AuthenticationSASLContinue) Backend() {}
+
+// AuthenticationSASLFinal (B) carries SASL outcome of the completed authentication.
+type AuthenticationSASLFinal struct {
+	Data []byte
+}
+
+func (m *AuthenticationSASLFinal) Encode(dst []byte) []byte {
+	return encodeAuthentication(dst, authenticationSASLFinal, m.Data)
+}
+
+func (m *AuthenticationSASLFinal) Decode(body []byte) error {
+	r := authenticationReader(body, authenticationSASLFinal)
+	*m = AuthenticationSASLFinal{Data: r.rest()}
+	return r.finish("AuthenticationSASLFinal")
+}
+
+func (m *AuthenticationSASLFinal) Backend() {}
+
+// BackendKeyData (B) carries the key the frontend cancels queries with, see CancelRequest.
+type BackendKeyData struct {
+	ProcessID uint32
+	// SecretKey is 4 bytes long in protocol 3.0 and up to 256 bytes since 3.2.
+	SecretKey []byte
+}
+
+func (m *BackendKeyData) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, backendKeyDataType)
+	dst = appendUint32(dst, m.ProcessID)
+	return finishMessage(append(dst, m.SecretKey...), start)
+}
+
+func (m *BackendKeyData) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = BackendKeyData{ProcessID: r.uint32(), SecretKey: r.rest()}
+	if r.err == nil && (len(m.SecretKey) < 4 || len(m.SecretKey) > maxSecretKeyLen) {
+		r.fail("invalid secret key length")
+	}
+	return r.finish("BackendKeyData")
+}
+
+func (m *BackendKeyData) Backend() {}
+
+// ParseComplete (B) answers Parse.
+type ParseComplete struct{}
+
+func (m *ParseComplete) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, parseCompleteType)
+}
+
+func (m *ParseComplete) Decode(body []byte) error {
+	return decodeEmpty(body, "ParseComplete")
+}
+
+func (m *ParseComplete) Backend() {}
+
+// BindComplete (B) answers Bind.
+type BindComplete struct{}
+
+func (m *BindComplete) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, bindCompleteType)
+}
+
+func (m *BindComplete) Decode(body []byte) error {
+	return decodeEmpty(body, "BindComplete")
+}
+
+func (m *BindComplete) Backend() {}
+
+// CloseComplete (B) answers Close.
+type CloseComplete struct{}
+
+func (m *CloseComplete) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, closeCompleteType)
+}
+
+func (m *CloseComplete) Decode(body []byte) error {
+	return decodeEmpty(body, "CloseComplete")
+}
+
+func (m *CloseComplete) Backend() {}
+
+// NoData (B) answers Describe of a statement or a portal which doesn't return rows.
+type NoData struct{}
+
+func (m *NoData) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, noDataType)
+}
+
+func (m *NoData) Decode(body []byte) error {
+	return decodeEmpty(body, "NoData")
+}
+
+func (m *NoData) Backend() {}
+
+// EmptyQueryResponse (B) takes the place of CommandComplete in response to an empty query string.
+type EmptyQueryResponse struct{}
+
+func (m *EmptyQueryResponse) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, emptyQueryResponseType)
+}
+
+func (m *EmptyQueryResponse) Decode(body []byte) error {
+	return decodeEmpty(body, "EmptyQueryResponse")
+}
+
+func (m *EmptyQueryResponse) Backend() {}
+
+// PortalSuspended (B) takes the place of CommandComplete when the row limit of Execute is reached.
+type PortalSuspended struct{}
+
+func (m *PortalSuspended) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, portalSuspendedType)
+}
+
+func (m *PortalSuspended) Decode(body []byte) error {
+	return decodeEmpty(body, "PortalSuspended")
+}
+
+func (m *PortalSuspended) Backend() {}
+
+// CommandComplete (B) reports a completed command.
+type CommandComplete struct {
+	// Tag is the command tag, e.g. "INSERT 0 1" or "SELECT 5".
+	Tag string
+}
+
+func (m *CommandComplete) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, commandCompleteType)
+	return finishMessage(appendString(dst, m.Tag), start)
+}
+
+func (m *CommandComplete) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = CommandComplete{Tag: r.string()}
+	return r.finish("CommandComplete")
+}
+
+func (m *CommandComplete) Backend() {}
+
+// CopyInResponse (B) starts COPY FROM STDIN.
+type CopyInResponse struct {
+	// Format is the overall format of COPY data, BinaryFormat if the data are binary.
+	Format Format
+	// ColumnFormats are the formats of the columns, all of them are TextFormat if Format is.
+	ColumnFormats []Format
+}
+
+func (m *CopyInResponse) Encode(dst []byte) []byte {
+	return encodeCopyResponse(dst, copyInResponseType, m.Format, m.ColumnFormats)
+}
+
+func (m *CopyInResponse) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = CopyInResponse{}
+	m.Format, m.ColumnFormats = r.copyFormats()
+	return r.finish("CopyInResponse")
+}
+
+func (m *CopyInResponse) Backend() {}
+
+// CopyOutResponse (B) starts COPY TO STDOUT.
+type CopyOutResponse struct {
+	Format        Format
+	ColumnFormats []Format
+}
+
+func (m *CopyOutResponse) Encode(dst []byte) []byte {
+	return encodeCopyResponse(dst, copyOutResponseType, m.Format, m.ColumnFormats)
+}
+
+func (m *CopyOutResponse) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = CopyOutResponse{}
+	m.Format, m.ColumnFormats = r.copyFormats()
+	return r.finish("CopyOutResponse")
+}
+
+func (m *CopyOutResponse) Backend() {}
+
+// CopyBothResponse (B) starts COPY in both directions, which is used by streaming replication.
+type CopyBothResponse struct {
+	Format        Format
+	ColumnFormats []Format
+}
+
+func (m *CopyBothResponse) Encode(dst []byte) []byte {
+	return encodeCopyResponse(dst, copyBothResponseType, m.Format, m.ColumnFormats)
+}
+
+func (m *CopyBothResponse) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = CopyBothResponse{}
+	m.Format, m.ColumnFormats = r.copyFormats()
+	return r.finish("CopyBothResponse")
+}
+
+func (m *CopyBothResponse) Backend() {}
+
+func encodeCopyResponse(dst []byte, t byte, format Format, columnFormats []Format) []byte {
+	dst, start := beginMessage(dst, t)
+	dst = append(dst, byte(format))
+	return finishMessage(appendFormats(dst, columnFormats), start)
+}
+
+// copyFormats reads the overall format of COPY data followed by the formats of the columns.
+func (r *reader) copyFormats() (Format, []Format) {
+	format := Format(r.byte())
+	if r.err == nil && format != TextFormat && format != BinaryFormat {
+		r.fail(fmt.Sprintf("invalid format %d", format))
+	}
+	return format, r.formats()
+}
+
+// DataRow (B) carries a row of the result.
+type DataRow struct {
+	// Values are the values of the columns, nil stands for NULL.
+	Values [][]byte
+}
+
+func (m *DataRow) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, dataRowType)
+	return finishMessage(appendValues(dst, m.Values), start)
+}
+
+func (m *DataRow) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = DataRow{Values: r.values()}
+	return r.finish("DataRow")
+}
+
+func (m *DataRow) Backend() {}
+
+// FieldDescription describes a column of RowDescription.
+type FieldDescription struct {
+	Name string
+	// TableOID and TableAttributeNumber identify the column of the table the field comes from,
+	// they are zero if it doesn't come from a table column.
+	TableOID             uint32
+	TableAttributeNumber uint16
+	DataTypeOID          uint32
+	// DataTypeSize is pg_type.typlen, it's negative for types of variable width.
+	DataTypeSize int16
+	TypeModifier int32
+	Format       Format
+}
+
+// RowDescription (B) describes the columns of the rows to follow.
+type RowDescription struct {
+	Fields []FieldDescription
+}
+
+func (m *RowDescription) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, rowDescriptionType)
+	dst = appendUint16(dst, uint16(len(m.Fields)))
+	for _, f := range m.Fields {
+		dst = appendString(dst, f.Name)
+		dst = appendUint32(dst, f.TableOID)
+		dst = appendUint16(dst, f.TableAttributeNumber)
+		dst = appendUint32(dst, f.DataTypeOID)
+		dst = appendUint16(dst, uint16(f.DataTypeSize))
+		dst = appendUint32(dst, uint32(f.TypeModifier))
+		dst = appendUint16(dst, uint16(f.Format))
+	}
+	return finishMessage(dst, start)
+}
+
+func (m *RowDescription) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = RowDescription{}
+	n := int(r.uint16())
+	// Each field takes at least 19 bytes: the terminator of its name and 18 bytes of the numbers.
+	if n*19 > len(r.buf) {
+		r.fail("message is too short")
+	}
+	if n > 0 && r.err == nil {
+		m.Fields = make([]FieldDescription, n)
+	}
+	for i := range m.Fields {
+		m.Fields[i] = FieldDescription{
+			Name:                 r.string(),
+			TableOID:             r.uint32(),
+			TableAttributeNumber: r.uint16(),
+			DataTypeOID:          r.uint32(),
+			DataTypeSize:         int16(r.uint16()),
+			TypeModifier:         int32(r.uint32()),
+			Format:               Format(r.uint16()),
+		}
+	}
+	return r.finish("RowDescription")
+}
+
+func (m *RowDescription) Backend() {}
+
+// ParameterDescription (B) describes the parameters of a prepared statement.
+type ParameterDescription struct {
+	ParameterOIDs []uint32
+}
+
+func (m *ParameterDescription) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, parameterDescriptionType)
+	dst = appendUint16(dst, uint16(len(m.ParameterOIDs)))
+	for _, oid := range m.ParameterOIDs {
+		dst = appendUint32(dst, oid)
+	}
+	return finishMessage(dst, start)
+}
+
+func (m *ParameterDescription) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = ParameterDescription{ParameterOIDs: r.oids()}
+	return r.finish("ParameterDescription")
+}
+
+func (m *ParameterDescription) Backend() {}
+
+// ParameterStatus (B) reports the value of a run-time parameter.
+type ParameterStatus struct {
+	Name  string
+	Value string
+}
+
+func (m *ParameterStatus) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, parameterStatusType)
+	dst = appendString(dst, m.Name)
+	return finishMessage(appendString(dst, m.Value), start)
+}
+
+func (m *ParameterStatus) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = ParameterStatus{Name: r.string(), Value: r.string()}
+	return r.finish("ParameterStatus")
+}
+
+func (m *ParameterStatus) Backend() {}
+
+// ReadyForQuery (B) reports that backend is ready for a new query.
+type ReadyForQuery struct {
+	// TxStatus is TxIdle, TxInTransaction or TxFailed.
+	TxStatus byte
+}
+
+func (m *ReadyForQuery) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, readyForQueryType)
+	return finishMessage(append(dst, m.TxStatus), start)
+}
+
+func (m *ReadyForQuery) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = ReadyForQuery{TxStatus: r.byte()}
+	if r.err == nil && m.TxStatus != TxIdle && m.TxStatus != TxInTransaction && m.TxStatus != TxFailed {
+		r.fail(fmt.Sprintf("invalid transaction status %q", m.TxStatus))
+	}
+	return r.finish("ReadyForQuery")
+}
+
+func (m *ReadyForQuery) Backend() {}
+
+// FunctionCallResponse (B) answers FunctionCall.
+type FunctionCallResponse struct {
+	// Result is the value of the result, nil stands for NULL.
+	Result []byte
+}
+
+func (m *FunctionCallResponse) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, functionCallResponseType)
+	return finishMessage(appendValue(dst, m.Result), start)
+}
+
+func (m *FunctionCallResponse) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = FunctionCallResponse{Result: r.value()}
+	return r.finish("FunctionCallResponse")
+}
+
+func (m *FunctionCallResponse) Backend() {}
+
+// NegotiateProtocolVersion (B) reports the protocol version and the options backend supports
+// when the frontend requests a newer minor version or options it doesn't recognize.
+type NegotiateProtocolVersion struct {
+	NewestMinorVersion  uint32
+	UnrecognizedOptions []string
+}
+
+func (m *NegotiateProtocolVersion) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, negotiateProtocolType)
+	dst = appendUint32(dst, m.NewestMinorVersion)
+	dst = appendUint32(dst, uint32(len(m.UnrecognizedOptions)))
+	for _, option := range m.UnrecognizedOptions {
+		dst = appendString(dst, option)
+	}
+	return finishMessage(dst, start)
+}
+
+func (m *NegotiateProtocolVersion) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = NegotiateProtocolVersion{NewestMinorVersion: r.uint32()}
+	n := r.uint32()
+	// Each option takes at least its terminator.
+	if uint64(n) > uint64(len(r.buf)) {
+		r.fail("message is too short")
+	}
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		m.UnrecognizedOptions = append(m.UnrecognizedOptions, r.string())
+	}
+	return r.finish("NegotiateProtocolVersion")
+}
+
+func (m *NegotiateProtocolVersion) Backend() {}
+
+// NotificationResponse (B) delivers a notification of NOTIFY.
+type NotificationResponse struct {
+	// ProcessID is the process ID of the notifying backend.
+	ProcessID uint32
+	Channel   string
+	Payload   string
+}
+
+func (m *NotificationResponse) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, notificationResponseType)
+	dst = appendUint32(dst, m.ProcessID)
+	dst = appendString(dst, m.Channel)
+	return finishMessage(appendString(dst, m.Payload), start)
+}
+
+func (m *NotificationResponse) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = NotificationResponse{ProcessID: r.uint32(), Channel: r.string(), Payload: r.string()}
+	return r.finish("NotificationResponse")
+}
+
+func (m *NotificationResponse) Backend() {}
+
+// ErrorResponse (B) reports an error. Fields which are empty or zero are omitted.
+// See https://www.postgresql.org/docs/current/protocol-error-fields.html
+type ErrorResponse struct {
+	// Severity is ERROR, FATAL or PANIC in an error message, or WARNING, NOTICE, DEBUG, INFO or LOG
+	// in a notice message. It's never localized.
+	Severity string
+	// SeverityLocalized is the severity translated to the language of the server messages.
+	// Severity takes its place if it's empty, since servers always send it.
+	SeverityLocalized string
+	// Code is the SQLSTATE code of the error.
+	Code    string
+	Message string
+	Detail  string
+	Hint    string
+	// Position is the error cursor position as an index into the original query string starting from 1.
+	Position         int32
+	InternalPosition int32
+	InternalQuery    string
+	Where            string
+	SchemaName       string
+	TableName        string
+	ColumnName       string
+	DataTypeName     string
+	ConstraintName   string
+	File             string
+	Line             int32
+	Routine          string
+	// UnknownFields are the fields of types this package doesn't know about, keyed by their type byte.
+	UnknownFields map[byte]string
+}
+
+func (m *ErrorResponse) Encode(dst []byte) []byte {
+	return m.encode(dst, errorResponseType)
+}
+
+func (m *ErrorResponse) Decode(body []byte) error {
+	return m.decode(body, "ErrorResponse")
+}
+
+func (m *ErrorResponse) Backend() {}
+
+func (m *ErrorResponse) encode(dst []byte, t byte) []byte {
+	dst, start := beginMessage(dst, t)
+	severity := m.SeverityLocalized
+	if severity == "" {
+		severity = m.Severity
+	}
+	dst = appendField(dst, 'S', severity)
+	dst = appendField(dst, 'V', m.Severity)
+	dst = appendField(dst, 'C', m.Code)
+	dst = appendField(dst, 'M', m.Message)
+	dst = appendField(dst, 'D', m.Detail)
+	dst = appendField(dst, 'H', m.Hint)
+	dst = appendIntField(dst, 'P', m.Position)
+	dst = appendIntField(dst, 'p', m.InternalPosition)
+	dst = appendField(dst, 'q', m.InternalQuery)
+	dst = appendField(dst, 'W', m.Where)
+	dst = appendField(dst, 's', m.SchemaName)
+	dst = appendField(dst, 't', m.TableName)
+	dst = appendField(dst, 'c', m.ColumnName)
+	dst = appendField(dst, 'd', m.DataTypeName)
+	dst = appendField(dst, 'n', m.ConstraintName)
+	dst = appendField(dst, 'F', m.File)
+	dst = appendIntField(dst, 'L', m.Line)
+	dst = appendField(dst, 'R', m.Routine)
+
+	unknown := make([]int, 0, len(m.UnknownFields))
+	for t := range m.UnknownFields {
+		unknown = append(unknown, int(t))
+	}
+	sort.Ints(unknown)
+	for _, t := range unknown {
+		dst = appendField(dst, byte(t), m.UnknownFields[byte(t)])
+	}
+	return finishMessage(append(dst, 0), start)
+}
+
+// decode decodes the fields of the message called name. Each field is a byte identifying its type
+// followed by a null terminated string value. A zero byte terminates the fields.
+func (m *ErrorResponse) decode(body []byte, name string) error {
+	r := reader{buf: body}
+	*m = ErrorResponse{}
+	for r.err == nil {
+		t := r.byte()
+		if t == 0 {
+			break
+		}
+		value := r.string()
+		switch t {
+		case 'S':
+			m.SeverityLocalized = value
+		case 'V':
+			m.Severity = value
+		case 'C':
+			m.Code = value
+		case 'M':
+			m.Message = value
+		case 'D':
+			m.Detail = value
+		case 'H':
+			m.Hint = value
+		case 'P':
+			m.Position = r.intField(value)
+		case 'p':
+			m.InternalPosition = r.intField(value)
+		case 'q':
+			m.InternalQuery = value
+		case 'W':
+			m.Where = value
+		case 's':
+			m.SchemaName = value
+		case 't':
+			m.TableName = value
+		case 'c':
+			m.ColumnName = value
+		case 'd':
+			m.DataTypeName = value
+		case 'n':
+			m.ConstraintName = value
+		case 'F':
+			m.File = value
+		case 'L':
+			m.Line = r.intField(value)
+		case 'R':
+			m.Routine = value
+		default:
+			// Frontend should silently ignore fields of unrecognized type.
+			if m.UnknownFields == nil {
+				m.UnknownFields = make(map[byte]string)
+			}
+			m.UnknownFields[t] = value
+		}
+	}
+	return r.finish(name)
+}
+
+func appendField(dst []byte, t byte, value string) []byte {
+	if value == "" {
+		return dst
+	}
+	return appendString(append(dst, t), value)
+}
+
+func appendIntField(dst []byte, t byte, value int32) []byte {
+	if value == 0 {
+		return dst
+	}
+	return appendField(dst, t, strconv.FormatInt(int64(value), 10))
+}
+
+// NoticeResponse (B) reports a warning or another notice, it has the same fields as ErrorResponse.
+type NoticeResponse ErrorResponse
+
+func (m *NoticeResponse) Encode(dst []byte) []byte {
+	return (*ErrorResponse)(m).encode(dst, noticeResponseType)
+}
+
+func (m *NoticeResponse) Decode(body []byte) error {
+	return (*ErrorResponse)(m).decode(body, "NoticeResponse")
+}
+
+func (m *NoticeResponse) Backend() {}
+
+// EncryptionResponse (B) is the single byte backend answers SSLRequest or GSSENCRequest with.
+// It has neither the type byte nor the length.
+type EncryptionResponse struct {
+	// Response is 'S' if backend accepts SSLRequest, 'G' if it accepts GSSENCRequest and 'N' if it refuses either.
+	Response byte
+}
+
+// Accepted returns true if backend accepted the encryption request.
+func (m *EncryptionResponse) Accepted() bool {
+	return m.Response == 'S' || m.Response == 'G'
+}
+
+func (m *EncryptionResponse) Encode(dst []byte) []byte {
+	return append(dst, m.Response)
+}
+
+// Decode decodes the only byte of the message.
+func (m *EncryptionResponse) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = EncryptionResponse{Response: r.byte()}
+	if r.err == nil && m.Response != 'S' && m.Response != 'G' && m.Response != 'N' {
+		r.fail(fmt.Sprintf("invalid response %q", m.Response))
+	}
+	return r.finish("EncryptionResponse")
+}
+
+func (m *EncryptionResponse) Backend() {}
@@ -0,0 +1,136 @@
+package pgwire
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// decodeBackendStream decodes the only message of the stream sent by backend past the startup phase.
+func decodeBackendStream(t *testing.T, stream string) (Message, error) {
+	d := NewTypedDecoder(bytes.NewReader(decodeHexStream(t, stream)), ClientSide)
+	m, err := d.Decode()
+	if err != nil {
+		return nil, err
+	}
+	if next, err := d.Decode(); err != io.EOF {
+		t.Fatalf("Decode() after the message = %+v, %v, want io.EOF", next, err)
+	}
+	return m, nil
+}
+
+func Test_Decode_Backend(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   BackendMessage
+	}{
+		{"AuthenticationOk", "520000000800000000", &AuthenticationOk{}},
+		{"AuthenticationKerberosV5", "520000000800000002", &AuthenticationKerberosV5{}},
+		{"AuthenticationCleartextPassword", "520000000800000003", &AuthenticationCleartextPassword{}},
+		{"AuthenticationMD5Password", "520000000c000000059f3c1102", &AuthenticationMD5Password{Salt: [4]byte{0x9f, 0x3c, 0x11, 0x02}}},
+		{"AuthenticationGSS", "520000000800000007", &AuthenticationGSS{}},
+		{"AuthenticationGSSContinue", "520000000a000000086082", &AuthenticationGSSContinue{Data: []byte{0x60, 0x82}}},
+		{"AuthenticationSSPI", "520000000800000009", &AuthenticationSSPI{}},
+		{"AuthenticationSASL", "520000002a0000000a534352414d2d5348412d3235362d504c555300534352414d2d5348412d3235360000",
+			&AuthenticationSASL{Mechanisms: []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256"}}},
+		{"AuthenticationSASLContinue", "520000001f0000000b723d6162632c733d6332467364413d3d2c693d34303936",
+			&AuthenticationSASLContinue{Data: []byte("r=abc,s=c2FsdA==,i=4096")}},
+		{"AuthenticationSASLFinal", "52000000120000000c763d63326c6e62673d3d", &AuthenticationSASLFinal{Data: []byte("v=c2lnbg==")}},
+		{"BackendKeyData", "4b0000000c000030395eb1ca4e", &BackendKeyData{ProcessID: 12345, SecretKey: []byte{0x5e, 0xb1, 0xca, 0x4e}}},
+		{"BackendKeyData_Long_Key", "4b0000002800003039000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+			&BackendKeyData{ProcessID: 12345, SecretKey: []byte{
+				0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31,
+			}}},
+		{"BindComplete", "3200000004", &BindComplete{}},
+		{"CloseComplete", "3300000004", &CloseComplete{}},
+		{"CommandComplete", "430000000f494e534552542030203500", &CommandComplete{Tag: "INSERT 0 5"}},
+		{"CopyInResponse", "470000000b00000200000000", &CopyInResponse{Format: TextFormat, ColumnFormats: []Format{TextFormat, TextFormat}}},
+		{"CopyOutResponse", "48000000090100010001", &CopyOutResponse{Format: BinaryFormat, ColumnFormats: []Format{BinaryFormat}}},
+		{"CopyBothResponse", "5700000007000000", &CopyBothResponse{}},
+		{"CopyData", "640000000a31096f6e650a", &CopyData{Data: []byte("1\tone\n")}},
+		{"CopyDone", "6300000004", &CopyDone{}},
+		{"DataRow", "440000001300030000000131ffffffff00000000", &DataRow{Values: [][]byte{[]byte("1"), nil, {}}}},
+		{"EmptyQueryResponse", "4900000004", &EmptyQueryResponse{}},
+		{"ErrorResponse", "45000000b4534552524f5200564552524f5200433233353035004d6475706c6963617465206b65792076616c75652076696f6c6174657320756e6971756520636f6e73747261696e74202275736572735f706b65792200444b657920286964293d28312920616c7265616479206578697374732e00737075626c696300747573657273006e75736572735f706b657900466e6274696e736572742e63004c36363300525f62745f636865636b5f756e697175650000",
+			&ErrorResponse{
+				Severity:          "ERROR",
+				SeverityLocalized: "ERROR",
+				Code:              "23505",
+				Message:           `duplicate key value violates unique constraint "users_pkey"`,
+				Detail:            "Key (id)=(1) already exists.",
+				SchemaName:        "public",
+				TableName:         "users",
+				ConstraintName:    "users_pkey",
+				File:              "nbtinsert.c",
+				Line:              663,
+				Routine:           "_bt_check_unique",
+			}},
+		{"FunctionCallResponse", "560000000c000000040000002a", &FunctionCallResponse{Result: []byte{0, 0, 0, 42}}},
+		{"FunctionCallResponse_Null", "5600000008ffffffff", &FunctionCallResponse{}},
+		{"NegotiateProtocolVersion", "760000001a00000000000000025f70715f2e61005f70715f2e6200",
+			&NegotiateProtocolVersion{UnrecognizedOptions: []string{"_pq_.a", "_pq_.b"}}},
+		{"NoData", "6e00000004", &NoData{}},
+		{"NoticeResponse", "4e00000027535741524e554e4700565741524e494e4700433031303030004d6361726566756c0000",
+			&NoticeResponse{Severity: "WARNING", SeverityLocalized: "WARNUNG", Code: "01000", Message: "careful"}},
+		{"NotificationResponse", "4100000018000010926576656e7473007b226964223a317d00",
+			&NotificationResponse{ProcessID: 4242, Channel: "events", Payload: `{"id":1}`}},
+		{"NotificationResponse_Empty_Payload", "410000000b00000001630000", &NotificationResponse{ProcessID: 1, Channel: "c"}},
+		{"ParameterDescription", "740000000e00020000001700000019", &ParameterDescription{ParameterOIDs: []uint32{23, 25}}},
+		{"ParameterStatus", "530000001b54696d655a6f6e65004575726f70652f4265726c696e00", &ParameterStatus{Name: "TimeZone", Value: "Europe/Berlin"}},
+		{"ParseComplete", "3100000004", &ParseComplete{}},
+		{"PortalSuspended", "7300000004", &PortalSuspended{}},
+		{"ReadyForQuery", "5a0000000554", &ReadyForQuery{TxStatus: TxInTransaction}},
+		{"RowDescription", "54000000320002696400000040000001000000170004ffffffff00006e616d650000004000000200000413ffff000000240001",
+			&RowDescription{Fields: []FieldDescription{
+				{Name: "id", TableOID: 16384, TableAttributeNumber: 1, DataTypeOID: 23, DataTypeSize: 4, TypeModifier: -1, Format: TextFormat},
+				{Name: "name", TableOID: 16384, TableAttributeNumber: 2, DataTypeOID: 1043, DataTypeSize: -1, TypeModifier: 36, Format: BinaryFormat},
+			}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeBackendStream(t, tt.stream)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Decode() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Decode_Backend_Malformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+	}{
+		{"AuthenticationOk_Trailing_Bytes", "52000000090000000000"},
+		{"AuthenticationMD5Password_Short_Salt", "520000000a000000059f3c"},
+		{"AuthenticationSASL_Unterminated_List", "520000000d0000000a5343524100"},
+		{"BackendKeyData_Short_Key", "4b0000000a000030390102"},
+		{"CommandComplete_Unterminated", "43000000074f4b21"},
+		{"CopyInResponse_Invalid_Format", "4700000007020000"},
+		{"CopyOutResponse_Missing_Columns", "4800000007000002"},
+		{"CopyDone_With_Body", "630000000500"},
+		{"DataRow_Long_Value", "440000000a000100000005"},
+		{"FunctionCallResponse_Invalid_Length", "5600000008fffffffe"},
+		{"NegotiateProtocolVersion_Missing_Options", "760000000c0000000000000005"},
+		{"NoticeResponse_Unterminated", "4e0000000853414200"},
+		{"NotificationResponse_Unterminated", "410000000b00000001630070"},
+		{"ParameterDescription_Missing_OIDs", "740000000a000200000017"},
+		{"ParameterStatus_Missing_Value", "530000000a54696d655a00"},
+		{"ParseComplete_With_Body", "310000000500"},
+		{"ReadyForQuery_Invalid_Status", "5a0000000541"},
+		{"RowDescription_Truncated", "540000000a000161000000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := decodeBackendStream(t, tt.stream); !errors.Is(err, ErrMalformedMessage) {
+				t.Errorf("Decode() = %+v, %v, want %v", got, err, ErrMalformedMessage)
+			}
+		})
+	}
+}
@@ -0,0 +1,539 @@
+package pgwire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+var (
+	// ErrInvalidLength is returned by Decoder once the stream has a message of invalid length.
+	// The stream can't be decoded any further.
+	ErrInvalidLength = errors.New("pgwire: invalid message length")
+	// ErrUnknownMessage is wrapped by the errors about messages of unknown type.
+	ErrUnknownMessage = errors.New("pgwire: unknown message")
+	// ErrMalformedMessage is wrapped by the errors about messages which don't match their format.
+	ErrMalformedMessage = errors.New("pgwire: malformed message")
+	// ErrMessageTooLong is wrapped by the errors about messages longer than the limit of Decoder.
+	ErrMessageTooLong = errors.New("pgwire: message is too long")
+)
+
+// DefaultMaxMessageLen is the limit of message length Decoder applies unless SetMaxMessageLen changes it.
+// Backend doesn't accept longer messages either.
+const DefaultMaxMessageLen = 1 << 30
+
+const (
+	// maxStartupMessageLen is the limit of StartupMessage length which backend applies as well.
+	maxStartupMessageLen = 10000
+	// maxSecretKeyLen is the limit of the secret key length of BackendKeyData and CancelRequest.
+	maxSecretKeyLen = 256
+)
+
+// FrontendMessage is a message sent by frontend.
+type FrontendMessage interface {
+	Message
+	// Decode decodes the body of the message, which follows its type byte and length.
+	// The message may refer to body, so body must not be modified afterwards.
+	Decode(body []byte) error
+	Frontend()
+}
+
+// BackendMessage is a message sent by backend.
+type BackendMessage interface {
+	Message
+	// Decode decodes the body of the message, which follows its type byte and length.
+	// The message may refer to body, so body must not be modified afterwards.
+	Decode(body []byte) error
+	Backend()
+}
+
+type decodable interface {
+	Message
+	Decode(body []byte) error
+}
+
+// Side is the side of the connection Decoder reads the messages on.
+type Side int
+
+const (
+	// ClientSide reads the messages sent by backend.
+	ClientSide Side = iota
+	// ServerSide reads the messages sent by frontend.
+	ServerSide
+)
+
+// Decoder reads and decodes messages from a stream. It starts in the startup phase of the connection,
+// in which frontend sends messages without a type byte, e.g. StartupMessage or SSLRequest, and backend
+// answers encryption requests with a single byte, which is decoded as EncryptionResponse.
+// Once the encryption is accepted, a new Decoder must read the decrypted stream.
+//
+// A message which doesn't match its format, is of unknown type or is longer than the limit is skipped,
+// and the error is returned instead of it, so the decoding can go on. Any other error ends the stream.
+type Decoder struct {
+	r       io.Reader
+	side    Side
+	startup bool
+	header  [5]byte
+	// auth is the code of the Authentication message frontend responds to.
+	auth uint32
+	// maxLen is the limit of typed message length, not counting the type byte.
+	maxLen int
+	// err ends the stream.
+	err error
+}
+
+// NewDecoder creates Decoder which reads the messages from r on the side of the connection.
+func NewDecoder(r io.Reader, side Side) *Decoder {
+	return &Decoder{r: r, side: side, startup: true, maxLen: DefaultMaxMessageLen}
+}
+
+// NewTypedDecoder creates Decoder which reads the messages from r past the startup phase.
+func NewTypedDecoder(r io.Reader, side Side) *Decoder {
+	return &Decoder{r: r, side: side, maxLen: DefaultMaxMessageLen}
+}
+
+// SetMaxMessageLen sets the limit of message length, not counting the type byte. Longer messages
+// are read past without being kept in memory. Messages of the startup phase are limited to 10000 bytes regardless.
+func (d *Decoder) SetMaxMessageLen(n int) {
+	d.maxLen = n
+}
+
+// Decode reads and decodes the next message. The message is FrontendMessage on ServerSide
+// and BackendMessage on ClientSide. It returns io.EOF once the stream ends between messages.
+func (d *Decoder) Decode() (Message, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	switch {
+	case d.startup && d.side == ServerSide:
+		return d.decodeStartup()
+	case d.startup:
+		if _, err := io.ReadFull(d.r, d.header[:1]); err != nil {
+			return nil, d.fail(err)
+		}
+		switch d.header[0] {
+		case 'S', 'G', 'N':
+			m := &EncryptionResponse{}
+			return m, m.Decode(d.header[:1])
+		}
+		// Backend didn't answer an encryption request, so it's a regular message.
+		d.startup = false
+		if _, err := io.ReadFull(d.r, d.header[1:]); err != nil {
+			return nil, d.fail(unexpectedEOF(err))
+		}
+	default:
+		if _, err := io.ReadFull(d.r, d.header[:]); err != nil {
+			return nil, d.fail(err)
+		}
+	}
+
+	length := binary.BigEndian.Uint32(d.header[1:])
+	if length < 4 {
+		return nil, d.fail(ErrInvalidLength)
+	}
+	if int64(length) > int64(d.maxLen) {
+		if _, err := io.CopyN(io.Discard, d.r, int64(length)-4); err != nil {
+			return nil, d.fail(unexpectedEOF(err))
+		}
+		return nil, fmt.Errorf("%w: %d bytes of type %q", ErrMessageTooLong, length, d.header[0])
+	}
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(d.r, body); err != nil {
+		return nil, d.fail(unexpectedEOF(err))
+	}
+
+	var m decodable
+	if d.side == ServerSide {
+		m = newFrontendMessage(d.header[0], d.auth)
+	} else {
+		m = newBackendMessage(d.header[0], body)
+	}
+	if m == nil {
+		return nil, fmt.Errorf("%w of type %q", ErrUnknownMessage, d.header[0])
+	}
+	if err := m.Decode(body); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// decodeStartup decodes a message frontend sends without a type byte.
+func (d *Decoder) decodeStartup() (Message, error) {
+	if _, err := io.ReadFull(d.r, d.header[:4]); err != nil {
+		return nil, d.fail(err)
+	}
+	length := binary.BigEndian.Uint32(d.header[:4])
+	if length < 8 || length > maxStartupMessageLen {
+		return nil, d.fail(ErrInvalidLength)
+	}
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(d.r, body); err != nil {
+		return nil, d.fail(unexpectedEOF(err))
+	}
+
+	var m FrontendMessage
+	switch binary.BigEndian.Uint32(body) {
+	case sslRequestCode:
+		m = &SSLRequest{}
+	case gssencRequestCode:
+		m = &GSSENCRequest{}
+	case cancelRequestCode:
+		m = &CancelRequest{}
+	default:
+		m = &StartupMessage{}
+		// Either StartupMessage or a request backend rejects, nothing but regular messages may follow it.
+		d.startup = false
+	}
+	if err := m.Decode(body); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ExpectResponseTo tells Decoder on ServerSide that frontend responds to the Authentication message m
+// backend sent. PasswordMessage, SASLInitialResponse, SASLResponse and GSSResponse share the type byte,
+// so the messages of that type are decoded as the response to the last such m, PasswordMessage by default.
+// Messages other than Authentication are ignored.
+func (d *Decoder) ExpectResponseTo(m BackendMessage) {
+	switch m.(type) {
+	case *AuthenticationCleartextPassword:
+		d.auth = authenticationCleartextPassword
+	case *AuthenticationMD5Password:
+		d.auth = authenticationMD5Password
+	case *AuthenticationGSS:
+		d.auth = authenticationGSS
+	case *AuthenticationGSSContinue:
+		d.auth = authenticationGSSContinue
+	case *AuthenticationSSPI:
+		d.auth = authenticationSSPI
+	case *AuthenticationSASL:
+		d.auth = authenticationSASL
+	case *AuthenticationSASLContinue:
+		d.auth = authenticationSASLContinue
+	}
+}
+
+func (d *Decoder) fail(err error) error {
+	d.err = err
+	return err
+}
+
+// unexpectedEOF returns io.ErrUnexpectedEOF in place of io.EOF in the middle of a message.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// newFrontendMessage returns the message of type t. The messages of type 'p' are told apart
+// by the code of Authentication message auth they respond to.
+func newFrontendMessage(t byte, auth uint32) FrontendMessage {
+	switch t {
+	case bindType:
+		return &Bind{}
+	case closeType:
+		return &Close{}
+	case copyDataType:
+		return &CopyData{}
+	case copyDoneType:
+		return &CopyDone{}
+	case copyFailType:
+		return &CopyFail{}
+	case describeType:
+		return &Describe{}
+	case executeType:
+		return &Execute{}
+	case flushType:
+		return &Flush{}
+	case functionType:
+		return &FunctionCall{}
+	case parseType:
+		return &Parse{}
+	case passwordType:
+		return newPasswordMessage(auth)
+	case queryType:
+		return &Query{}
+	case syncType:
+		return &Sync{}
+	case terminateType:
+		return &Terminate{}
+	}
+	return nil
+}
+
+func newPasswordMessage(auth uint32) FrontendMessage {
+	switch auth {
+	case authenticationGSS, authenticationGSSContinue, authenticationSSPI:
+		return &GSSResponse{}
+	case authenticationSASL:
+		return &SASLInitialResponse{}
+	case authenticationSASLContinue:
+		return &SASLResponse{}
+	}
+	return &PasswordMessage{}
+}
+
+// newBackendMessage returns the message of type t. Authentication messages are told apart by their code,
+// so body is needed to pick one of them.
+func newBackendMessage(t byte, body []byte) BackendMessage {
+	switch t {
+	case authenticationType:
+		if len(body) < 4 {
+			// Any of them fails to decode.
+			return &AuthenticationOk{}
+		}
+		return newAuthenticationMessage(binary.BigEndian.Uint32(body))
+	case backendKeyDataType:
+		return &BackendKeyData{}
+	case bindCompleteType:
+		return &BindComplete{}
+	case closeCompleteType:
+		return &CloseComplete{}
+	case commandCompleteType:
+		return &CommandComplete{}
+	case copyBothResponseType:
+		return &CopyBothResponse{}
+	case copyDataType:
+		return &CopyData{}
+	case copyDoneType:
+		return &CopyDone{}
+	case copyInResponseType:
+		return &CopyInResponse{}
+	case copyOutResponseType:
+		return &CopyOutResponse{}
+	case dataRowType:
+		return &DataRow{}
+	case emptyQueryResponseType:
+		return &EmptyQueryResponse{}
+	case errorResponseType:
+		return &ErrorResponse{}
+	case functionCallResponseType:
+		return &FunctionCallResponse{}
+	case negotiateProtocolType:
+		return &NegotiateProtocolVersion{}
+	case noDataType:
+		return &NoData{}
+	case noticeResponseType:
+		return &NoticeResponse{}
+	case notificationResponseType:
+		return &NotificationResponse{}
+	case parameterDescriptionType:
+		return &ParameterDescription{}
+	case parameterStatusType:
+		return &ParameterStatus{}
+	case parseCompleteType:
+		return &ParseComplete{}
+	case portalSuspendedType:
+		return &PortalSuspended{}
+	case readyForQueryType:
+		return &ReadyForQuery{}
+	case rowDescriptionType:
+		return &RowDescription{}
+	}
+	return nil
+}
+
+func newAuthenticationMessage(code uint32) BackendMessage {
+	switch code {
+	case authenticationOk:
+		return &AuthenticationOk{}
+	case authenticationKerberosV5:
+		return &AuthenticationKerberosV5{}
+	case authenticationCleartextPassword:
+		return &AuthenticationCleartextPassword{}
+	case authenticationMD5Password:
+		return &AuthenticationMD5Password{}
+	case authenticationGSS:
+		return &AuthenticationGSS{}
+	case authenticationGSSContinue:
+		return &AuthenticationGSSContinue{}
+	case authenticationSSPI:
+		return &AuthenticationSSPI{}
+	case authenticationSASL:
+		return &AuthenticationSASL{}
+	case authenticationSASLContinue:
+		return &AuthenticationSASLContinue{}
+	case authenticationSASLFinal:
+		return &AuthenticationSASLFinal{}
+	}
+	return &unknownAuthentication{code: code}
+}
+
+// unknownAuthentication fails to decode Authentication message with an unknown code.
+type unknownAuthentication struct {
+	code uint32
+}
+
+func (m *unknownAuthentication) Encode(dst []byte) []byte {
+	return encodeAuthentication(dst, m.code, nil)
+}
+
+func (m *unknownAuthentication) Decode(body []byte) error {
+	return fmt.Errorf("%w of type 'R' with code %d", ErrUnknownMessage, m.code)
+}
+
+func (m *unknownAuthentication) Backend() {}
+
+// reader reads the fields of a message body. The first error sticks, and the fields read after it are zero.
+type reader struct {
+	buf []byte
+	err error
+}
+
+func (r *reader) fail(reason string) {
+	if r.err == nil {
+		r.err = errors.New(reason)
+	}
+	r.buf = nil
+}
+
+func (r *reader) next(n int) []byte {
+	if n > len(r.buf) {
+		r.fail("message is too short")
+		return nil
+	}
+	b := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *reader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+// string reads a null terminated string.
+func (r *reader) string() string {
+	i := bytes.IndexByte(r.buf, 0)
+	if i < 0 {
+		r.fail("string isn't terminated")
+		return ""
+	}
+	s := string(r.buf[:i])
+	r.buf = r.buf[i+1:]
+	return s
+}
+
+// value reads the length of a value followed by its bytes. The length -1 stands for NULL, which is nil.
+func (r *reader) value() []byte {
+	n := int32(r.uint32())
+	switch {
+	case r.err != nil || n == -1:
+		return nil
+	case n < 0:
+		r.fail("invalid value length")
+		return nil
+	case n == 0:
+		return []byte{}
+	}
+	return r.next(int(n))
+}
+
+// values reads the number of values followed by the values.
+func (r *reader) values() [][]byte {
+	n := int(r.uint16())
+	// Each value takes at least 4 bytes of its length.
+	if n == 0 || n*4 > len(r.buf) {
+		if n > 0 {
+			r.fail("message is too short")
+		}
+		return nil
+	}
+	values := make([][]byte, n)
+	for i := range values {
+		values[i] = r.value()
+	}
+	return values
+}
+
+// formats reads the number of format codes followed by the codes.
+func (r *reader) formats() []Format {
+	n := int(r.uint16())
+	if n == 0 || n*2 > len(r.buf) {
+		if n > 0 {
+			r.fail("message is too short")
+		}
+		return nil
+	}
+	formats := make([]Format, n)
+	for i := range formats {
+		formats[i] = Format(r.uint16())
+	}
+	return formats
+}
+
+// oids reads the number of object IDs followed by the IDs.
+func (r *reader) oids() []uint32 {
+	n := int(r.uint16())
+	if n == 0 || n*4 > len(r.buf) {
+		if n > 0 {
+			r.fail("message is too short")
+		}
+		return nil
+	}
+	oids := make([]uint32, n)
+	for i := range oids {
+		oids[i] = r.uint32()
+	}
+	return oids
+}
+
+// objectType reads the kind of object targeted by Close or Describe.
+func (r *reader) objectType() byte {
+	t := r.byte()
+	if r.err == nil && t != ObjectStatement && t != ObjectPortal {
+		r.fail(fmt.Sprintf("invalid object type %q", t))
+	}
+	return t
+}
+
+// intField parses the value of a numeric field of ErrorResponse or NoticeResponse.
+func (r *reader) intField(value string) int32 {
+	n, err := strconv.ParseInt(value, 10, 32)
+	if err != nil && r.err == nil {
+		r.fail(fmt.Sprintf("invalid numeric field %q", value))
+	}
+	return int32(n)
+}
+
+// rest reads the remaining bytes.
+func (r *reader) rest() []byte {
+	return r.next(len(r.buf))
+}
+
+// finish returns the error of the message called name, including the bytes which are left unread.
+func (r *reader) finish(name string) error {
+	if r.err == nil && len(r.buf) > 0 {
+		r.err = errors.New("unexpected bytes at the end")
+	}
+	if r.err != nil {
+		return fmt.Errorf("%w %s: %v", ErrMalformedMessage, name, r.err)
+	}
+	return nil
+}
+
+// decodeEmpty checks the body of the message called name which consists of the type byte and the length only.
+func decodeEmpty(body []byte, name string) error {
+	r := reader{buf: body}
+	return r.finish(name)
+}
@@ -0,0 +1,204 @@
+package pgwire
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func decodeHexStream(t testing.TB, stream string) []byte {
+	decoded, err := hex.DecodeString(stream)
+	if err != nil {
+		t.Fatalf("Failed to decode stream in %s", err)
+	}
+	return decoded
+}
+
+// decodeAll decodes the stream encoded from msgs and checks that it's decoded back into msgs.
+func decodeAll(t *testing.T, side Side, msgs ...Message) {
+	var stream []byte
+	for _, m := range msgs {
+		stream = m.Encode(stream)
+	}
+	d := NewDecoder(bytes.NewReader(stream), side)
+	for _, want := range msgs {
+		got, err := d.Decode()
+		if err != nil {
+			t.Fatalf("Decode() error = %v, want %T", err, want)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Decode() = %+v, want %+v", got, want)
+		}
+		switch side {
+		case ServerSide:
+			if _, ok := got.(FrontendMessage); !ok {
+				t.Errorf("%T isn't FrontendMessage", got)
+			}
+		case ClientSide:
+			if _, ok := got.(BackendMessage); !ok {
+				t.Errorf("%T isn't BackendMessage", got)
+			}
+		}
+	}
+	if got, err := d.Decode(); err != io.EOF {
+		t.Errorf("Decode() = %+v, %v, want io.EOF", got, err)
+	}
+}
+
+func Test_Decoder_ServerSide(t *testing.T) {
+	decodeAll(t, ServerSide,
+		&SSLRequest{},
+		&GSSENCRequest{},
+		&StartupMessage{ProtocolVersion: ProtocolVersion30, Parameters: map[string]string{"user": "u", "database": "d"}},
+		&Parse{Name: "s", Query: "SELECT $1", ParameterOIDs: []uint32{23}},
+		&Describe{ObjectType: ObjectStatement, Name: "s"},
+		&Bind{Statement: "s", ParameterFormats: []Format{BinaryFormat}, Parameters: [][]byte{{0, 0, 0, 1}, nil, {}}, ResultFormats: []Format{TextFormat, BinaryFormat}},
+		&Execute{MaxRows: 10},
+		&Close{ObjectType: ObjectPortal},
+		&Flush{},
+		&Sync{},
+		&Query{String: "SELECT 1"},
+	)
+}
+
+func Test_Decoder_ServerSide_CancelRequest(t *testing.T) {
+	decodeAll(t, ServerSide, &CancelRequest{ProcessID: 42, SecretKey: []byte{1, 2, 3, 4}})
+}
+
+func Test_Decoder_ClientSide(t *testing.T) {
+	decodeAll(t, ClientSide,
+		&EncryptionResponse{Response: 'N'},
+		&AuthenticationSASL{Mechanisms: []string{"SCRAM-SHA-256"}},
+		&AuthenticationSASLContinue{Data: []byte("r=abc")},
+		&AuthenticationSASLFinal{Data: []byte("v=xyz")},
+		&AuthenticationOk{},
+		&ParameterStatus{Name: "server_version", Value: "16"},
+		&BackendKeyData{ProcessID: 42, SecretKey: []byte{1, 2, 3, 4}},
+		&ReadyForQuery{TxStatus: TxIdle},
+		&ParseComplete{},
+		&ParameterDescription{ParameterOIDs: []uint32{23}},
+		&RowDescription{Fields: []FieldDescription{{Name: "a", DataTypeOID: 23, DataTypeSize: 4, TypeModifier: -1, Format: BinaryFormat}}},
+		&BindComplete{},
+		&DataRow{Values: [][]byte{[]byte("1"), nil}},
+		&NoticeResponse{Severity: "NOTICE", SeverityLocalized: "NOTICE", Code: "00000", Message: "n"},
+		&CommandComplete{Tag: "SELECT 1"},
+		&PortalSuspended{},
+		&EmptyQueryResponse{},
+		&NoData{},
+		&CloseComplete{},
+		&ErrorResponse{Severity: "ERROR", SeverityLocalized: "ERROR", Code: "42601", Message: "syntax error", Position: 8, UnknownFields: map[byte]string{'Y': "y"}},
+		&ReadyForQuery{TxStatus: TxFailed},
+	)
+}
+
+func Test_Decoder_ClientSide_Authentication(t *testing.T) {
+	decodeAll(t, ClientSide,
+		&AuthenticationKerberosV5{},
+		&AuthenticationCleartextPassword{},
+		&AuthenticationMD5Password{Salt: [4]byte{1, 2, 3, 4}},
+		&AuthenticationGSS{},
+		&AuthenticationGSSContinue{Data: []byte{1}},
+		&AuthenticationSSPI{},
+	)
+}
+
+func Test_Decoder_Encryption_Accepted(t *testing.T) {
+	d := NewDecoder(bytes.NewReader([]byte("S")), ClientSide)
+	m, err := d.Decode()
+	if r, ok := m.(*EncryptionResponse); err != nil || !ok || !r.Accepted() {
+		t.Errorf("Decode() = %+v, %v, want accepted EncryptionResponse", m, err)
+	}
+}
+
+func Test_Decoder_Skips_Invalid_Messages(t *testing.T) {
+	tests := []struct {
+		name string
+		side Side
+		// stream is an invalid message followed by Sync or ReadyForQuery.
+		stream string
+		want   error
+	}{
+		{"Unknown_Type", ServerSide, "7a00000004" + "5300000004", ErrUnknownMessage},
+		{"Unknown_Authentication", ClientSide, "520000000800000063" + "5a0000000549", ErrUnknownMessage},
+		{"Unterminated_String", ServerSide, "510000000541" + "5300000004", ErrMalformedMessage},
+		{"Trailing_Bytes", ServerSide, "530000000500" + "5300000004", ErrMalformedMessage},
+		{"Invalid_Object_Type", ServerSide, "430000000641" + "00" + "5300000004", ErrMalformedMessage},
+		{"Invalid_Value_Length", ServerSide, "420000000e" + "0000" + "0000" + "0001" + "fffffffe" + "5300000004", ErrMalformedMessage},
+		{"Invalid_Transaction_Status", ClientSide, "5a0000000541" + "5a0000000549", ErrMalformedMessage},
+		{"Invalid_Error_Position", ClientSide, "450000000850780000" + "5a0000000549", ErrMalformedMessage},
+		{"Short_Authentication", ClientSide, "52000000050a" + "5a0000000549", ErrMalformedMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewTypedDecoder(bytes.NewReader(decodeHexStream(t, tt.stream)), tt.side)
+			if m, err := d.Decode(); !errors.Is(err, tt.want) {
+				t.Errorf("Decode() = %+v, %v, want %v", m, err, tt.want)
+			}
+			m, err := d.Decode()
+			if err != nil {
+				t.Fatalf("Decode() of the next message error = %v", err)
+			}
+			switch m.(type) {
+			case *Sync, *ReadyForQuery:
+			default:
+				t.Errorf("Decode() of the next message = %T", m)
+			}
+		})
+	}
+}
+
+func Test_Decoder_Broken_Stream(t *testing.T) {
+	tests := []struct {
+		name   string
+		side   Side
+		typed  bool
+		stream string
+		want   error
+	}{
+		{"Invalid_Length", ServerSide, true, "5300000003" + "5300000004", ErrInvalidLength},
+		{"Short_StartupMessage", ServerSide, false, "00000004", ErrInvalidLength},
+		{"Long_StartupMessage", ServerSide, false, "00100000", ErrInvalidLength},
+		{"Truncated_Header", ClientSide, true, "5a000000", io.ErrUnexpectedEOF},
+		{"Truncated_Body", ClientSide, true, "5a00000005", io.ErrUnexpectedEOF},
+		{"Truncated_After_Startup", ClientSide, false, "5a00", io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bytes.NewReader(decodeHexStream(t, tt.stream))
+			d := NewDecoder(r, tt.side)
+			if tt.typed {
+				d = NewTypedDecoder(r, tt.side)
+			}
+			if m, err := d.Decode(); err != tt.want {
+				t.Errorf("Decode() = %+v, %v, want %v", m, err, tt.want)
+			}
+			// The stream can't be decoded any further.
+			if m, err := d.Decode(); err != tt.want {
+				t.Errorf("second Decode() = %+v, %v, want %v", m, err, tt.want)
+			}
+		})
+	}
+}
+
+func Test_StartupMessage_Decode_Unsupported_Version(t *testing.T) {
+	msg := (&StartupMessage{ProtocolVersion: 2 << 16}).Encode(nil)
+	if err := (&StartupMessage{}).Decode(msg[4:]); !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("Decode() error = %v, want %v", err, ErrMalformedMessage)
+	}
+}
+
+func Test_Decoder_Skips_Long_Messages(t *testing.T) {
+	stream := (&DataRow{Values: [][]byte{[]byte("0123456789")}}).Encode(nil)
+	stream = (&ReadyForQuery{TxStatus: TxIdle}).Encode(stream)
+	d := NewTypedDecoder(bytes.NewReader(stream), ClientSide)
+	d.SetMaxMessageLen(16)
+	if m, err := d.Decode(); !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("Decode() = %+v, %v, want %v", m, err, ErrMessageTooLong)
+	}
+	if m, err := d.Decode(); err != nil || !reflect.DeepEqual(m, &ReadyForQuery{TxStatus: TxIdle}) {
+		t.Errorf("Decode() of the next message = %+v, %v", m, err)
+	}
+}
@@ -0,0 +1,91 @@
+package pgwire
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func Test_Encode(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		want string
+	}{
+		{"StartupMessage", &StartupMessage{ProtocolVersion: ProtocolVersion30, Parameters: map[string]string{"user": "u", "database": "d", "application_name": "a"}},
+			"0000002e000300007573657200750064617461626173650064006170706c69636174696f6e5f6e616d6500610000"},
+		{"SSLRequest", &SSLRequest{}, "0000000804d2162f"},
+		{"GSSENCRequest", &GSSENCRequest{}, "0000000804d21630"},
+		{"CancelRequest", &CancelRequest{ProcessID: 1, SecretKey: []byte{0, 0, 0, 2}}, "0000001004d2162e0000000100000002"},
+		{"Query", &Query{String: "SELECT 1"}, "510000000d53454c4543542031" + "00"},
+		{"Parse", &Parse{Name: "s", Query: "SELECT $1", ParameterOIDs: []uint32{23}}, "5000000016730053454c45435420243100000100000017"},
+		{"Bind", &Bind{Statement: "s", ParameterFormats: []Format{BinaryFormat}, Parameters: [][]byte{{1}, nil}, ResultFormats: []Format{TextFormat}},
+			"420000001a0073000001000100020000000101ffffffff00010000"},
+		{"Describe", &Describe{ObjectType: ObjectPortal, Name: "p"}, "4400000007507000"},
+		{"Execute", &Execute{MaxRows: 10}, "4500000009000000000a"},
+		{"Close", &Close{ObjectType: ObjectStatement}, "430000000653" + "00"},
+		{"Sync", &Sync{}, "5300000004"},
+		{"Flush", &Flush{}, "4800000004"},
+		{"Terminate", &Terminate{}, "5800000004"},
+		{"CopyData", &CopyData{Data: []byte("1\n")}, "6400000006310a"},
+		{"CopyDone", &CopyDone{}, "6300000004"},
+		{"CopyFail", &CopyFail{Message: "x"}, "66000000067800"},
+		{"FunctionCall", &FunctionCall{Function: 1, Arguments: [][]byte{{2}}, ResultFormat: BinaryFormat},
+			"4600000013" + "00000001" + "0000" + "0001" + "0000000102" + "0001"},
+		{"PasswordMessage", &PasswordMessage{Password: "pw"}, "7000000007707700"},
+		{"SASLInitialResponse", &SASLInitialResponse{Mechanism: "M"}, "700000000a4d00ffffffff"},
+		{"SASLResponse", &SASLResponse{Data: []byte("r")}, "700000000572"},
+		{"GSSResponse", &GSSResponse{Data: []byte("g")}, "700000000567"},
+
+		{"AuthenticationOk", &AuthenticationOk{}, "520000000800000000"},
+		{"AuthenticationKerberosV5", &AuthenticationKerberosV5{}, "520000000800000002"},
+		{"AuthenticationCleartextPassword", &AuthenticationCleartextPassword{}, "520000000800000003"},
+		{"AuthenticationMD5Password", &AuthenticationMD5Password{Salt: [4]byte{1, 2, 3, 4}}, "520000000c0000000501020304"},
+		{"AuthenticationGSS", &AuthenticationGSS{}, "520000000800000007"},
+		{"AuthenticationGSSContinue", &AuthenticationGSSContinue{Data: []byte{9}}, "52000000090000000809"},
+		{"AuthenticationSSPI", &AuthenticationSSPI{}, "520000000800000009"},
+		{"AuthenticationSASL", &AuthenticationSASL{Mechanisms: []string{"A", "B"}}, "520000000d0000000a4100420000"},
+		{"AuthenticationSASLContinue", &AuthenticationSASLContinue{Data: []byte("c")}, "52000000090000000b63"},
+		{"AuthenticationSASLFinal", &AuthenticationSASLFinal{Data: []byte("f")}, "52000000090000000c66"},
+		{"BackendKeyData", &BackendKeyData{ProcessID: 1, SecretKey: []byte{0, 0, 0, 2}}, "4b0000000c0000000100000002"},
+		{"ParseComplete", &ParseComplete{}, "3100000004"},
+		{"BindComplete", &BindComplete{}, "3200000004"},
+		{"CloseComplete", &CloseComplete{}, "3300000004"},
+		{"NoData", &NoData{}, "6e00000004"},
+		{"EmptyQueryResponse", &EmptyQueryResponse{}, "4900000004"},
+		{"PortalSuspended", &PortalSuspended{}, "7300000004"},
+		{"CommandComplete", &CommandComplete{Tag: "SELECT 1"}, "430000000d53454c4543542031" + "00"},
+		{"CopyInResponse", &CopyInResponse{ColumnFormats: []Format{TextFormat, TextFormat}}, "470000000b00000200000000"},
+		{"CopyOutResponse", &CopyOutResponse{Format: BinaryFormat, ColumnFormats: []Format{BinaryFormat}}, "4800000009" + "01" + "0001" + "0001"},
+		{"CopyBothResponse", &CopyBothResponse{}, "570000000700" + "0000"},
+		{"DataRow", &DataRow{Values: [][]byte{[]byte("1"), nil}}, "440000000f" + "0002" + "0000000131" + "ffffffff"},
+		{"RowDescription", &RowDescription{Fields: []FieldDescription{{Name: "a", TableOID: 1, TableAttributeNumber: 2, DataTypeOID: 23, DataTypeSize: 4, TypeModifier: -1}}},
+			"540000001a0001" + "6100" + "00000001" + "0002" + "00000017" + "0004" + "ffffffff" + "0000"},
+		{"ParameterDescription", &ParameterDescription{ParameterOIDs: []uint32{23, 25}}, "740000000e00020000001700000019"},
+		{"ParameterStatus", &ParameterStatus{Name: "a", Value: "b"}, "53000000086100" + "6200"},
+		{"ReadyForQuery", &ReadyForQuery{TxStatus: TxInTransaction}, "5a0000000554"},
+		{"FunctionCallResponse", &FunctionCallResponse{}, "5600000008ffffffff"},
+		{"NegotiateProtocolVersion", &NegotiateProtocolVersion{NewestMinorVersion: 0, UnrecognizedOptions: []string{"_pq_.x"}},
+			"76000000130000000000000001" + "5f70715f2e7800"},
+		{"NotificationResponse", &NotificationResponse{ProcessID: 1, Channel: "c", Payload: "p"}, "410000000c00000001630070" + "00"},
+		{"ErrorResponse", &ErrorResponse{Severity: "ERROR", Code: "42P01", Message: "m", Position: 15},
+			"4500000021" + "534552524f5200" + "564552524f5200" + "433432503031" + "00" + "4d6d00" + "50313500" + "00"},
+		{"ErrorResponse_Unknown_Fields", &ErrorResponse{SeverityLocalized: "FEHLER", Severity: "ERROR", UnknownFields: map[byte]string{'z': "2", 'Y': "1"}},
+			"450000001a" + "534645484c455200" + "564552524f5200" + "593100" + "7a3200" + "00"},
+		{"NoticeResponse", &NoticeResponse{Severity: "NOTICE", Message: "n"}, "4e00000018" + "534e4f5449434500" + "564e4f5449434500" + "4d6e00" + "00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hex.EncodeToString(tt.msg.Encode(nil)); got != tt.want {
+				t.Errorf("Encode() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Encode_Appends(t *testing.T) {
+	dst := (&Sync{}).Encode([]byte{0xff})
+	dst = (&Query{String: ""}).Encode(dst)
+	if got, want := hex.EncodeToString(dst), "ff5300000004"+"510000000500"; got != want {
+		t.Errorf("Encode() = %s, want %s", got, want)
+	}
+}
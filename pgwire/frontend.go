@@ -0,0 +1,484 @@
+package pgwire
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	bindType      = 'B'
+	closeType     = 'C'
+	copyDataType  = 'd'
+	copyDoneType  = 'c'
+	copyFailType  = 'f'
+	describeType  = 'D'
+	executeType   = 'E'
+	flushType     = 'H'
+	functionType  = 'F'
+	parseType     = 'P'
+	passwordType  = 'p'
+	queryType     = 'Q'
+	syncType      = 'S'
+	terminateType = 'X'
+)
+
+// StartupMessage (F) starts the connection.
+type StartupMessage struct {
+	// ProtocolVersion is the version of the protocol the frontend requests, e.g. ProtocolVersion30.
+	ProtocolVersion uint32
+	// Parameters are run-time parameters: user, database, options, replication, application_name and others.
+	Parameters map[string]string
+}
+
+// Encode appends the message to dst. user and database go first as libpq sends them,
+// the rest of parameters are sorted by name.
+func (m *StartupMessage) Encode(dst []byte) []byte {
+	names := make([]string, 0, len(m.Parameters))
+	for name := range m.Parameters {
+		if name != "user" && name != "database" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	names = append([]string{"user", "database"}, names...)
+
+	dst, start := beginUntypedMessage(dst)
+	dst = appendUint32(dst, m.ProtocolVersion)
+	for _, name := range names {
+		value, ok := m.Parameters[name]
+		if !ok {
+			continue
+		}
+		dst = appendString(dst, name)
+		dst = appendString(dst, value)
+	}
+	return finishMessage(append(dst, 0), start)
+}
+
+// Decode decodes the body following the length. Only major version 3 of the protocol is supported.
+func (m *StartupMessage) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = StartupMessage{ProtocolVersion: r.uint32(), Parameters: make(map[string]string)}
+	if r.err == nil && m.ProtocolVersion>>16 != 3 {
+		r.fail(fmt.Sprintf("unsupported protocol version %d.%d", m.ProtocolVersion>>16, m.ProtocolVersion&0xffff))
+	}
+	// Parameters are pairs of names and values terminated by an empty name.
+	for r.err == nil {
+		name := r.string()
+		if name == "" {
+			break
+		}
+		m.Parameters[name] = r.string()
+	}
+	return r.finish("StartupMessage")
+}
+
+func (m *StartupMessage) Frontend() {}
+
+// SSLRequest (F) asks backend to encrypt the connection with TLS.
+type SSLRequest struct{}
+
+func (m *SSLRequest) Encode(dst []byte) []byte {
+	dst, start := beginUntypedMessage(dst)
+	return finishMessage(appendUint32(dst, sslRequestCode), start)
+}
+
+func (m *SSLRequest) Decode(body []byte) error {
+	return decodeRequest(body, sslRequestCode, "SSLRequest")
+}
+
+func (m *SSLRequest) Frontend() {}
+
+// GSSENCRequest (F) asks backend to encrypt the connection with GSSAPI.
+type GSSENCRequest struct{}
+
+func (m *GSSENCRequest) Encode(dst []byte) []byte {
+	dst, start := beginUntypedMessage(dst)
+	return finishMessage(appendUint32(dst, gssencRequestCode), start)
+}
+
+func (m *GSSENCRequest) Decode(body []byte) error {
+	return decodeRequest(body, gssencRequestCode, "GSSENCRequest")
+}
+
+func (m *GSSENCRequest) Frontend() {}
+
+// decodeRequest checks the body of the request called name which consists of its code only.
+func decodeRequest(body []byte, code uint32, name string) error {
+	r := reader{buf: body}
+	if r.uint32() != code && r.err == nil {
+		r.fail("invalid request code")
+	}
+	return r.finish(name)
+}
+
+// CancelRequest (F) asks backend to cancel the query running in another connection.
+type CancelRequest struct {
+	// ProcessID and SecretKey are the ones the target backend sent in BackendKeyData.
+	ProcessID uint32
+	SecretKey []byte
+}
+
+func (m *CancelRequest) Encode(dst []byte) []byte {
+	dst, start := beginUntypedMessage(dst)
+	dst = appendUint32(dst, cancelRequestCode)
+	dst = appendUint32(dst, m.ProcessID)
+	return finishMessage(append(dst, m.SecretKey...), start)
+}
+
+func (m *CancelRequest) Decode(body []byte) error {
+	r := reader{buf: body}
+	if r.uint32() != cancelRequestCode && r.err == nil {
+		r.fail("invalid request code")
+	}
+	*m = CancelRequest{ProcessID: r.uint32(), SecretKey: r.rest()}
+	if r.err == nil && (len(m.SecretKey) < 4 || len(m.SecretKey) > maxSecretKeyLen) {
+		r.fail("invalid secret key length")
+	}
+	return r.finish("CancelRequest")
+}
+
+func (m *CancelRequest) Frontend() {}
+
+// Query (F) runs a simple query.
+type Query struct {
+	// String is the query string itself. It may contain several statements separated by semicolons.
+	String string
+}
+
+func (m *Query) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, queryType)
+	return finishMessage(appendString(dst, m.String), start)
+}
+
+func (m *Query) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = Query{String: r.string()}
+	return r.finish("Query")
+}
+
+func (m *Query) Frontend() {}
+
+// Parse (F) prepares a statement.
+type Parse struct {
+	// Name is the name of the prepared statement, an empty string selects the unnamed one.
+	Name  string
+	Query string
+	// ParameterOIDs prespecify the data types of the parameters, zero leaves the type unspecified.
+	ParameterOIDs []uint32
+}
+
+func (m *Parse) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, parseType)
+	dst = appendString(dst, m.Name)
+	dst = appendString(dst, m.Query)
+	dst = appendUint16(dst, uint16(len(m.ParameterOIDs)))
+	for _, oid := range m.ParameterOIDs {
+		dst = appendUint32(dst, oid)
+	}
+	return finishMessage(dst, start)
+}
+
+func (m *Parse) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = Parse{Name: r.string(), Query: r.string(), ParameterOIDs: r.oids()}
+	return r.finish("Parse")
+}
+
+func (m *Parse) Frontend() {}
+
+// Bind (F) creates a portal from a prepared statement.
+type Bind struct {
+	// Portal and Statement are the names of the portal and the prepared statement,
+	// empty strings select the unnamed ones.
+	Portal    string
+	Statement string
+	// ParameterFormats are either empty if all parameters are in text format, a single format
+	// of all parameters or the format of each parameter.
+	ParameterFormats []Format
+	// Parameters are the values of the parameters, nil stands for NULL.
+	Parameters [][]byte
+	// ResultFormats are the formats of the result columns following the same rules as ParameterFormats.
+	ResultFormats []Format
+}
+
+func (m *Bind) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, bindType)
+	dst = appendString(dst, m.Portal)
+	dst = appendString(dst, m.Statement)
+	dst = appendFormats(dst, m.ParameterFormats)
+	dst = appendValues(dst, m.Parameters)
+	dst = appendFormats(dst, m.ResultFormats)
+	return finishMessage(dst, start)
+}
+
+func (m *Bind) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = Bind{Portal: r.string(), Statement: r.string()}
+	m.ParameterFormats = r.formats()
+	m.Parameters = r.values()
+	m.ResultFormats = r.formats()
+	return r.finish("Bind")
+}
+
+func (m *Bind) Frontend() {}
+
+// Describe (F) asks for the description of a prepared statement or a portal.
+type Describe struct {
+	// ObjectType is ObjectStatement or ObjectPortal.
+	ObjectType byte
+	Name       string
+}
+
+func (m *Describe) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, describeType)
+	dst = append(dst, m.ObjectType)
+	return finishMessage(appendString(dst, m.Name), start)
+}
+
+func (m *Describe) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = Describe{ObjectType: r.objectType(), Name: r.string()}
+	return r.finish("Describe")
+}
+
+func (m *Describe) Frontend() {}
+
+// Execute (F) runs a portal.
+type Execute struct {
+	Portal string
+	// MaxRows is the maximum number of rows to return, zero denotes no limit.
+	MaxRows uint32
+}
+
+func (m *Execute) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, executeType)
+	dst = appendString(dst, m.Portal)
+	return finishMessage(appendUint32(dst, m.MaxRows), start)
+}
+
+func (m *Execute) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = Execute{Portal: r.string(), MaxRows: r.uint32()}
+	return r.finish("Execute")
+}
+
+func (m *Execute) Frontend() {}
+
+// Close (F) closes a prepared statement or a portal.
+type Close struct {
+	// ObjectType is ObjectStatement or ObjectPortal.
+	ObjectType byte
+	Name       string
+}
+
+func (m *Close) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, closeType)
+	dst = append(dst, m.ObjectType)
+	return finishMessage(appendString(dst, m.Name), start)
+}
+
+func (m *Close) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = Close{ObjectType: r.objectType(), Name: r.string()}
+	return r.finish("Close")
+}
+
+func (m *Close) Frontend() {}
+
+// Sync (F) ends an extended query batch.
+type Sync struct{}
+
+func (m *Sync) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, syncType)
+}
+
+func (m *Sync) Decode(body []byte) error {
+	return decodeEmpty(body, "Sync")
+}
+
+func (m *Sync) Frontend() {}
+
+// Flush (F) asks backend to send the pending responses.
+type Flush struct{}
+
+func (m *Flush) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, flushType)
+}
+
+func (m *Flush) Decode(body []byte) error {
+	return decodeEmpty(body, "Flush")
+}
+
+func (m *Flush) Frontend() {}
+
+// Terminate (F) closes the connection.
+type Terminate struct{}
+
+func (m *Terminate) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, terminateType)
+}
+
+func (m *Terminate) Decode(body []byte) error {
+	return decodeEmpty(body, "Terminate")
+}
+
+func (m *Terminate) Frontend() {}
+
+// CopyData (F & B) carries data of COPY.
+type CopyData struct {
+	Data []byte
+}
+
+func (m *CopyData) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, copyDataType)
+	return finishMessage(append(dst, m.Data...), start)
+}
+
+func (m *CopyData) Decode(body []byte) error {
+	*m = CopyData{Data: body}
+	return nil
+}
+
+func (m *CopyData) Frontend() {}
+
+func (m *CopyData) Backend() {}
+
+// CopyDone (F & B) ends data of COPY.
+type CopyDone struct{}
+
+func (m *CopyDone) Encode(dst []byte) []byte {
+	return encodeEmpty(dst, copyDoneType)
+}
+
+func (m *CopyDone) Decode(body []byte) error {
+	return decodeEmpty(body, "CopyDone")
+}
+
+func (m *CopyDone) Frontend() {}
+
+func (m *CopyDone) Backend() {}
+
+// CopyFail (F) aborts COPY FROM STDIN.
+type CopyFail struct {
+	// Message is the reason of the failure.
+	Message string
+}
+
+func (m *CopyFail) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, copyFailType)
+	return finishMessage(appendString(dst, m.Message), start)
+}
+
+func (m *CopyFail) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = CopyFail{Message: r.string()}
+	return r.finish("CopyFail")
+}
+
+func (m *CopyFail) Frontend() {}
+
+// FunctionCall (F) calls a function.
+type FunctionCall struct {
+	// Function is the object ID of the function to call.
+	Function uint32
+	// ArgumentFormats follow the same rules as ParameterFormats of Bind.
+	ArgumentFormats []Format
+	// Arguments are the values of the arguments, nil stands for NULL.
+	Arguments    [][]byte
+	ResultFormat Format
+}
+
+func (m *FunctionCall) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, functionType)
+	dst = appendUint32(dst, m.Function)
+	dst = appendFormats(dst, m.ArgumentFormats)
+	dst = appendValues(dst, m.Arguments)
+	return finishMessage(appendUint16(dst, uint16(m.ResultFormat)), start)
+}
+
+func (m *FunctionCall) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = FunctionCall{Function: r.uint32()}
+	m.ArgumentFormats = r.formats()
+	m.Arguments = r.values()
+	m.ResultFormat = Format(r.uint16())
+	return r.finish("FunctionCall")
+}
+
+func (m *FunctionCall) Frontend() {}
+
+// PasswordMessage (F) responds to AuthenticationCleartextPassword or AuthenticationMD5Password.
+type PasswordMessage struct {
+	// Password is either the password itself or its md5 hash.
+	Password string
+}
+
+func (m *PasswordMessage) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, passwordType)
+	return finishMessage(appendString(dst, m.Password), start)
+}
+
+func (m *PasswordMessage) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = PasswordMessage{Password: r.string()}
+	return r.finish("PasswordMessage")
+}
+
+func (m *PasswordMessage) Frontend() {}
+
+// SASLInitialResponse (F) responds to AuthenticationSASL.
+type SASLInitialResponse struct {
+	// Mechanism is the name of SASL authentication mechanism the client selected.
+	Mechanism string
+	// Data is the mechanism specific initial response, nil if there is none.
+	Data []byte
+}
+
+func (m *SASLInitialResponse) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, passwordType)
+	dst = appendString(dst, m.Mechanism)
+	return finishMessage(appendValue(dst, m.Data), start)
+}
+
+func (m *SASLInitialResponse) Decode(body []byte) error {
+	r := reader{buf: body}
+	*m = SASLInitialResponse{Mechanism: r.string(), Data: r.value()}
+	return r.finish("SASLInitialResponse")
+}
+
+func (m *SASLInitialResponse) Frontend() {}
+
+// SASLResponse (F) responds to AuthenticationSASLContinue.
+type SASLResponse struct {
+	Data []byte
+}
+
+func (m *SASLResponse) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, passwordType)
+	return finishMessage(append(dst, m.Data...), start)
+}
+
+func (m *SASLResponse) Decode(body []byte) error {
+	*m = SASLResponse{Data: body}
+	return nil
+}
+
+func (m *SASLResponse) Frontend() {}
+
+// GSSResponse (F) responds to AuthenticationGSSContinue.
+type GSSResponse struct {
+	Data []byte
+}
+
+func (m *GSSResponse) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, passwordType)
+	return finishMessage(append(dst, m.Data...), start)
+}
+
+func (m *GSSResponse) Decode(body []byte) error {
+	*m = GSSResponse{Data: body}
+	return nil
+}
+
+func (m *GSSResponse) Frontend() {}
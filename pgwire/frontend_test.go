@@ -0,0 +1,131 @@
+package pgwire
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// decodeFrontendStream decodes the only message of the stream sent by frontend in response to auth.
+// The stream is decoded in the startup phase if it begins with a length rather than a type byte.
+func decodeFrontendStream(t *testing.T, stream string, auth BackendMessage) (Message, error) {
+	data := decodeHexStream(t, stream)
+	d := NewTypedDecoder(bytes.NewReader(data), ServerSide)
+	if len(data) > 0 && data[0] == 0 {
+		d = NewDecoder(bytes.NewReader(data), ServerSide)
+	}
+	if auth != nil {
+		d.ExpectResponseTo(auth)
+	}
+	m, err := d.Decode()
+	if err != nil {
+		return nil, err
+	}
+	if next, err := d.Decode(); err != io.EOF {
+		t.Fatalf("Decode() after the message = %+v, %v, want io.EOF", next, err)
+	}
+	return m, nil
+}
+
+func Test_Decode_Frontend(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		auth   BackendMessage
+		want   FrontendMessage
+	}{
+		{"StartupMessage", "00000038000300007573657200616c6963650064617461626173650073686f70006170706c69636174696f6e5f6e616d65007073716c0000", nil,
+			&StartupMessage{ProtocolVersion: ProtocolVersion30, Parameters: map[string]string{"user": "alice", "database": "shop", "application_name": "psql"}}},
+		{"StartupMessage_Version_3_2", "0000001d000300027573657200616c696365005f70715f2e7800310000", nil,
+			&StartupMessage{ProtocolVersion: ProtocolVersion32, Parameters: map[string]string{"user": "alice", "_pq_.x": "1"}}},
+		{"SSLRequest", "0000000804d2162f", nil, &SSLRequest{}},
+		{"GSSENCRequest", "0000000804d21630", nil, &GSSENCRequest{}},
+		{"CancelRequest", "0000001004d2162e000030395eb1ca4e", nil, &CancelRequest{ProcessID: 12345, SecretKey: []byte{0x5e, 0xb1, 0xca, 0x4e}}},
+		{"CancelRequest_Long_Key", "0000002c04d2162e00003039000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f", nil,
+			&CancelRequest{ProcessID: 12345, SecretKey: []byte{
+				0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31,
+			}}},
+		{"Bind", "4200000022703100733100000100010002000000040000002affffffff000200000001", nil,
+			&Bind{Portal: "p1", Statement: "s1", ParameterFormats: []Format{BinaryFormat}, Parameters: [][]byte{{0, 0, 0, 42}, nil},
+				ResultFormats: []Format{TextFormat, BinaryFormat}}},
+		{"Close", "430000000850703100", nil, &Close{ObjectType: ObjectPortal, Name: "p1"}},
+		{"CopyData", "640000000a31096f6e650a", nil, &CopyData{Data: []byte("1\tone\n")}},
+		{"CopyDone", "6300000004", nil, &CopyDone{}},
+		{"CopyFail", "660000001461626f72746564206279207573657200", nil, &CopyFail{Message: "aborted by user"}},
+		{"Describe", "440000000853733100", nil, &Describe{ObjectType: ObjectStatement, Name: "s1"}},
+		{"Execute", "450000000b70310000000064", nil, &Execute{Portal: "p1", MaxRows: 100}},
+		{"Flush", "4800000004", nil, &Flush{}},
+		{"FunctionCall", "46000000180000063e00010001000100000004000000070001", nil,
+			&FunctionCall{Function: 1598, ArgumentFormats: []Format{BinaryFormat}, Arguments: [][]byte{{0, 0, 0, 7}}, ResultFormat: BinaryFormat}},
+		{"Parse", "500000001f73310053454c4543542024312c2024320000020000001700000000", nil,
+			&Parse{Name: "s1", Query: "SELECT $1, $2", ParameterOIDs: []uint32{23, 0}}},
+		{"PasswordMessage", "70000000286d6435613335353635373165393362306432303732326261363262653631653863326400", nil,
+			&PasswordMessage{Password: "md5a3556571e93b0d20722ba62be61e8c2d"}},
+		{"PasswordMessage_Cleartext", "70000000077077" + "00", &AuthenticationCleartextPassword{}, &PasswordMessage{Password: "pw"}},
+		{"PasswordMessage_MD5", "70000000077077" + "00", &AuthenticationMD5Password{}, &PasswordMessage{Password: "pw"}},
+		{"SASLInitialResponse", "7000000028534352414d2d5348412d32353600000000126e2c2c6e3d2c723d724f70724e4766774562", &AuthenticationSASL{},
+			&SASLInitialResponse{Mechanism: "SCRAM-SHA-256", Data: []byte("n,,n=,r=rOprNGfwEb")}},
+		{"SASLInitialResponse_Without_Data", "7000000016534352414d2d5348412d32353600ffffffff", &AuthenticationSASL{},
+			&SASLInitialResponse{Mechanism: "SCRAM-SHA-256"}},
+		{"SASLResponse", "7000000016633d626977732c723d6162632c703d78797a", &AuthenticationSASLContinue{},
+			&SASLResponse{Data: []byte("c=biws,r=abc,p=xyz")}},
+		{"GSSResponse", "7000000007608201", &AuthenticationGSS{}, &GSSResponse{Data: []byte{0x60, 0x82, 0x01}}},
+		{"GSSResponse_Continue", "7000000007608201", &AuthenticationGSSContinue{}, &GSSResponse{Data: []byte{0x60, 0x82, 0x01}}},
+		{"GSSResponse_SSPI", "7000000007608201", &AuthenticationSSPI{}, &GSSResponse{Data: []byte{0x60, 0x82, 0x01}}},
+		{"Query", "510000001753454c45435420313b2053454c454354203200", nil, &Query{String: "SELECT 1; SELECT 2"}},
+		{"Sync", "5300000004", nil, &Sync{}},
+		{"Terminate", "5800000004", nil, &Terminate{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeFrontendStream(t, tt.stream, tt.auth)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Decode() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Decode_Frontend_Malformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		auth   BackendMessage
+	}{
+		{"StartupMessage_Missing_Value", "0000000a000300007500", nil},
+		{"CancelRequest_Short_Key", "0000000e04d2162e000030390102", nil},
+		{"Bind_Missing_Result_Formats", "420000000e70310073310000000000", nil},
+		{"Bind_Short_Result_Formats", "42000000127031007331000000000000020000", nil},
+		{"Close_Missing_Name", "430000000553", nil},
+		{"CopyFail_Unterminated", "66000000066162", nil},
+		{"Describe_Invalid_Object_Type", "440000000858733100", nil},
+		{"Execute_Missing_Row_Limit", "4500000007703100", nil},
+		{"FunctionCall_Missing_Result_Format", "460000000c0000063e00000000", nil},
+		{"Parse_Missing_OIDs", "500000000c0000000200000017", nil},
+		{"PasswordMessage_Unterminated", "70000000067077", nil},
+		{"SASLInitialResponse_Long_Data", "700000000c4d000000000a6162", &AuthenticationSASL{}},
+		{"Query_Trailing_Bytes", "51000000060000", nil},
+		{"Terminate_With_Body", "580000000500", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := decodeFrontendStream(t, tt.stream, tt.auth); !errors.Is(err, ErrMalformedMessage) {
+				t.Errorf("Decode() = %+v, %v, want %v", got, err, ErrMalformedMessage)
+			}
+		})
+	}
+}
+
+func Test_Decoder_ExpectResponseTo_Ignores_Other_Messages(t *testing.T) {
+	d := NewTypedDecoder(bytes.NewReader((&SASLResponse{Data: []byte("r")}).Encode(nil)), ServerSide)
+	d.ExpectResponseTo(&AuthenticationSASLContinue{})
+	d.ExpectResponseTo(&ParameterStatus{Name: "a", Value: "b"})
+	if m, err := d.Decode(); err != nil || !reflect.DeepEqual(m, &SASLResponse{Data: []byte("r")}) {
+		t.Errorf("Decode() = %+v, %v, want SASLResponse", m, err)
+	}
+}
@@ -0,0 +1,102 @@
+//go:build go1.18
+// +build go1.18
+
+package pgwire
+
+import (
+	"bytes"
+	"testing"
+)
+
+// fuzzAuthentication are the Authentication messages the fuzzed Decoder on ServerSide expects a response to.
+var fuzzAuthentication = []BackendMessage{
+	&AuthenticationCleartextPassword{},
+	&AuthenticationGSS{},
+	&AuthenticationSASL{},
+	&AuthenticationSASLContinue{},
+}
+
+func encodeAll(msgs ...Message) []byte {
+	var stream []byte
+	for _, m := range msgs {
+		stream = m.Encode(stream)
+	}
+	return stream
+}
+
+// Fuzz_Decoder checks that Decoder doesn't panic on any stream and that each message
+// it decodes is encoded the same way after it's decoded back from its encoding.
+// Decoded messages aren't compared, since Encode fills some of the omitted fields.
+func Fuzz_Decoder(f *testing.F) {
+	f.Add(encodeAll(
+		&SSLRequest{},
+		&StartupMessage{ProtocolVersion: ProtocolVersion30, Parameters: map[string]string{"user": "u", "database": "d"}},
+		&PasswordMessage{Password: "secret"},
+		&Query{String: "SELECT 1"},
+		&Parse{Name: "s", Query: "SELECT $1", ParameterOIDs: []uint32{23}},
+		&Bind{Statement: "s", ParameterFormats: []Format{BinaryFormat}, Parameters: [][]byte{{0, 0, 0, 1}, nil}, ResultFormats: []Format{TextFormat}},
+		&Describe{ObjectType: ObjectPortal},
+		&Execute{MaxRows: 10},
+		&FunctionCall{Function: 1, Arguments: [][]byte{{1}}},
+		&CopyData{Data: []byte("1\n")},
+		&CopyDone{},
+		&Sync{},
+		&Terminate{},
+	), true, true, uint8(0))
+	f.Add(encodeAll(&CancelRequest{ProcessID: 1, SecretKey: []byte{1, 2, 3, 4}}), true, true, uint8(0))
+	f.Add(encodeAll(
+		&SASLInitialResponse{Mechanism: "SCRAM-SHA-256", Data: []byte("n,,n=,r=abc")},
+	), true, false, uint8(2))
+	f.Add(encodeAll(
+		&EncryptionResponse{Response: 'N'},
+		&AuthenticationSASL{Mechanisms: []string{"SCRAM-SHA-256"}},
+		&AuthenticationSASLContinue{Data: []byte("r=abc")},
+		&AuthenticationOk{},
+		&ParameterStatus{Name: "TimeZone", Value: "UTC"},
+		&BackendKeyData{ProcessID: 1, SecretKey: []byte{1, 2, 3, 4}},
+		&ReadyForQuery{TxStatus: TxIdle},
+		&RowDescription{Fields: []FieldDescription{{Name: "a", DataTypeOID: 23, DataTypeSize: 4, TypeModifier: -1}}},
+		&DataRow{Values: [][]byte{[]byte("1"), nil}},
+		&CommandComplete{Tag: "SELECT 1"},
+		&CopyInResponse{Format: TextFormat, ColumnFormats: []Format{TextFormat}},
+		&ErrorResponse{Severity: "ERROR", Code: "42601", Message: "m", Position: 1},
+		&NoticeResponse{Severity: "NOTICE", Message: "n"},
+		&NotificationResponse{ProcessID: 1, Channel: "c", Payload: "p"},
+	), false, true, uint8(0))
+	f.Fuzz(func(t *testing.T, stream []byte, serverSide, startup bool, auth uint8) {
+		side := ClientSide
+		if serverSide {
+			side = ServerSide
+		}
+		newDecoder := func(stream []byte, startup bool) *Decoder {
+			d := NewTypedDecoder(bytes.NewReader(stream), side)
+			if startup {
+				d = NewDecoder(bytes.NewReader(stream), side)
+			}
+			d.SetMaxMessageLen(1 << 16)
+			d.ExpectResponseTo(fuzzAuthentication[int(auth)%len(fuzzAuthentication)])
+			return d
+		}
+
+		d := newDecoder(stream, startup)
+		for d.err == nil {
+			m, err := d.Decode()
+			if err != nil {
+				continue
+			}
+			var untyped bool
+			switch m.(type) {
+			case *StartupMessage, *SSLRequest, *GSSENCRequest, *CancelRequest, *EncryptionResponse:
+				untyped = true
+			}
+			encoded := m.Encode(nil)
+			got, err := newDecoder(encoded, untyped).Decode()
+			if err != nil {
+				t.Fatalf("Decode() of encoded %+v error = %v", m, err)
+			}
+			if reencoded := got.Encode(nil); !bytes.Equal(reencoded, encoded) {
+				t.Fatalf("%+v is encoded as %x after decoding, want %x", got, reencoded, encoded)
+			}
+		}
+	})
+}
@@ -0,0 +1,111 @@
+// Package pgwire encodes and decodes messages of PostgreSQL frontend/backend protocol version 3.
+// Each message is a struct, its Encode method appends the message as it's sent on the wire
+// and Decode method decodes the body of the message. Decoder reads messages from a stream.
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+package pgwire
+
+import (
+	"encoding/binary"
+)
+
+// Message is a message of the protocol sent by frontend, backend or both.
+type Message interface {
+	// Encode appends the message to dst and returns the extended buffer.
+	Encode(dst []byte) []byte
+}
+
+// Protocol versions sent in StartupMessage. The most significant 16 bits are the major version number,
+// the least significant 16 bits are the minor version number.
+const (
+	ProtocolVersion30 uint32 = 3 << 16
+	ProtocolVersion32 uint32 = 3<<16 | 2
+)
+
+// Request codes of the untyped messages which take the place of the protocol version.
+const (
+	cancelRequestCode uint32 = 80877102
+	sslRequestCode    uint32 = 80877103
+	gssencRequestCode uint32 = 80877104
+)
+
+// Format is the format code of a parameter or a column value.
+type Format int16
+
+const (
+	TextFormat   Format = 0
+	BinaryFormat Format = 1
+)
+
+// Kinds of objects targeted by Close and Describe messages.
+const (
+	ObjectStatement byte = 'S'
+	ObjectPortal    byte = 'P'
+)
+
+// Transaction statuses reported by ReadyForQuery.
+const (
+	TxIdle          byte = 'I'
+	TxInTransaction byte = 'T'
+	TxFailed        byte = 'E'
+)
+
+// beginMessage appends the type byte and the placeholder of the length of a message to dst.
+// It returns the extended buffer and the position of the length to pass to finishMessage.
+func beginMessage(dst []byte, t byte) ([]byte, int) {
+	start := len(dst) + 1
+	return append(dst, t, 0, 0, 0, 0), start
+}
+
+// beginUntypedMessage appends the placeholder of the length of a message without the type byte.
+func beginUntypedMessage(dst []byte) ([]byte, int) {
+	start := len(dst)
+	return append(dst, 0, 0, 0, 0), start
+}
+
+// finishMessage writes the length of the message which starts at the position of its length.
+func finishMessage(dst []byte, start int) []byte {
+	binary.BigEndian.PutUint32(dst[start:], uint32(len(dst)-start))
+	return dst
+}
+
+// encodeEmpty appends a message which consists of the type byte and the length only.
+func encodeEmpty(dst []byte, t byte) []byte {
+	return append(dst, t, 0, 0, 0, 4)
+}
+
+func appendString(dst []byte, s string) []byte {
+	return append(append(dst, s...), 0)
+}
+
+func appendUint16(dst []byte, n uint16) []byte {
+	return append(dst, byte(n>>8), byte(n))
+}
+
+func appendUint32(dst []byte, n uint32) []byte {
+	return append(dst, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+// appendValue appends the length of the value followed by its bytes. The length of nil value is -1,
+// which stands for NULL.
+func appendValue(dst []byte, value []byte) []byte {
+	if value == nil {
+		return appendUint32(dst, 0xffffffff)
+	}
+	return append(appendUint32(dst, uint32(len(value))), value...)
+}
+
+func appendFormats(dst []byte, formats []Format) []byte {
+	dst = appendUint16(dst, uint16(len(formats)))
+	for _, f := range formats {
+		dst = appendUint16(dst, uint16(f))
+	}
+	return dst
+}
+
+func appendValues(dst []byte, values [][]byte) []byte {
+	dst = appendUint16(dst, uint16(len(values)))
+	for _, v := range values {
+		dst = appendValue(dst, v)
+	}
+	return dst
+}
@@ -0,0 +1,817 @@
+package postgresql
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/backstage-app/postgresql/pgwire"
+)
+
+// PoolMode tells how long a client keeps the target connection leased from the pool.
+type PoolMode string
+
+const (
+	// PoolSession leases the target connection for the whole client session.
+	PoolSession PoolMode = "session"
+	// PoolTransaction leases the target connection for a single transaction. The connection is reset
+	// with transactionResetQuery once the transaction ends, so session state, e.g. settings changed with SET,
+	// temporary tables or advisory locks, is lost between transactions. The statements the client prepares
+	// with Parse are kept though: they are renamed and prepared again on whichever connection the client gets.
+	// Statements stay prepared on the connections until a client session ends on them.
+	// The client gets BackendKeyData made up by Proxy, its CancelRequest is sent to the target
+	// with the key of the connection the client has leased at the moment, if any.
+	PoolTransaction PoolMode = "transaction"
+)
+
+// resetQuery is executed on the target connection the client session ends on.
+const resetQuery = "DISCARD ALL"
+
+// transactionResetQuery is executed on the target connection a transaction ends on in transaction mode.
+// It's DISCARD ALL except for DEALLOCATE ALL, which would drop the statements prepared by the clients.
+const transactionResetQuery = "CLOSE ALL; SET SESSION AUTHORIZATION DEFAULT; RESET ALL; UNLISTEN *; " +
+	"SELECT pg_advisory_unlock_all(); DISCARD PLANS; DISCARD TEMP; DISCARD SEQUENCES"
+
+// resetTimeout is how long the target connection may take to reset before it's closed instead.
+const resetTimeout = 5 * time.Second
+
+// errClientGone is returned by acquire if the client is closed while it waits for a target connection.
+var errClientGone = errors.New("postgresql: client closed while waiting for target connection")
+
+// targetRejection is the error of the login the target rejected with ErrorResponse.
+type targetRejection struct {
+	// msg is ErrorResponse of the target.
+	msg []byte
+	err error
+}
+
+func (e *targetRejection) Error() string {
+	return e.err.Error()
+}
+
+func (e *targetRejection) Unwrap() error {
+	return e.err
+}
+
+// poolKey identifies target connections which are interchangeable.
+type poolKey struct {
+	target   string
+	user     string
+	database string
+}
+
+// pool keeps authenticated target connections per poolKey.
+type pool struct {
+	proxy *Proxy
+	size  int
+
+	mu      sync.Mutex
+	entries map[poolKey]*poolEntry
+	// seq numbers Parse messages, so that statements prepared by different clients never share names.
+	seq uint64
+	// clients are the clients in transaction mode by the process ID of BackendKeyData they got.
+	clients map[uint32]*pooledConn
+}
+
+type poolEntry struct {
+	// slots limits the number of connections, each open connection holds a slot.
+	slots chan struct{}
+	// idle are the connections which aren't leased to any client.
+	idle chan *serverConn
+}
+
+// serverConn is an authenticated target connection kept by pool.
+type serverConn struct {
+	net.Conn
+	key poolKey
+	// parameters are ParameterStatus messages the target sent after authentication.
+	parameters []byte
+	// keyData is BackendKeyData message the target sent after authentication.
+	keyData []byte
+	// statements map names of statements prepared on the connection to the sequence numbers of their Parse.
+	statements map[string]uint64
+}
+
+func newPool(p *Proxy, size int) *pool {
+	return &pool{proxy: p, size: size, entries: make(map[poolKey]*poolEntry), clients: make(map[uint32]*pooledConn)}
+}
+
+func (p *pool) entry(key poolKey) *poolEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[key]
+	if !ok {
+		e = &poolEntry{slots: make(chan struct{}, p.size), idle: make(chan *serverConn, p.size)}
+		p.entries[key] = e
+	}
+	return e
+}
+
+func (p *pool) nextSeq() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.seq++
+	return p.seq
+}
+
+// register makes the client in transaction mode reachable by CancelRequest with the process ID pid.
+func (p *pool) register(pid uint32, c *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clients[pid] = c
+}
+
+// unregister forgets the client once it's gone.
+func (p *pool) unregister(c *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pid := c.conn.session.snapshot().ConnID
+	if p.clients[pid] == c {
+		delete(p.clients, pid)
+	}
+}
+
+// redirectCancel reads CancelRequest of conn. If it carries BackendKeyData of a client in transaction mode,
+// the key is replaced by the one of the connection the client has leased and the target of that connection
+// is returned. Otherwise CancelRequest is passed on as is to target: the target ignores a key it doesn't know,
+// as it does for a client which has no connection leased and thus nothing to cancel.
+func (p *pool) redirectCancel(conn *proxyConn, target string) string {
+	client := conn.client
+	msg, err := readStartupMessage(client)
+	if err != nil {
+		// The request is broken, the target gets the rest of it, if any, and drops the connection.
+		msg = nil
+	} else if request, err := decodeCancelRequestMessage(msg); err == nil {
+		if server := p.leased(request); server != nil {
+			if keyData, err := decodeBackendKeyDataMessage(server.keyData); err == nil {
+				msg = (&pgwire.CancelRequest{ProcessID: keyData.pid, SecretKey: keyData.secret}).Encode(nil)
+				target = server.key.target
+			}
+		}
+	}
+	conn.setClient(&readerConn{Conn: client, r: io.MultiReader(bytes.NewReader(msg), client)})
+	return target
+}
+
+// leased returns the connection leased by the client in transaction mode CancelRequest request is meant for.
+func (p *pool) leased(request *cancelRequestMessage) *serverConn {
+	p.mu.Lock()
+	c := p.clients[request.pid]
+	p.mu.Unlock()
+	if c == nil || subtle.ConstantTimeCompare(c.secret, request.secret) != 1 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.server
+}
+
+// acquire leases an idle connection or opens a new one if there is a free slot.
+// Otherwise it waits until another client releases a connection or done is closed.
+func (p *pool) acquire(key poolKey, password string, done <-chan struct{}) (*serverConn, error) {
+	e := p.entry(key)
+	select {
+	case s := <-e.idle:
+		return s, nil
+	default:
+	}
+
+	select {
+	case s := <-e.idle:
+		return s, nil
+	case e.slots <- struct{}{}:
+		s, err := p.open(key, password)
+		if err != nil {
+			<-e.slots
+			return nil, err
+		}
+		return s, nil
+	case <-done:
+		return nil, errClientGone
+	}
+}
+
+// release returns the connection to the pool or closes it if it can't be reused.
+func (p *pool) release(s *serverConn, reuse bool) {
+	e := p.entry(s.key)
+	if !reuse {
+		_ = s.Close()
+		<-e.slots
+		return
+	}
+	e.idle <- s
+}
+
+// close closes all idle connections.
+func (p *pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range p.entries {
+		for {
+			select {
+			case s := <-e.idle:
+				_ = s.Close()
+				<-e.slots
+				continue
+			default:
+			}
+			break
+		}
+	}
+}
+
+// open connects to the target and logs in, then waits for the target to get ready for queries.
+func (p *pool) open(key poolKey, password string) (*serverConn, error) {
+	conn, err := p.proxy.dialTarget(key.target)
+	if err != nil {
+		return nil, err
+	}
+	s := &serverConn{Conn: conn, key: key, statements: make(map[string]uint64)}
+
+	params := map[string]string{"user": key.user, "database": key.database}
+	if rejection, err := loginTarget(conn, params, password); err != nil {
+		_ = conn.Close()
+		if rejection != nil {
+			err = &targetRejection{msg: rejection, err: err}
+		}
+		return nil, fmt.Errorf("postgresql.pool.open: %w", err)
+	}
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("postgresql.pool.open: %w", err)
+		}
+		switch {
+		case isParameterStatusMessage(msg):
+			s.parameters = append(s.parameters, msg...)
+		case isBackendKeyDataMessage(msg):
+			s.keyData = msg
+		case isErrorMessage(msg):
+			_ = conn.Close()
+			return nil, fmt.Errorf("postgresql.pool.open: %w", decodeErrorMessage(msg).fields)
+		case isReadyForQueryMessage(msg):
+			return s, nil
+		}
+	}
+}
+
+// reset executes query on the idle connection and waits for the connection to get ready for queries.
+// It returns an error if query fails or the connection doesn't respond within resetTimeout.
+func (s *serverConn) reset(query string) error {
+	_ = s.SetDeadline(time.Now().Add(resetTimeout))
+	if _, err := s.Write(encodeMessage(queryMessageType, append([]byte(query), 0x00))); err != nil {
+		return err
+	}
+	var failed error
+	for {
+		msg, err := readMessage(s)
+		if err != nil {
+			return err
+		}
+		switch {
+		case isErrorMessage(msg):
+			failed = decodeErrorMessage(msg).fields
+		case isReadyForQueryMessage(msg):
+			if failed == nil && msg[minPacketLen] != 'I' {
+				failed = errors.New("postgresql: connection isn't idle after reset")
+			}
+			return failed
+		}
+	}
+}
+
+// clientStatement is a statement the client prepared with Parse.
+type clientStatement struct {
+	// name is the name of the statement on target connections.
+	name string
+	seq  uint64
+	// parse is Parse message which prepares the statement on target connections under name.
+	parse []byte
+}
+
+// pendingParseComplete is Parse sent to the target connection which ParseComplete is awaited for.
+type pendingParseComplete struct {
+	name string
+	seq  uint64
+	// batch is the number of the Sync or Query the Parse precedes.
+	batch uint64
+	// injected is true if the client didn't send the Parse, so ParseComplete isn't passed to it.
+	injected bool
+}
+
+// pooledConn serves a client with target connections leased from the pool.
+// Frontend messages are forwarded one by one, so that the target connection can be acquired
+// when a transaction starts and released once ReadyForQuery reports it's over.
+type pooledConn struct {
+	proxy     *Proxy
+	conn      *proxyConn
+	key       poolKey
+	password  string
+	requests  *collector
+	responses *collector
+	queue     *responseQueue
+	// guard is set if Proxy has Firewall.
+	guard   *guard
+	chain   *interceptorChain
+	readers sync.WaitGroup
+
+	mu     sync.Mutex
+	server *serverConn
+	// outstanding is the number of Query and Sync messages the server hasn't answered with ReadyForQuery yet.
+	outstanding int
+	// unsynced is true if the messages sent after the last Sync or Query aren't followed by Sync yet.
+	unsynced bool
+	status   byte
+	// sent and completed count Query and Sync messages sent and answered with ReadyForQuery.
+	sent, completed uint64
+	parses          []pendingParseComplete
+	statements      map[string]*clientStatement
+	// closing is true once the client is gone and the server is being reset.
+	closing bool
+	// released is closed once the responses of the connection released last are written to the client.
+	released chan struct{}
+	// secret is the secret key of BackendKeyData the client got in transaction mode.
+	secret []byte
+}
+
+// servePooled serves the authenticated client with connections from the pool.
+// It fills the byte counts and the error of closed.
+func (p *Proxy) servePooled(conn *proxyConn, auth *authentication, target string, closed *ConnectionClosed) {
+	user := auth.credentials.TargetUser
+	if user == "" {
+		user = auth.startup.params["user"]
+	}
+	database := auth.startup.params["database"]
+	if database == "" {
+		database = auth.startup.params["user"]
+	}
+
+	c := &pooledConn{
+		proxy:      p,
+		conn:       conn,
+		key:        poolKey{target: target, user: user, database: database},
+		password:   auth.credentials.TargetPassword,
+		requests:   newCollector(conn.session, originFrontend, false),
+		responses:  newCollector(conn.session, originBackend, false),
+		status:     'I',
+		statements: make(map[string]*clientStatement),
+	}
+	c.queue = newResponseQueue(conn.client, c.responses)
+	if p.firewall != nil {
+		c.guard = &guard{firewall: p.firewall, session: conn.session}
+	}
+	c.chain = newInterceptorChain(p.interceptors, conn.session)
+	defer c.requests.close()
+	defer c.responses.close()
+	defer p.pool.unregister(c)
+
+	server, err := c.acquire()
+	if err != nil {
+		var rejection *targetRejection
+		if errors.As(err, &rejection) {
+			p.rejectClient(conn, auth.method, rejection.msg)
+		} else {
+			_, _ = conn.client.Write(encodeErrorResponse("FATAL", "08006", "could not connect to the target"))
+		}
+		conn.close(CloseByDialFailure)
+		closed.Err = err
+		return
+	}
+	conn.session.backend([]interface{}{&authenticationMessage{code: auth.method}})
+	if err := c.startup(server); err != nil {
+		p.pool.release(server, false)
+		conn.close(CloseByClient)
+		closed.Err = err
+		return
+	}
+
+	closed.BytesFromClient, closed.Err = c.serve()
+	conn.close(CloseByClient)
+	c.finish()
+	c.readers.Wait()
+
+	closed.BytesFromServer = c.queue.written()
+	if closed.Err != nil && (isClosedConnError(closed.Err) || errors.Is(closed.Err, errClientGone)) {
+		closed.Err = nil
+	}
+}
+
+// acquire leases a target connection and reports if the target can't be connected to.
+func (c *pooledConn) acquire() (*serverConn, error) {
+	server, err := c.proxy.pool.acquire(c.key, c.password, c.conn.done)
+	var rejection *targetRejection
+	if err != nil && !errors.Is(err, errClientGone) && !errors.As(err, &rejection) {
+		log.Print(err)
+		c.proxy.events.WriteEvent(&DialFailed{Session: c.conn.session.snapshot(), Time: c.proxy.now(), Target: c.key.target, Err: err})
+	}
+	return server, err
+}
+
+// startup completes the startup phase of the client as if it was connected to server directly.
+// In transaction mode the client gets BackendKeyData of its own, since its queries run on different
+// connections. Its CancelRequest is redirected by pool.redirectCancel.
+func (c *pooledConn) startup(server *serverConn) error {
+	keyData := server.keyData
+	if c.proxy.poolMode == PoolTransaction {
+		c.secret = make([]byte, 4)
+		if _, err := rand.Read(c.secret); err != nil {
+			return err
+		}
+		pid := c.conn.session.snapshot().ConnID
+		body := make([]byte, 4, 8)
+		binary.BigEndian.PutUint32(body, pid)
+		keyData = encodeMessage(backendKeyDataMessageType, append(body, c.secret...))
+		c.proxy.pool.register(pid, c)
+	}
+
+	var msg []byte
+	msg = append(msg, encodeAuthentication(authenticationOk, nil)...)
+	msg = append(msg, server.parameters...)
+	msg = append(msg, keyData...)
+	msg = append(msg, encodeMessage(readyForQueryMessageType, []byte{'I'})...)
+	if err := c.queue.raw(msg); err != nil {
+		return err
+	}
+
+	if c.proxy.poolMode == PoolTransaction {
+		c.proxy.pool.release(server, true)
+		return nil
+	}
+	c.lease(server)
+	return nil
+}
+
+// lease makes server the connection of the client and starts reading it.
+// It must be called with c.mu held or before the client is served.
+func (c *pooledConn) lease(server *serverConn) {
+	c.server = server
+	c.readers.Add(1)
+	go func() {
+		defer c.readers.Done()
+		c.read(server)
+	}()
+}
+
+// serve forwards messages from the client until it's closed. It returns the number of bytes read
+// from the client and the error which stopped it.
+func (c *pooledConn) serve() (int64, error) {
+	f := newFramer(originFrontend, false, c.proxy.maxMessageLen)
+	defer f.close()
+
+	var n int64
+	buf := make([]byte, 32*1024)
+	for {
+		read, err := c.conn.client.Read(buf)
+		n += int64(read)
+		var forwardErr error
+		f.write(buf[:read], func(msg []byte) {
+			if forwardErr == nil {
+				forwardErr = c.forward(msg)
+			}
+		})
+		if forwardErr != nil {
+			if forwardErr == errTerminated {
+				return n, nil
+			}
+			return n, forwardErr
+		}
+		if f.err != nil {
+			c.conn.session.protocolError(true, f.err)
+			return n, f.err
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// errTerminated is returned by forward if the client sent Terminate.
+var errTerminated = errors.New("postgresql: client terminated")
+
+// forward runs a single message of the client through the interceptors and sends the result to the target.
+func (c *pooledConn) forward(msg []byte) error {
+	if msg[0] == terminateMessageType {
+		return errTerminated
+	}
+	_, _ = c.requests.Write(msg)
+	if c.chain == nil {
+		return c.send(msg)
+	}
+
+	toServer, toClient := c.chain.frontend(msg, true, nil, nil)
+	if len(toClient) > 0 {
+		if err := c.queue.add(&syntheticResponse{data: toClient}, false); err != nil {
+			return err
+		}
+	}
+	var err error
+	forEachMessage(toServer, func(msg []byte) {
+		if err == nil {
+			err = c.send(msg)
+		}
+	})
+	return err
+}
+
+// send passes a single message to the target connection of the client, which is acquired
+// if the client doesn't have one, unless Firewall blocks the message.
+func (c *pooledConn) send(msg []byte) error {
+	if c.guard != nil {
+		pass, response, beforeNext := c.guard.check(msg)
+		if !pass {
+			if response == nil {
+				return nil
+			}
+			return c.queue.add(response, beforeNext)
+		}
+	}
+
+	c.mu.Lock()
+	if c.server == nil {
+		released := c.released
+		c.mu.Unlock()
+		// The client gets the responses of the previous connection first.
+		if released != nil {
+			<-released
+		}
+		server, err := c.acquire()
+		if err != nil {
+			_ = c.queue.raw(encodeErrorResponse("FATAL", "08006", "could not connect to the target"))
+			return err
+		}
+		c.mu.Lock()
+		c.lease(server)
+	}
+	server := c.server
+	out := msg
+	if c.proxy.poolMode == PoolTransaction {
+		out = c.rewrite(msg)
+	}
+	switch msg[0] {
+	case queryMessageType, syncMessageType:
+		c.outstanding++
+		c.sent++
+		c.unsynced = false
+		c.queue.sync()
+	case parseMessageType, bindMessageType, describeMessageType, executeMessageType, closeMessageType, flushMessageType:
+		c.unsynced = true
+	}
+	c.mu.Unlock()
+
+	// The server isn't released while it has outstanding messages, so it's written without holding the lock,
+	// which would block reading responses the server may be blocked on.
+	_, err := server.Write(out)
+	return err
+}
+
+// rewrite renames the statements msg refers to, so that statements of different clients
+// don't clash on the same target connection, and prepares them on the current target connection
+// if they were prepared on another one. It must be called with c.mu held.
+func (c *pooledConn) rewrite(msg []byte) []byte {
+	if msg[0] == queryMessageType {
+		// Query message destroys the unnamed statement.
+		delete(c.server.statements, "")
+		return msg
+	}
+	start, end, ok := statementNameRange(msg)
+	if !ok {
+		return msg
+	}
+	name := string(msg[start:end])
+
+	if msg[0] == parseMessageType {
+		seq := c.proxy.pool.nextSeq()
+		s := &clientStatement{seq: seq}
+		if name != "" {
+			s.name = fmt.Sprintf("proxy_%d", seq)
+		}
+		s.parse = renameStatement(msg, start, end, s.name)
+		c.statements[name] = s
+		c.server.statements[s.name] = seq
+		c.parses = append(c.parses, pendingParseComplete{name: s.name, seq: seq, batch: c.sent + 1})
+		return s.parse
+	}
+
+	s, ok := c.statements[name]
+	if !ok {
+		// The target reports the statement doesn't exist.
+		return msg
+	}
+	renamed := renameStatement(msg, start, end, s.name)
+	if msg[0] == closeMessageType {
+		delete(c.statements, name)
+		if c.server.statements[s.name] == s.seq {
+			delete(c.server.statements, s.name)
+		}
+		return renamed
+	}
+	if c.server.statements[s.name] == s.seq {
+		return renamed
+	}
+	c.server.statements[s.name] = s.seq
+	c.parses = append(c.parses, pendingParseComplete{name: s.name, seq: s.seq, batch: c.sent + 1, injected: true})
+	return append(append([]byte(nil), s.parse...), renamed...)
+}
+
+// read forwards messages of server to the client until the server is released.
+func (c *pooledConn) read(server *serverConn) {
+	f := newFramer(originBackend, false, c.proxy.maxMessageLen)
+	defer f.close()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := server.Read(buf)
+		var out, intercepted, toServer []byte
+		var readies []readyMark
+		released, reset, extra := false, false, false
+		f.write(buf[:n], func(msg []byte) {
+			if released {
+				extra = true
+				return
+			}
+			// Messages the interceptors send to the target are accounted before the response
+			// decides whether the connection is released.
+			intercepted, toServer = c.chain.backend(msg, intercepted[:0], toServer[:0])
+			if len(toServer) > 0 {
+				c.inject(server, toServer)
+			}
+			var keep bool
+			keep, released, reset = c.response(server, msg)
+			if !keep {
+				return
+			}
+			start := len(out)
+			out = append(out, intercepted...)
+			if isReadyForQueryMessage(msg) {
+				readies = append(readies, readyMark{start: start, end: len(out), status: msg[minPacketLen]})
+			}
+		})
+		_ = c.queue.forward(out, readies)
+
+		if released {
+			c.mu.Lock()
+			if c.released != nil {
+				close(c.released)
+				c.released = nil
+			}
+			c.mu.Unlock()
+			if reset {
+				server.statements = make(map[string]uint64)
+			}
+			reuse := !extra && f.tail == nil && f.err == nil
+			if reuse && !reset {
+				// The transaction ended, but the session state it changed stays with the connection.
+				reuse = server.reset(transactionResetQuery) == nil
+			}
+			_ = server.SetDeadline(time.Time{})
+			c.proxy.pool.release(server, reuse)
+			return
+		}
+		if err != nil || f.err != nil {
+			c.mu.Lock()
+			if c.server == server {
+				c.server = nil
+			}
+			closing := c.closing
+			c.mu.Unlock()
+			if !closing {
+				c.conn.close(CloseByServer)
+			}
+			c.proxy.pool.release(server, false)
+			return
+		}
+	}
+}
+
+// inject sends the messages an interceptor produced from a response of server to it.
+// Unlike the messages of the client, their statements aren't renamed.
+func (c *pooledConn) inject(server *serverConn, msgs []byte) {
+	c.mu.Lock()
+	if c.server != server {
+		c.mu.Unlock()
+		return
+	}
+	forEachMessage(msgs, func(msg []byte) {
+		switch msg[0] {
+		case queryMessageType, syncMessageType:
+			c.outstanding++
+			c.sent++
+			c.unsynced = false
+			c.queue.sync()
+		case parseMessageType, bindMessageType, describeMessageType, executeMessageType, closeMessageType, flushMessageType:
+			c.unsynced = true
+		}
+	})
+	c.mu.Unlock()
+	_, _ = server.Write(msgs)
+}
+
+// response handles a single message of server. It returns whether the message is passed to the client,
+// whether server must be released and whether it was reset before that.
+func (c *pooledConn) response(server *serverConn, msg []byte) (keep, release, reset bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Responses which arrive once the client is gone are dropped.
+	keep = !c.closing
+	switch {
+	case isParseCompleteMessage(msg):
+		if len(c.parses) > 0 {
+			keep = keep && !c.parses[0].injected
+			c.parses = c.parses[1:]
+		}
+	case isReadyForQueryMessage(msg):
+		c.completed++
+		c.outstanding--
+		c.status = msg[5]
+		// Backend skips Parse messages of the failed batch, so they didn't prepare anything.
+		for len(c.parses) > 0 && c.parses[0].batch <= c.completed {
+			if server.statements[c.parses[0].name] == c.parses[0].seq {
+				delete(server.statements, c.parses[0].name)
+			}
+			c.parses = c.parses[1:]
+		}
+		if c.closing && c.outstanding == 0 {
+			return false, true, true
+		}
+		if c.proxy.poolMode == PoolTransaction && c.outstanding == 0 && !c.unsynced && c.status == 'I' {
+			c.server = nil
+			c.released = make(chan struct{})
+			return true, true, false
+		}
+	}
+	return keep, false, false
+}
+
+// finish releases the target connection once the client is gone. The connection is reset
+// and returned to the pool if it's idle, otherwise it's closed.
+func (c *pooledConn) finish() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	server := c.server
+	if server == nil {
+		return
+	}
+	c.server = nil
+	if c.outstanding > 0 || c.unsynced || c.status != 'I' {
+		// Closing makes the reader release the connection without reusing it.
+		c.closing = true
+		_ = server.Close()
+		return
+	}
+
+	c.closing = true
+	c.outstanding++
+	_ = server.SetDeadline(time.Now().Add(resetTimeout))
+	if _, err := server.Write(encodeMessage(queryMessageType, append([]byte(resetQuery), 0x00))); err != nil {
+		_ = server.Close()
+	}
+}
+
+// statementNameRange returns the bounds of the name of the prepared statement msg refers to.
+// ok is false if msg doesn't refer to a prepared statement.
+func statementNameRange(msg []byte) (start, end int, ok bool) {
+	switch msg[0] {
+	case parseMessageType:
+		start = minPacketLen
+	case bindMessageType:
+		// The statement name follows the portal name.
+		i := bytes.IndexByte(msg[minPacketLen:], 0x00)
+		if i < 0 {
+			return 0, 0, false
+		}
+		start = minPacketLen + i + 1
+	case describeMessageType, closeMessageType:
+		if len(msg) <= minPacketLen || msg[minPacketLen] != targetStatement {
+			return 0, 0, false
+		}
+		start = minPacketLen + 1
+	default:
+		return 0, 0, false
+	}
+	i := bytes.IndexByte(msg[start:], 0x00)
+	if i < 0 {
+		return 0, 0, false
+	}
+	return start, start + i, true
+}
+
+// renameStatement returns a copy of msg with the statement name between start and end replaced with name.
+func renameStatement(msg []byte, start, end int, name string) []byte {
+	renamed := make([]byte, 0, len(msg)-(end-start)+len(name))
+	renamed = append(renamed, msg[:start]...)
+	renamed = append(renamed, name...)
+	renamed = append(renamed, msg[end:]...)
+	binary.BigEndian.PutUint32(renamed[1:minPacketLen], uint32(len(renamed)-1))
+	return renamed
+}
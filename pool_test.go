@@ -0,0 +1,486 @@
+package postgresql
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/backstage-app/postgresql/pgwire"
+)
+
+// testPoolBackend is a backend which executes simple queries and statements prepared with Parse,
+// failing Bind of statements which weren't prepared on the same connection. Settings changed
+// with SET name TO value are shown by SHOW name until the connection is reset.
+type testPoolBackend struct {
+	net.Listener
+
+	mu      sync.Mutex
+	conns   int
+	queries []string
+	parses  []string
+	// resets is the number of transactionResetQuery executed, which isn't recorded in queries.
+	resets int
+	// cancels are CancelRequest messages the backend got.
+	cancels []*cancelRequestMessage
+}
+
+func startTestPoolBackend(t *testing.T) *testPoolBackend {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testPoolBackend{Listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.conns++
+			pid := uint32(1000 + b.conns)
+			b.mu.Unlock()
+			go b.serve(conn, pid)
+		}
+	}()
+	t.Cleanup(func() { _ = l.Close() })
+	return b
+}
+
+func (b *testPoolBackend) serve(conn net.Conn, pid uint32) {
+	defer conn.Close()
+	startup, err := readStartupMessage(conn)
+	if err != nil {
+		return
+	}
+	if request, err := decodeCancelRequestMessage(startup); err == nil {
+		b.mu.Lock()
+		b.cancels = append(b.cancels, request)
+		b.mu.Unlock()
+		return
+	}
+	keyData := make([]byte, 8)
+	binary.BigEndian.PutUint32(keyData, pid)
+	var out []byte
+	out = append(out, encodeAuthentication(authenticationOk, nil)...)
+	out = append(out, encodeMessage(parameterStatusMessageType, []byte("server_version\x0016\x00"))...)
+	out = append(out, encodeMessage(backendKeyDataMessageType, keyData)...)
+	out = append(out, encodeMessage(readyForQueryMessageType, []byte{'I'})...)
+	_, _ = conn.Write(out)
+
+	statements := make(map[string]bool)
+	settings := make(map[string]string)
+	status, failed := byte('I'), false
+	for {
+		msg, err := readMessage(conn)
+		if err != nil || msg[0] == terminateMessageType {
+			return
+		}
+		if failed && msg[0] != syncMessageType {
+			continue
+		}
+		body := msg[minPacketLen:]
+		var response []byte
+		switch msg[0] {
+		case queryMessageType:
+			query := strings.TrimSuffix(string(body), "\x00")
+			b.mu.Lock()
+			if query == transactionResetQuery {
+				b.resets++
+			} else {
+				b.queries = append(b.queries, query)
+			}
+			b.mu.Unlock()
+			words := strings.Fields(query)
+			switch {
+			case query == "BEGIN":
+				status = 'T'
+			case query == "COMMIT" || query == "DISCARD ALL" || query == transactionResetQuery:
+				status = 'I'
+				settings = make(map[string]string)
+			case len(words) == 4 && words[0] == "SET" && words[2] == "TO":
+				settings[words[1]] = words[3]
+			case len(words) == 2 && words[0] == "SHOW":
+				value := settings[words[1]]
+				if value == "" {
+					value = "default"
+				}
+				row := []byte{0, 1, 0, 0, 0, byte(len(value))}
+				response = encodeMessage(dataRowMessageType, append(row, value...))
+			}
+			response = append(response, encodeMessage(commandCompleteMessageType, []byte(query+"\x00"))...)
+			response = append(response, encodeMessage(readyForQueryMessageType, []byte{status})...)
+		case parseMessageType:
+			name := string(body[:strings.IndexByte(string(body), 0)])
+			statements[name] = true
+			b.mu.Lock()
+			b.parses = append(b.parses, name)
+			b.mu.Unlock()
+			response = encodeMessage(parseCompleteMessageType, nil)
+		case bindMessageType:
+			portalEnd := strings.IndexByte(string(body), 0)
+			statement := body[portalEnd+1:]
+			name := string(statement[:strings.IndexByte(string(statement), 0)])
+			if !statements[name] {
+				failed = true
+				response = encodeErrorResponse("ERROR", "26000", "prepared statement does not exist")
+				break
+			}
+			response = encodeMessage(bindCompleteMessageType, nil)
+		case executeMessageType:
+			response = encodeMessage(commandCompleteMessageType, []byte("SELECT 1\x00"))
+		case syncMessageType:
+			failed = false
+			response = encodeMessage(readyForQueryMessageType, []byte{status})
+		}
+		if _, err := conn.Write(response); err != nil {
+			return
+		}
+	}
+}
+
+// waitCancel waits for CancelRequest and returns it.
+func (b *testPoolBackend) waitCancel(t *testing.T) *cancelRequestMessage {
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		b.mu.Lock()
+		if len(b.cancels) > 0 {
+			defer b.mu.Unlock()
+			return b.cancels[0]
+		}
+		b.mu.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatal("CancelRequest wasn't received")
+		}
+	}
+}
+
+func (b *testPoolBackend) resetCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.resets
+}
+
+func (b *testPoolBackend) stats() (conns int, queries, parses []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conns, append([]string(nil), b.queries...), append([]string(nil), b.parses...)
+}
+
+// startTestPoolProxy starts Proxy which pools connections to the backend in the mode.
+func startTestPoolProxy(t *testing.T, backend net.Listener, mode PoolMode, size int) (*Proxy, string) {
+	store := CredentialMap{"app": {Password: "secret", TargetUser: "db_user"}}
+	proxy := NewEventProxy(newEventRecorder()).To(backend.Addr().String()).
+		Authenticate(AuthPassword, store).
+		Pool(mode, size)
+	addr, _ := startTestProxy(t, proxy)
+	return proxy, addr
+}
+
+// connectPooledClient logs in to Proxy and returns the connection ready for queries
+// along with the process ID of BackendKeyData.
+func connectPooledClient(t *testing.T, addr string) (net.Conn, uint32) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	if _, err := conn.Write(encodeStartupMessage(map[string]string{"user": "app", "database": "d"})); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := readMessage(conn); err != nil || !isAuthenticationMessage(msg) {
+		t.Fatalf("password request expected, got %x, %v", msg, err)
+	}
+	if _, err := conn.Write(encodePasswordMessage("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	var pid uint32
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case isErrorMessage(msg):
+			t.Fatalf("login failed: %v", decodeErrorMessage(msg).fields)
+		case isBackendKeyDataMessage(msg):
+			pid = binary.BigEndian.Uint32(msg[minPacketLen:])
+		case isReadyForQueryMessage(msg):
+			return conn, pid
+		}
+	}
+}
+
+// waitTestPoolIdle waits until the pool of Proxy keeps n idle connections to the backend.
+// A connection is released only once it's reset after the transaction.
+func waitTestPoolIdle(t *testing.T, proxy *Proxy, backend net.Listener, n int) {
+	e := proxy.pool.entry(poolKey{target: backend.Addr().String(), user: "db_user", database: "d"})
+	for deadline := time.Now().Add(time.Second); len(e.idle) != n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle connections = %d, want %d", len(e.idle), n)
+		}
+	}
+}
+
+// exchangeTestMessages sends msgs and returns the types of the response messages up to ReadyForQuery,
+// which is followed by the transaction status.
+func exchangeTestMessages(t *testing.T, conn net.Conn, msgs ...[]byte) string {
+	for _, msg := range msgs {
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var types []byte
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, msg[0])
+		if isReadyForQueryMessage(msg) {
+			return string(append(types, msg[minPacketLen]))
+		}
+	}
+}
+
+func testQuery(query string) []byte {
+	return encodeMessage(queryMessageType, []byte(query+"\x00"))
+}
+
+func testParse(name, query string) []byte {
+	return encodeMessage(parseMessageType, []byte(name+"\x00"+query+"\x00\x00\x00"))
+}
+
+func testBind(name string) []byte {
+	return encodeMessage(bindMessageType, []byte("\x00"+name+"\x00\x00\x00\x00\x00\x00\x00"))
+}
+
+func testExecute() []byte {
+	return encodeMessage(executeMessageType, []byte("\x00\x00\x00\x00\x00"))
+}
+
+func testSync() []byte {
+	return encodeMessage(syncMessageType, nil)
+}
+
+func Test_Proxy_Pool_Invalid_Config(t *testing.T) {
+	tests := []struct {
+		name string
+		mode PoolMode
+		size int
+	}{
+		{name: "Zero_Size", mode: PoolTransaction, size: 0},
+		{name: "Negative_Size", mode: PoolSession, size: -1},
+		{name: "Unknown_Mode", mode: "statement", size: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			proxy := NewEventProxy(newEventRecorder()).To("127.0.0.1:5432").
+				Authenticate(AuthPassword, CredentialMap{"app": {Password: "secret"}}).Pool(tt.mode, tt.size)
+			if err := proxy.Serve(l); err == nil || err == ErrProxyClosed {
+				t.Errorf("Serve() = %v, want configuration error", err)
+			}
+		})
+	}
+}
+
+func Test_Proxy_Pool_Transaction_Shares_Connection(t *testing.T) {
+	backend := startTestPoolBackend(t)
+	proxy, addr := startTestPoolProxy(t, backend, PoolTransaction, 1)
+	defer proxy.Shutdown(context.Background())
+
+	a, pidA := connectPooledClient(t, addr)
+	b, pidB := connectPooledClient(t, addr)
+	if pidA == pidB || pidA >= 1000 {
+		t.Errorf("process IDs = %d, %d, want own IDs of the clients", pidA, pidB)
+	}
+	if got := exchangeTestMessages(t, a, testQuery("BEGIN")); got != "CZT" {
+		t.Fatalf("BEGIN = %s", got)
+	}
+
+	// The only connection is leased by a until its transaction ends.
+	answered := make(chan string, 1)
+	go func() {
+		answered <- exchangeTestMessages(t, b, testQuery("SELECT 1"))
+	}()
+	select {
+	case got := <-answered:
+		t.Fatalf("query answered during the transaction of another client: %s", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if got := exchangeTestMessages(t, a, testQuery("COMMIT")); got != "CZI" {
+		t.Fatalf("COMMIT = %s", got)
+	}
+	if got := <-answered; got != "CZI" {
+		t.Fatalf("SELECT 1 = %s", got)
+	}
+
+	conns, queries, _ := backend.stats()
+	if conns != 1 {
+		t.Errorf("backend connections = %d, want 1", conns)
+	}
+	if want := "BEGIN,COMMIT,SELECT 1"; strings.Join(queries, ",") != want {
+		t.Errorf("queries = %v, want %s", queries, want)
+	}
+}
+
+func Test_Proxy_Pool_Transaction_Prepared_Statements(t *testing.T) {
+	backend := startTestPoolBackend(t)
+	proxy, addr := startTestPoolProxy(t, backend, PoolTransaction, 2)
+	defer proxy.Shutdown(context.Background())
+
+	a, _ := connectPooledClient(t, addr)
+	b, _ := connectPooledClient(t, addr)
+	if got := exchangeTestMessages(t, a, testParse("s1", "SELECT 1"), testSync()); got != "1ZI" {
+		t.Fatalf("Parse = %s", got)
+	}
+	waitTestPoolIdle(t, proxy, backend, 1)
+	// b takes the connection s1 was prepared on, so a executes it on another one.
+	if got := exchangeTestMessages(t, b, testQuery("BEGIN")); got != "CZT" {
+		t.Fatalf("BEGIN = %s", got)
+	}
+	if got := exchangeTestMessages(t, a, testBind("s1"), testExecute(), testSync()); got != "2CZI" {
+		t.Errorf("Bind and Execute = %s, want 2CZI", got)
+	}
+	// The statement is already prepared on the connection now.
+	if got := exchangeTestMessages(t, a, testBind("s1"), testExecute(), testSync()); got != "2CZI" {
+		t.Errorf("second Bind and Execute = %s, want 2CZI", got)
+	}
+	if got := exchangeTestMessages(t, b, testQuery("COMMIT")); got != "CZI" {
+		t.Fatalf("COMMIT = %s", got)
+	}
+
+	conns, _, parses := backend.stats()
+	if conns != 2 {
+		t.Errorf("backend connections = %d, want 2", conns)
+	}
+	if len(parses) != 2 || parses[0] != parses[1] || !strings.HasPrefix(parses[0], "proxy_") {
+		t.Errorf("statements parsed = %v, want the same renamed statement on both connections", parses)
+	}
+}
+
+func Test_Proxy_Pool_Transaction_Resets_Session_State(t *testing.T) {
+	backend := startTestPoolBackend(t)
+	proxy, addr := startTestPoolProxy(t, backend, PoolTransaction, 1)
+	defer proxy.Shutdown(context.Background())
+
+	a, _ := connectPooledClient(t, addr)
+	b, _ := connectPooledClient(t, addr)
+	if got := exchangeTestMessages(t, a, testQuery("SET search_path TO a")); got != "CZI" {
+		t.Fatalf("SET = %s", got)
+	}
+	if _, err := b.Write(testQuery("SHOW search_path")); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := readMessage(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg[0] == dataRowMessageType {
+			if value := string(msg[minPacketLen+6:]); value != "default" {
+				t.Errorf("search_path = %s, want the default of a reset connection", value)
+			}
+		}
+		if isReadyForQueryMessage(msg) {
+			break
+		}
+	}
+
+	conns, _, _ := backend.stats()
+	if conns != 1 {
+		t.Errorf("backend connections = %d, want 1", conns)
+	}
+	if resets := backend.resetCount(); resets < 1 {
+		t.Errorf("resets = %d, want at least 1", resets)
+	}
+}
+
+func Test_Proxy_Pool_Session(t *testing.T) {
+	backend := startTestPoolBackend(t)
+	proxy, addr := startTestPoolProxy(t, backend, PoolSession, 1)
+	defer proxy.Shutdown(context.Background())
+
+	a, pid := connectPooledClient(t, addr)
+	if pid != 1001 {
+		t.Errorf("process ID = %d, want the one of the backend", pid)
+	}
+	if got := exchangeTestMessages(t, a, testQuery("SELECT 1")); got != "CZI" {
+		t.Fatalf("SELECT 1 = %s", got)
+	}
+
+	// The second client waits for the first one to finish its session.
+	connected := make(chan uint32, 1)
+	go func() {
+		_, pid := connectPooledClient(t, addr)
+		connected <- pid
+	}()
+	select {
+	case <-connected:
+		t.Fatal("client connected while the only connection is leased")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := a.Write(encodeMessage(terminateMessageType, nil)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pid := <-connected:
+		if pid != 1001 {
+			t.Errorf("process ID = %d, want the reused connection", pid)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client didn't get the released connection")
+	}
+
+	conns, queries, _ := backend.stats()
+	if conns != 1 {
+		t.Errorf("backend connections = %d, want 1", conns)
+	}
+	if want := "SELECT 1,DISCARD ALL"; strings.Join(queries, ",") != want {
+		t.Errorf("queries = %v, want %s", queries, want)
+	}
+}
+
+func Test_Proxy_Pool_Transaction_Cancel(t *testing.T) {
+	backend := startTestPoolBackend(t)
+	proxy, addr := startTestPoolProxy(t, backend, PoolTransaction, 1)
+	defer proxy.Shutdown(context.Background())
+
+	conn, pid := connectPooledClient(t, addr)
+	if got := exchangeTestMessages(t, conn, testQuery("BEGIN")); got != "CZT" {
+		t.Fatalf("BEGIN = %s, want CZT", got)
+	}
+	proxy.pool.mu.Lock()
+	secret := proxy.pool.clients[pid].secret
+	proxy.pool.mu.Unlock()
+
+	cancel, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel.Close()
+	if _, err := cancel.Write((&pgwire.CancelRequest{ProcessID: pid, SecretKey: secret}).Encode(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The request reaches the target connection leased in the transaction with its key.
+	got := backend.waitCancel(t)
+	if want := (&cancelRequestMessage{pid: 1001, secret: []byte{0, 0, 0, 0}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("CancelRequest = %+v, want %+v", got, want)
+	}
+	if got := exchangeTestMessages(t, conn, testQuery("COMMIT")); got != "CZI" {
+		t.Errorf("COMMIT = %s, want CZI", got)
+	}
+}
@@ -1,45 +1,172 @@
 package postgresql
 
 import (
-	"container/list"
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"strings"
+	"sync"
 	"time"
 )
 
-type state struct {
-	bind     *bindMessage
-	parse    *parseMessage
-	error    *errorMessage
-	complete *commandCompleteMessage
-}
-
 type QueryWriter interface {
 	Write(q *Query)
 }
 
+// Query describes a single statement executed by backend.
 type Query struct {
-	Type         string
-	Query        string
-	Error        string
-	Time         time.Time
+	// Type is the command name from CommandComplete tag, e.g. SELECT, INSERT or CREATE TABLE.
+	Type  string
+	Query string
+	// Session describes the connection the statement was executed on.
+	Session SessionInfo
+	// Error is the message of the error the statement failed with.
+	Error string
+	// PgError holds all fields of the error the statement failed with, including its SQLSTATE code.
+	// It's nil if the statement succeeded.
+	PgError *PgError
+	// Rule is the firewall rule which blocked the statement, so it never reached backend.
+	// It's nil if the statement wasn't blocked.
+	Rule *Rule
+	// Notices are warnings and other notices backend raised while executing the statement.
+	Notices []*PgError
+	// Params are the values of statement parameters. Values sent in text format are strings,
+	// values sent in binary format are decoded into Go types according to the parameter type:
+	// int16, int32, int64, float32, float64, bool, string for text, json and numeric, []byte for bytea,
+	// time.Time for date and timestamp, []interface{} for one-dimensional arrays.
+	// Values of unknown types sent in binary format are left as []byte, NULL is nil.
+	Params []interface{}
+	// Time is the moment the statement arrived from frontend.
+	Time time.Time
+	// RowsAffected is the number of rows inserted, updated, deleted, merged, selected,
+	// fetched, moved or copied by the statement.
 	RowsAffected uint
+	// Duration is the time passed from Parse (or Query) till CommandComplete (or ErrorResponse).
+	Duration time.Duration
+	// ExecDuration is the time passed from Execute till CommandComplete (or ErrorResponse).
+	// It's equal to Duration for statements sent with Query.
+	ExecDuration time.Duration
+	// TimeToFirstRow is the time passed from Execute till the first DataRow.
+	// It's zero if the statement didn't return rows.
+	TimeToFirstRow time.Duration
+	// Copy describes the data transferred by COPY FROM STDIN or COPY TO STDOUT.
+	// It's nil for other statements, including COPY from or to a file.
+	Copy *CopyStats
 }
 
+// ErrProxyClosed is returned by Serve and Run after a call to Shutdown.
+var ErrProxyClosed = errors.New("postgresql: Proxy closed")
+
+// shutdownPollInterval is how often Shutdown looks for connections which became idle.
+const shutdownPollInterval = 50 * time.Millisecond
+
 // Proxy ...
 type Proxy struct {
-	connId uint32
-	source string
-	target string
-	writer QueryWriter
-	conns  map[uint32]*list.List
+	connId       uint32
+	source       string
+	target       string
+	events       EventWriter
+	now          func() time.Time
+	drainTimeout time.Duration
+	// maxMessageLen and maxFieldLen are set by MaxMessageSize and MaxFieldSize.
+	maxMessageLen int
+	maxFieldLen   int
+	tlsConfig     *tls.Config
+	// targetSSLMode and targetTLSBase are set by TargetTLS.
+	targetSSLMode SSLMode
+	targetTLSBase *tls.Config
+	// routes map lower case server names to targets.
+	routes map[string]string
+	// authMethod and credentials are set by Authenticate.
+	authMethod  AuthMethod
+	credentials CredentialStore
+	// poolMode and pool are set by Pool.
+	poolMode     PoolMode
+	pool         *pool
+	firewall     *Firewall
+	interceptors []Interceptor
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[*proxyConn]struct{}
+	inShutdown bool
+	// wg counts goroutines serving listeners and connections.
+	wg sync.WaitGroup
 }
 
-// NewProxy creates new instance of Proxy
+// proxyConn is a client connection together with the connection to target made for it.
+type proxyConn struct {
+	client  net.Conn
+	session *session
+
+	mu     sync.Mutex
+	server net.Conn
+	closed bool
+	// reason is why the connection was closed.
+	reason CloseReason
+	// done is closed along with the connection.
+	done chan struct{}
+}
+
+// setClient replaces the client connection, e.g. with the one which terminates TLS on top of it.
+// It returns false if proxyConn is already closed.
+func (c *proxyConn) setClient(client net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.client = client
+	return true
+}
+
+// setServer sets the connection to target. It returns false if proxyConn is already closed.
+func (c *proxyConn) setServer(server net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.server = server
+	return true
+}
+
+// close closes both connections. It's safe to call it more than once,
+// the reason of the first call is the one which is kept.
+func (c *proxyConn) close(reason CloseReason) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.reason = reason
+		close(c.done)
+	}
+	c.closed = true
+	_ = c.client.Close()
+	if c.server != nil {
+		_ = c.server.Close()
+	}
+}
+
+// closeReason returns why the connection was closed.
+func (c *proxyConn) closeReason() CloseReason {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reason
+}
+
+// NewProxy creates new instance of Proxy.
+// If w also implements TransactionWriter, it receives every completed transaction block too.
 func NewProxy(w QueryWriter) *Proxy {
-	return &Proxy{writer: w}
+	return NewEventProxy(QueryEvents(w))
+}
+
+// NewEventProxy creates new instance of Proxy which writes all events to w.
+func NewEventProxy(w EventWriter) *Proxy {
+	return &Proxy{events: w, now: time.Now, maxMessageLen: defaultMaxMessageLen, maxFieldLen: defaultMaxMessageLen}
 }
 
 func (p *Proxy) From(source string) *Proxy {
@@ -52,132 +179,577 @@ func (p *Proxy) To(target string) *Proxy {
 	return p
 }
 
-// Run runs Proxy server on specified port and handles each incoming
-// tcp connection in separate goroutine.
-func (p *Proxy) Run() error {
+// Clock replaces the function Proxy uses to timestamp messages. It's time.Now by default.
+func (p *Proxy) Clock(now func() time.Time) *Proxy {
+	p.now = now
+	return p
+}
+
+// DrainTimeout sets how long Run waits for in-flight connections to become idle after its context is done.
+// Connections which are still busy by then are closed forcibly. It's zero by default,
+// so all connections are closed right away.
+func (p *Proxy) DrainTimeout(d time.Duration) *Proxy {
+	p.drainTimeout = d
+	return p
+}
+
+// MaxMessageSize sets the limit of the length of a protocol message Proxy observes, not counting its type byte.
+// Messages are kept in memory until they arrive completely, so a longer message stops observing the stream
+// it's sent on: Proxy writes ProtocolError and either goes on forwarding the stream as is or, if it passes
+// on messages one by one, e.g. with Firewall or Pool, closes the connection. The limit is 1 GB by default,
+// backend doesn't accept longer messages either.
+func (p *Proxy) MaxMessageSize(n int) *Proxy {
+	p.maxMessageLen = n
+	return p
+}
+
+// MaxFieldSize sets the limit of the length of a single field Proxy keeps from the messages it observes:
+// a query string or a parameter value. A longer field is truncated, a truncated query string ends
+// with "...(truncated)", and ProtocolError wrapping ErrFieldTooLong is written. The limit is 1 GB by default.
+// It bounds the memory kept after a message is decoded, e.g. in the queries the session waits responses for,
+// but not the memory the message takes while it arrives: the whole message is buffered first,
+// which only MaxMessageSize limits.
+func (p *Proxy) MaxFieldSize(n int) *Proxy {
+	p.maxFieldLen = n
+	return p
+}
+
+// TLS makes Proxy answer SSLRequest itself and terminate TLS on the client side with config,
+// so that statements of encrypted connections can be observed. Traffic to the target is encrypted
+// independently according to TargetTLS.
+// Clients which start TLS directly without SSLRequest (sslnegotiation=direct) are accepted as well,
+// provided that they negotiate the postgresql ALPN protocol.
+// Clients which don't request encryption are served as before.
+func (p *Proxy) TLS(config *tls.Config) *Proxy {
+	p.tlsConfig = config
+	return p
+}
+
+// TargetTLS makes Proxy encrypt connections to the target according to mode. It's SSLDisable by default.
+// config provides the trusted CAs (RootCAs) for SSLVerifyCA and SSLVerifyFull, the client certificate
+// (Certificates) for mutual TLS and the server name, which defaults to the host of the target. config may be nil.
+// Proxy always negotiates encryption with clients itself once the target is encrypted,
+// so clients which request TLS are refused unless TLS is set too.
+func (p *Proxy) TargetTLS(mode SSLMode, config *tls.Config) *Proxy {
+	p.targetSSLMode = mode
+	p.targetTLSBase = config
+	return p
+}
+
+// Route makes Proxy connect clients which request serverName via TLS SNI to target
+// instead of the default one. It's effective only if TLS is set.
+func (p *Proxy) Route(serverName, target string) *Proxy {
+	if p.routes == nil {
+		p.routes = make(map[string]string)
+	}
+	p.routes[strings.ToLower(serverName)] = target
+	return p
+}
+
+// Authenticate makes Proxy authenticate clients itself with method against the credentials from store
+// and then authenticate to the target with the target credentials of the client, so that clients
+// never know the actual database passwords. The target may request SCRAM-SHA-256, md5 or cleartext password.
+func (p *Proxy) Authenticate(method AuthMethod, store CredentialStore) *Proxy {
+	p.authMethod = method
+	p.credentials = store
+	return p
+}
+
+// Pool makes Proxy keep authenticated connections to the target per target user and database
+// and share them between clients according to mode. At most size connections are opened
+// for each user and database, clients which need a connection when all of them are leased wait for one.
+// Serve fails unless size is positive and mode is PoolSession or PoolTransaction.
+// Connections are reset with DISCARD ALL before they return to the pool once their client is gone.
+// Pool requires Authenticate, since the pool rather than the client logs in to the target.
+// Startup parameters other than user and database aren't passed to the target.
+func (p *Proxy) Pool(mode PoolMode, size int) *Proxy {
+	p.poolMode = mode
+	p.pool = newPool(p, size)
+	return p
+}
+
+// Firewall makes Proxy check statements against the rules of f and block the ones it denies.
+// Proxy negotiates encryption with clients itself, so that it never passes on encrypted traffic
+// it can't check: clients which request TLS are refused unless TLS is set.
+func (p *Proxy) Firewall(f *Firewall) *Proxy {
+	p.firewall = f
+	return p
+}
+
+// Intercept adds interceptors which inspect and change messages of every connection, see Interceptor.
+// Like Firewall, it makes Proxy negotiate encryption with clients itself.
+func (p *Proxy) Intercept(interceptors ...Interceptor) *Proxy {
+	p.interceptors = append(p.interceptors, interceptors...)
+	return p
+}
+
+// relaying returns true if messages are passed on one by one rather than copied as is.
+func (p *Proxy) relaying() bool {
+	return p.firewall != nil || len(p.interceptors) > 0
+}
+
+// Run listens on the source address and serves connections until ctx is done.
+// Then it shuts Proxy down waiting for in-flight connections at most DrainTimeout.
+// Run returns an error if it can't listen on the source address or accept connections,
+// in the latter case only after it shuts Proxy down. Otherwise it returns nil once all connections are closed.
+func (p *Proxy) Run(ctx context.Context) error {
 	if len(p.source) == 0 || len(p.target) == 0 {
 		return errors.New("postgresql.Proxy.Run: source or target missing")
 	}
 
+	listener, err := net.Listen("tcp", p.source)
+	if err != nil {
+		return fmt.Errorf("postgresql.Proxy.Run: %w", err)
+	}
+	return p.run(ctx, listener)
+}
+
+// run serves connections accepted by l until ctx is done or l fails, then shuts Proxy down.
+func (p *Proxy) run(ctx context.Context, l net.Listener) error {
+	served := make(chan error, 1)
 	go func() {
-		listener, err := net.Listen("tcp", p.source)
+		served <- p.Serve(l)
+	}()
+
+	var err error
+	select {
+	case err = <-served:
+	case <-ctx.Done():
+	}
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), p.drainTimeout)
+	defer cancel()
+	shutdownErr := p.Shutdown(drainCtx)
+	if err != nil {
+		// Serve failed, but connections in flight are drained all the same.
+		return err
+	}
+	if shutdownErr != nil && !errors.Is(shutdownErr, context.DeadlineExceeded) {
+		return shutdownErr
+	}
+	if err := <-served; !errors.Is(err, ErrProxyClosed) {
+		return err
+	}
+	return nil
+}
+
+// Serve accepts connections on the listener and handles each of them in separate goroutine.
+// It closes the listener on return and always returns a non-nil error: ErrProxyClosed after Shutdown,
+// or the error which made accepting connections impossible.
+func (p *Proxy) Serve(l net.Listener) error {
+	if len(p.target) == 0 {
+		return errors.New("postgresql.Proxy.Serve: target missing")
+	}
+	if p.pool != nil && p.credentials == nil {
+		return errors.New("postgresql.Proxy.Serve: pool requires authentication")
+	}
+	if p.pool != nil && p.pool.size < 1 {
+		return fmt.Errorf("postgresql.Proxy.Serve: invalid pool size %d", p.pool.size)
+	}
+	if p.pool != nil && p.poolMode != PoolSession && p.poolMode != PoolTransaction {
+		return fmt.Errorf("postgresql.Proxy.Serve: unknown pool mode %q", p.poolMode)
+	}
+	if !p.trackListener(l, true) {
+		_ = l.Close()
+		return ErrProxyClosed
+	}
+	defer p.trackListener(l, false)
+	defer func() {
+		_ = l.Close()
+	}()
+
+	var delay time.Duration
+	for {
+		client, err := l.Accept()
 		if err != nil {
-			log.Fatal(err)
-		}
-		defer func() {
-			if err := listener.Close(); err != nil {
-				log.Println(err)
+			if p.shuttingDown() {
+				return ErrProxyClosed
 			}
-		}()
-
-		for {
-			client, err := listener.Accept()
-			if err != nil {
-				log.Print(err.Error())
+			// Temporary errors like running out of file descriptors are retried with backoff.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				log.Printf("postgresql.Proxy.Serve: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
 			}
+			return err
+		}
+		delay = 0
+
+		conn := &proxyConn{client: client, done: make(chan struct{})}
+		if !p.trackConn(conn, true) {
+			conn.close(CloseByShutdown)
+			return ErrProxyClosed
+		}
+		go func() {
+			defer p.trackConn(conn, false)
+			p.handleConnection(conn)
+		}()
+	}
+}
 
-			go p.handleConnection(client)
+// Shutdown stops Proxy without interrupting busy connections. It closes all listeners,
+// then closes connections as they become idle and waits for their goroutines to exit.
+// If ctx is done before that, Shutdown closes the remaining connections forcibly,
+// waits for their goroutines as well and returns ctx.Err().
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.inShutdown = true
+	for l := range p.listeners {
+		if err := l.Close(); err != nil {
+			log.Println(err)
 		}
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
 	}()
-	return nil
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		p.closeConns(false)
+		select {
+		case <-done:
+			p.closePool()
+			return nil
+		case <-ctx.Done():
+			p.closeConns(true)
+			<-done
+			p.closePool()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeConns closes idle connections, or all connections if force is true.
+func (p *Proxy) closeConns(force bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for conn := range p.conns {
+		if force || conn.session.idle() {
+			conn.close(CloseByShutdown)
+		}
+	}
+}
+
+// closePool closes the idle connections of the pool, if any.
+func (p *Proxy) closePool() {
+	if p.pool != nil {
+		p.pool.close()
+	}
+}
+
+func (p *Proxy) shuttingDown() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inShutdown
+}
+
+// trackListener adds or removes the listener. It returns false if the listener can't be added
+// because Proxy is shutting down.
+func (p *Proxy) trackListener(l net.Listener, add bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.listeners == nil {
+		p.listeners = make(map[net.Listener]struct{})
+	}
+	if !add {
+		delete(p.listeners, l)
+		p.wg.Done()
+		return true
+	}
+	if p.inShutdown {
+		return false
+	}
+	p.listeners[l] = struct{}{}
+	p.wg.Add(1)
+	return true
+}
+
+// trackConn adds or removes the connection. It returns false if the connection can't be added
+// because Proxy is shutting down.
+func (p *Proxy) trackConn(c *proxyConn, add bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conns == nil {
+		p.conns = make(map[*proxyConn]struct{})
+	}
+	if !add {
+		delete(p.conns, c)
+		p.wg.Done()
+		return true
+	}
+	if p.inShutdown {
+		return false
+	}
+	p.connId++
+	c.session = newSession(p, SessionInfo{ConnID: p.connId, ClientAddr: c.client.RemoteAddr().String()})
+	p.conns[c] = struct{}{}
+	p.wg.Add(1)
+	return true
 }
 
 // handleConnection makes connection to target host per each incoming tcp connection
 // and forwards all traffic from source to target.
-func (p *Proxy) handleConnection(in io.ReadWriteCloser) {
+func (p *Proxy) handleConnection(conn *proxyConn) {
+	opened := p.now()
+	p.events.WriteEvent(&ConnectionOpened{Session: conn.session.snapshot(), Time: opened})
+
+	closed := &ConnectionClosed{}
 	defer func() {
-		if err := in.Close(); err != nil {
-			log.Println(err)
-		}
+		closed.Session = conn.session.snapshot()
+		closed.Time = p.now()
+		closed.Duration = closed.Time.Sub(opened)
+		closed.Reason = conn.closeReason()
+		p.events.WriteEvent(closed)
 	}()
 
-	out, err := net.Dial("tcp", p.target)
+	if p.tlsConfig != nil || (p.targetSSLMode != "" && p.targetSSLMode != SSLDisable) || p.credentials != nil || p.relaying() {
+		client, err := p.negotiateClient(conn.client)
+		if err != nil {
+			conn.close(CloseByClient)
+			closed.Err = err
+			return
+		}
+		// Shutdown may have closed the connection during the negotiation.
+		if !conn.setClient(client) {
+			return
+		}
+	}
+
+	target := p.target
+	if tlsClient, ok := conn.client.(*tls.Conn); ok {
+		if routed, ok := p.routes[strings.ToLower(tlsClient.ConnectionState().ServerName)]; ok {
+			target = routed
+		}
+	}
+
+	var auth *authentication
+	if p.credentials != nil {
+		var err error
+		if auth, err = p.authenticateClient(conn); err != nil {
+			conn.close(CloseByClient)
+			closed.Err = err
+			return
+		}
+	}
+
+	if auth != nil && p.pool != nil {
+		p.servePooled(conn, auth, target, closed)
+		return
+	}
+	if p.pool != nil && p.poolMode == PoolTransaction {
+		// Proxy authenticates every client of the pool, so only CancelRequest is left without authentication.
+		target = p.pool.redirectCancel(conn, target)
+	}
+
+	server, err := p.dialTarget(target)
 	if err != nil {
 		log.Print(err)
+		if auth != nil {
+			_, _ = conn.client.Write(encodeErrorResponse("FATAL", "08006", "could not connect to the target"))
+		}
+		p.events.WriteEvent(&DialFailed{Session: conn.session.snapshot(), Time: p.now(), Target: target, Err: err})
+		conn.close(CloseByDialFailure)
+		closed.Err = err
 		return
 	}
-	defer func() {
-		if err := out.Close(); err != nil {
-			log.Println(err)
-		}
-	}()
 
-	err = p.proxyTraffic(in, out)
-	if err != nil {
-		log.Println(err)
+	// Shutdown may have closed the connection while the target was being dialed.
+	if !conn.setServer(server) {
+		_ = server.Close()
+		return
+	}
+
+	if auth != nil {
+		if err := p.authenticateTarget(conn, auth); err != nil {
+			conn.close(CloseByServer)
+			closed.Err = err
+			return
+		}
 	}
+
+	// Authentication leaves both streams right after the startup phase.
+	p.proxyTraffic(conn, closed, auth == nil)
 }
 
-// proxyTraffic ...
-func (p *Proxy) proxyTraffic(client, server io.ReadWriteCloser) error {
-	list := list.New()
+// copyResult is the outcome of copying one direction of the connection.
+type copyResult struct {
+	n      int64
+	err    error
+	reason CloseReason
+}
 
-	requestCollector := &collector{p, originFrontend, packetBuilder{}, list}
-	responseCollector := &collector{p, originBackend, packetBuilder{}, list}
+// proxyTraffic copies traffic in both directions until either side closes its connection.
+// It fills the byte counts and the error of closed. startup must be true if the streams start
+// from the very beginning of the connection.
+func (p *Proxy) proxyTraffic(conn *proxyConn, closed *ConnectionClosed, startup bool) {
+	requestCollector := newCollector(conn.session, originFrontend, startup)
+	defer requestCollector.close()
+	responseCollector := newCollector(conn.session, originBackend, startup)
+	defer responseCollector.close()
 
-	// Copy bytes from client to server
-	go func() {
-		if _, err := io.Copy(io.MultiWriter(server, requestCollector), client); err != nil {
-			log.Println(err)
+	// Requests are collected before they are sent, so the session knows about each request
+	// by the time the response to it arrives.
+	toServer := io.MultiWriter(requestCollector, conn.server)
+	toClient := io.MultiWriter(conn.client, responseCollector)
+	if p.relaying() {
+		// Messages are relayed one by one, so that they can be changed or answered in place of the target.
+		requestFramer := newFramer(originFrontend, startup, p.maxMessageLen)
+		defer requestFramer.close()
+		responseFramer := newFramer(originBackend, startup, p.maxMessageLen)
+		defer responseFramer.close()
+
+		queue := newResponseQueue(conn.client, responseCollector)
+		if !startup {
+			// StartupMessage was sent by Proxy, the target answers it with ReadyForQuery still.
+			queue.sync()
 		}
+		chain := newInterceptorChain(p.interceptors, conn.session)
+		requests := &requestRelay{server: conn.server, framer: requestFramer, collector: requestCollector, chain: chain, responses: queue}
+		if p.firewall != nil {
+			requests.guard = &guard{firewall: p.firewall, session: conn.session}
+		}
+		toServer = requests
+		toClient = &responseRelay{server: conn.server, framer: responseFramer, chain: chain, responses: queue}
+	}
+
+	var requests, responses copyResult
+	done := make(chan copyResult, 2)
+
+	// Copy bytes from client to server.
+	go func() {
+		requests = copyConn(toServer, conn.client, CloseByClient, CloseByServer)
+		done <- requests
 	}()
 
 	// Copy bytes from server to client
-	if _, err := io.Copy(io.MultiWriter(client, responseCollector), server); err != nil {
+	go func() {
+		responses = copyConn(toClient, conn.server, CloseByServer, CloseByClient)
+		done <- responses
+	}()
+
+	// Once either side is gone, the other one has nothing to talk to.
+	first := <-done
+	conn.close(first.reason)
+	<-done
+
+	closed.BytesFromClient = requests.n
+	closed.BytesFromServer = responses.n
+	if first.err != nil && !isClosedConnError(first.err) {
+		closed.Err = first.err
+	}
+}
+
+// copyConn copies src to dst. The reason of the result is readReason if src ended
+// and writeReason if writing to dst failed.
+func copyConn(dst io.Writer, src net.Conn, readReason, writeReason CloseReason) copyResult {
+	r := &errorReader{r: src}
+	n, err := io.Copy(dst, r)
+	if err != nil && !isClosedConnError(err) {
 		log.Println(err)
 	}
+	result := copyResult{n: n, err: err, reason: readReason}
+	// The stream which can't be framed is the fault of its sender rather than of dst.
+	if err != nil && err != r.err && err != errInvalidMessageLength {
+		result.reason = writeReason
+	}
+	return result
+}
 
-	return nil
+// errorReader remembers the error reading stopped with.
+type errorReader struct {
+	r   io.Reader
+	err error
 }
 
-// collector ...
+func (r *errorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// isClosedConnError returns true if err is caused by use of the connection closed by Proxy.
+func isClosedConnError(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
+
+// collector decodes messages sent by the origin and feeds them to the session.
 type collector struct {
-	proxy   *Proxy
+	session *session
 	origin  byte
-	builder packetBuilder
-	list    *list.List
+	framer  *framer
+	// messages are the decoded messages of the current write.
+	messages []interface{}
+	// errs are the errors of the messages of the current write which can't be decoded.
+	errs []error
+	// broken is true once the stream can't be framed anymore and the session knows about it.
+	broken bool
+}
+
+// newCollector creates collector of the stream sent by the origin.
+// startup must be true if the stream starts from the very beginning of the connection.
+func newCollector(s *session, origin byte, startup bool) *collector {
+	f := newFramer(origin, startup, s.proxy.maxMessageLen)
+	// The session needs the size of CopyData alone, so COPY streams are never buffered.
+	f.skipType = copyDataMessageType
+	return &collector{session: s, origin: origin, framer: f}
 }
 
 func (c *collector) Write(p []byte) (n int, err error) {
-	packet, err := c.builder.append(p, c.origin)
-	if err != nil {
-		println(err)
-	}
-	if packet != nil {
-		for _, message := range packet.messages() {
-			switch m := message.(type) {
-			case *parseMessage:
-				// Sometimes frontend may send parse message with empty query
-				// and backend doesn't respond with CommandComplete message to it.
-				// So lets skip such parse messages.
-				if len(m.query) == 0 {
-					continue
-				}
-				c.list.PushBack(&state{
-					parse:    m,
-					complete: nil,
-				})
-			case *bindMessage:
-				if back := c.list.Back(); back != nil {
-					state := back.Value.(*state)
-					state.bind = m
-				}
-			case *errorMessage:
-				if front := c.list.Front(); front != nil {
-					state := front.Value.(*state)
-					state.error = m
-					c.proxy.writer.Write(&Query{Query: state.parse.query, Error: state.error.message})
-					c.list.Remove(front)
-				}
-			case *commandCompleteMessage:
-				if front := c.list.Front(); front != nil {
-					state := front.Value.(*state)
-					state.complete = m
-					c.proxy.writer.Write(&Query{Query: state.parse.query})
-					c.list.Remove(front)
-				}
-			}
-		}
+	c.messages, c.errs = c.messages[:0], c.errs[:0]
+	c.framer.write(p, c.decode)
+	switch {
+	case len(c.messages) == 0:
+	case c.origin == originFrontend:
+		c.session.frontend(c.messages)
+	default:
+		c.session.backend(c.messages)
+	}
+	for _, err := range c.errs {
+		c.session.protocolError(c.origin == originFrontend, err)
+	}
+
+	if c.framer.err != nil && !c.broken {
+		c.broken = true
+		c.session.protocolError(c.origin == originFrontend, c.framer.err)
 	}
 	return len(p), nil
 }
+
+func (c *collector) decode(msg []byte) {
+	m, err := decodeMessage(msg, c.origin)
+	switch {
+	case err != nil && c.origin == originFrontend:
+		// The session still learns that a statement it can't know was sent.
+		if u := newUndecodedMessage(msg); u != nil {
+			m = u
+		}
+	case err == nil:
+		err = limitFieldLen(m, c.session.proxy.maxFieldLen)
+	}
+	if err != nil {
+		c.errs = append(c.errs, err)
+	}
+	if m != nil {
+		c.messages = append(c.messages, m)
+	}
+}
+
+func (c *collector) close() {
+	c.framer.close()
+}
@@ -0,0 +1,959 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type queryRecorder struct {
+	queries []*Query
+}
+
+func (r *queryRecorder) Write(q *Query) {
+	r.queries = append(r.queries, q)
+}
+
+type fakeClock struct {
+	time time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.time
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.time = c.time.Add(d)
+}
+
+func newTestCollectors(w QueryWriter, clock *fakeClock) (request, response *collector) {
+	session := newSession(NewProxy(w).Clock(clock.now), SessionInfo{})
+	return newCollector(session, originFrontend, false), newCollector(session, originBackend, false)
+}
+
+func Test_collector_SimpleQuery_With_Multiple_Statements(t *testing.T) {
+	recorder := &queryRecorder{}
+	clock := &fakeClock{time.Date(2020, 5, 30, 12, 0, 0, 0, time.UTC)}
+	start := clock.time
+	request, response := newTestCollectors(recorder, clock)
+
+	// Q "SELECT 1; SELECT x; SELECT 3" followed by Q "SHOW x"
+	_, _ = request.Write(decodeHexStream(t, "510000002153454c45435420313b2053454c45435420783b2053454c454354203300"))
+	_, _ = request.Write(decodeHexStream(t, "510000000b53484f57207800"))
+	// CommandComplete "SELECT 1"
+	clock.advance(time.Millisecond)
+	_, _ = response.Write(decodeHexStream(t, "430000000d53454c454354203100"))
+	// ErrorResponse, ReadyForQuery
+	clock.advance(2 * time.Millisecond)
+	_, _ = response.Write(decodeHexStream(t, "450000002c534552524f5200433432373033004d636f6c756d6e207820646f6573206e6f7420657869737400005a0000000549"))
+	// ErrorResponse to the second query, ReadyForQuery
+	clock.advance(time.Millisecond)
+	_, _ = response.Write(decodeHexStream(t, "4500000018534552524f5200433432373034004d6e6f7000005a0000000549"))
+
+	want := []*Query{
+		{
+			Type:         "SELECT",
+			Query:        "SELECT 1",
+			Time:         start,
+			RowsAffected: 1,
+			Duration:     time.Millisecond,
+			ExecDuration: time.Millisecond,
+		},
+		{
+			Query:        "SELECT x",
+			Error:        "column x does not exist",
+			PgError:      &PgError{Severity: "ERROR", SeverityLocalized: "ERROR", Code: "42703", Message: "column x does not exist"},
+			Time:         start.Add(time.Millisecond),
+			Duration:     2 * time.Millisecond,
+			ExecDuration: 2 * time.Millisecond,
+		},
+		{
+			Query:        "SHOW x",
+			Error:        "nop",
+			PgError:      &PgError{Severity: "ERROR", SeverityLocalized: "ERROR", Code: "42704", Message: "nop"},
+			Time:         start,
+			Duration:     4 * time.Millisecond,
+			ExecDuration: 4 * time.Millisecond,
+		},
+	}
+	if !reflect.DeepEqual(recorder.queries, want) {
+		t.Errorf("collector wrote %s, want %s", dumpQueries(recorder.queries), dumpQueries(want))
+	}
+	if len(request.session.pending) != 0 {
+		t.Errorf("session left %d pending states, want 0", len(request.session.pending))
+	}
+}
+
+func Test_collector_ExtendedQuery_Timings(t *testing.T) {
+	recorder := &queryRecorder{}
+	clock := &fakeClock{time.Date(2020, 5, 30, 12, 0, 0, 0, time.UTC)}
+	start := clock.time
+	request, response := newTestCollectors(recorder, clock)
+
+	// Parse "SELECT generate_series(1, $1)"
+	_, _ = request.Write(decodeHexStream(t, "50000000250053454c4543542067656e65726174655f73657269657328312c20243129000000"))
+	// Bind, Execute, Sync
+	clock.advance(time.Millisecond)
+	_, _ = request.Write(decodeHexStream(t, "420000001100000000000100000001320000"))
+	clock.advance(time.Millisecond)
+	_, _ = request.Write(decodeHexStream(t, "450000000900000000005300000004"))
+	// ParseComplete, BindComplete, DataRow, DataRow
+	clock.advance(3 * time.Millisecond)
+	_, _ = response.Write(decodeHexStream(t, "31000000043200000004440000000b00010000000131"))
+	clock.advance(time.Millisecond)
+	_, _ = response.Write(decodeHexStream(t, "440000000b00010000000132"))
+	// CommandComplete, ReadyForQuery
+	clock.advance(time.Millisecond)
+	_, _ = response.Write(decodeHexStream(t, "430000000d53454c4543542032005a0000000549"))
+
+	want := []*Query{
+		{
+			Type:           "SELECT",
+			Query:          "SELECT generate_series(1, $1)",
+			Params:         []interface{}{"2"},
+			Time:           start,
+			RowsAffected:   2,
+			Duration:       7 * time.Millisecond,
+			ExecDuration:   5 * time.Millisecond,
+			TimeToFirstRow: 3 * time.Millisecond,
+		},
+	}
+	if !reflect.DeepEqual(recorder.queries, want) {
+		t.Errorf("collector wrote %s, want %s", dumpQueries(recorder.queries), dumpQueries(want))
+	}
+}
+
+func Test_collector_NamedStatement_Executed_Many_Times(t *testing.T) {
+	recorder := &queryRecorder{}
+	clock := &fakeClock{time.Date(2020, 5, 30, 12, 0, 0, 0, time.UTC)}
+	start := clock.time
+	request, response := newTestCollectors(recorder, clock)
+
+	// Parse "s1" with unspecified parameter type, Describe "s1", Sync
+	_, _ = request.Write(decodeHexStream(t, "500000001773310053454c454354202431000001000000004400000008537331005300000004"))
+	// ParseComplete, ParameterDescription with int4 parameter, ReadyForQuery
+	clock.advance(time.Millisecond)
+	_, _ = response.Write(decodeHexStream(t, "3100000004740000000a0001000000175a0000000549"))
+
+	for _, bind := range []string{
+		"42000000180073310000010001000100000004000000070000450000000900000000005300000004",
+		"42000000180073310000010001000100000004000000080000450000000900000000005300000004",
+	} {
+		// Bind "s1", Execute, Sync
+		clock.advance(time.Millisecond)
+		_, _ = request.Write(decodeHexStream(t, bind))
+		// BindComplete, CommandComplete, ReadyForQuery
+		clock.advance(time.Millisecond)
+		_, _ = response.Write(decodeHexStream(t, "3200000004430000000d53454c4543542031005a0000000549"))
+	}
+
+	// Close "s1", Sync
+	_, _ = request.Write(decodeHexStream(t, "4300000008537331005300000004"))
+	// CloseComplete, ReadyForQuery
+	_, _ = response.Write(decodeHexStream(t, "33000000045a0000000549"))
+
+	want := []*Query{
+		{
+			Type:         "SELECT",
+			Query:        "SELECT $1",
+			Params:       []interface{}{int32(7)},
+			Time:         start,
+			RowsAffected: 1,
+			Duration:     3 * time.Millisecond,
+			ExecDuration: time.Millisecond,
+		},
+		{
+			Type:         "SELECT",
+			Query:        "SELECT $1",
+			Params:       []interface{}{int32(8)},
+			Time:         start.Add(4 * time.Millisecond),
+			RowsAffected: 1,
+			Duration:     time.Millisecond,
+			ExecDuration: time.Millisecond,
+		},
+	}
+	if !reflect.DeepEqual(recorder.queries, want) {
+		t.Errorf("collector wrote %s, want %s", dumpQueries(recorder.queries), dumpQueries(want))
+	}
+	if len(request.session.registry.statements) != 0 {
+		t.Errorf("registry has %d statements after Close, want 0", len(request.session.registry.statements))
+	}
+}
+
+func dumpQueries(queries []*Query) string {
+	var s string
+	for _, q := range queries {
+		s += fmt.Sprintf("\n%+v", *q)
+		if q.Copy != nil {
+			s += fmt.Sprintf(" Copy:%+v", *q.Copy)
+		}
+	}
+	return s
+}
+
+func Test_collector_Copy(t *testing.T) {
+	recorder := &queryRecorder{}
+	clock := &fakeClock{time.Date(2020, 5, 30, 12, 0, 0, 0, time.UTC)}
+	start := clock.time
+	request, response := newTestCollectors(recorder, clock)
+
+	// Q "COPY t FROM STDIN (FORMAT csv)", CopyInResponse, CopyData "1,a\n", CopyData "2,b\n", CopyDone
+	_, _ = request.Write(decodeHexStream(t, "5100000023434f505920742046524f4d20535444494e2028464f524d4154206373762900"))
+	clock.advance(time.Millisecond)
+	_, _ = response.Write(decodeHexStream(t, "470000000b00000200000000"))
+	clock.advance(time.Millisecond)
+	_, _ = request.Write(decodeHexStream(t, "6400000008312c610a6400000008322c620a"))
+	clock.advance(2 * time.Millisecond)
+	_, _ = request.Write(decodeHexStream(t, "6300000004"))
+	// CommandComplete "COPY 2", ReadyForQuery
+	clock.advance(time.Millisecond)
+	_, _ = response.Write(decodeHexStream(t, "430000000b434f5059203200"+"5a0000000549"))
+
+	// Q "COPY t TO STDOUT WITH BINARY", CopyOutResponse, CopyData "abc" three times, CopyDone
+	_, _ = request.Write(decodeHexStream(t, "5100000021434f5059207420544f205354444f555420574954482042494e41525900"))
+	clock.advance(time.Millisecond)
+	_, _ = response.Write(decodeHexStream(t, "48000000090100010001"))
+	clock.advance(2 * time.Millisecond)
+	_, _ = response.Write(decodeHexStream(t, "6400000007616263"+"6400000007616263"+"6400000007616263"+"6300000004"))
+	// CommandComplete "COPY 2", ReadyForQuery
+	clock.advance(time.Millisecond)
+	_, _ = response.Write(decodeHexStream(t, "430000000b434f5059203200"+"5a0000000549"))
+
+	// Q "COPY t FROM STDIN", then CopyData "1,a\n" and CopyFail "aborted" arrive before CopyInResponse is observed
+	_, _ = request.Write(decodeHexStream(t, "5100000016434f505920742046524f4d20535444494e00"))
+	clock.advance(time.Millisecond)
+	_, _ = request.Write(decodeHexStream(t, "6400000008312c610a"+"660000000c61626f7274656400"))
+	// CopyInResponse, ErrorResponse, ReadyForQuery
+	clock.advance(time.Millisecond)
+	_, _ = response.Write(decodeHexStream(t, "470000000b00000200000000"+
+		"4500000034534552524f5200433537303134004d434f50592066726f6d20737464696e206661696c65643a2061626f727465640000"+"5a0000000549"))
+
+	want := []*Query{
+		{
+			Type:         "COPY",
+			Query:        "COPY t FROM STDIN (FORMAT csv)",
+			Time:         start,
+			RowsAffected: 2,
+			Duration:     5 * time.Millisecond,
+			ExecDuration: 5 * time.Millisecond,
+			Copy:         &CopyStats{Direction: CopyIn, Format: CopyCSV, MessagesFromClient: 2, BytesFromClient: 8, Duration: 3 * time.Millisecond},
+		},
+		{
+			Type:         "COPY",
+			Query:        "COPY t TO STDOUT WITH BINARY",
+			Time:         start.Add(5 * time.Millisecond),
+			RowsAffected: 2,
+			Duration:     4 * time.Millisecond,
+			ExecDuration: 4 * time.Millisecond,
+			Copy:         &CopyStats{Direction: CopyOut, Format: CopyBinary, MessagesFromServer: 3, BytesFromServer: 9, Duration: 2 * time.Millisecond},
+		},
+		{
+			Query:        "COPY t FROM STDIN",
+			Error:        "COPY from stdin failed: aborted",
+			PgError:      &PgError{Severity: "ERROR", SeverityLocalized: "ERROR", Code: "57014", Message: "COPY from stdin failed: aborted"},
+			Time:         start.Add(9 * time.Millisecond),
+			Duration:     2 * time.Millisecond,
+			ExecDuration: 2 * time.Millisecond,
+			Copy:         &CopyStats{Direction: CopyIn, Format: CopyText, MessagesFromClient: 1, BytesFromClient: 4, Failed: true},
+		},
+	}
+	if !reflect.DeepEqual(recorder.queries, want) {
+		t.Errorf("collector wrote %s, want %s", dumpQueries(recorder.queries), dumpQueries(want))
+	}
+	if copies := request.session.copies; copies.sending != nil || len(copies.sent) != 0 {
+		t.Errorf("session left data %+v, %+v of COPY, want none", copies.sending, copies.sent)
+	}
+}
+
+func Test_collector_Copy_Failed_By_Backend(t *testing.T) {
+	recorder := &queryRecorder{}
+	clock := &fakeClock{time.Date(2020, 5, 30, 12, 0, 0, 0, time.UTC)}
+	request, response := newTestCollectors(recorder, clock)
+
+	// Q "COPY t FROM STDIN", CopyInResponse, CopyData "1,a\n"
+	_, _ = request.Write(decodeHexStream(t, "5100000016434f505920742046524f4d20535444494e00"))
+	_, _ = response.Write(decodeHexStream(t, "470000000b00000200000000"))
+	_, _ = request.Write(decodeHexStream(t, "6400000008312c610a"))
+	// Backend fails before the data end: ErrorResponse, ReadyForQuery
+	_, _ = response.Write(decodeHexStream(t, "4500000034534552524f5200433537303134004d434f50592066726f6d20737464696e206661696c65643a2061626f727465640000"+"5a0000000549"))
+	// Frontend ends the data backend ignores: CopyData "2,b\n", CopyDone
+	_, _ = request.Write(decodeHexStream(t, "6400000008322c620a"+"6300000004"))
+
+	if len(recorder.queries) != 1 || recorder.queries[0].Copy == nil || recorder.queries[0].Copy.MessagesFromClient != 1 {
+		t.Fatalf("collector wrote %s, want COPY with 1 message from client", dumpQueries(recorder.queries))
+	}
+	if copies := request.session.copies; len(copies.sent) != 0 {
+		t.Errorf("session kept the ignored data %+v of COPY", copies.sent)
+	}
+}
+
+func Test_copyFormat(t *testing.T) {
+	tests := []struct {
+		query  string
+		binary bool
+		want   CopyFormat
+	}{
+		{"COPY t FROM STDIN", false, CopyText},
+		{"COPY t FROM STDIN", true, CopyBinary},
+		{"copy t from stdin with (format csv, header true)", false, CopyCSV},
+		{"COPY t FROM STDIN WITH (FORMAT 'csv')", false, CopyCSV},
+		{"COPY t TO STDOUT WITH CSV HEADER", false, CopyCSV},
+		{"COPY t TO STDOUT (FORMAT text, DELIMITER 'csv')", false, CopyText},
+		{"COPY csv TO STDOUT", false, CopyText},
+		{"COPY (SELECT 'csv', csv FROM t) TO STDOUT (FORMAT text)", false, CopyText},
+		{`COPY t ("STDOUT") TO STDOUT CSV`, false, CopyCSV},
+	}
+	for _, tt := range tests {
+		if got := copyFormat(tt.query, tt.binary); got != tt.want {
+			t.Errorf("copyFormat(%q, %t) = %q, want %q", tt.query, tt.binary, got, tt.want)
+		}
+	}
+}
+
+func Test_collector_Does_Not_Buffer_CopyData(t *testing.T) {
+	recorder := newEventRecorder()
+	session := newSession(NewEventProxy(recorder).Clock((&fakeClock{}).now).MaxMessageSize(8), SessionInfo{})
+	request := newCollector(session, originFrontend, false)
+
+	// CopyData with 16 bytes of data is longer than the message limit, but it's never buffered.
+	_, _ = request.Write(decodeHexStream(t, "6400000014000102030405"))
+	_, _ = request.Write(decodeHexStream(t, "060708090a0b0c0d0e0f"+"6300000004"))
+
+	if len(recorder.events) != 0 {
+		t.Errorf("events = %v, want none", recorder.types())
+	}
+	if want := []*copyData{{messages: 1, bytes: 16}}; !reflect.DeepEqual(session.copies.sent, want) {
+		t.Errorf("session got data %+v of COPY, want %+v", session.copies.sent, want)
+	}
+	if request.framer.tail != nil {
+		t.Error("framer keeps CopyData")
+	}
+}
+
+func Test_collector_Pipeline_Skips_Until_Sync_After_Error(t *testing.T) {
+	recorder := &queryRecorder{}
+	clock := &fakeClock{time.Date(2020, 5, 30, 12, 0, 0, 0, time.UTC)}
+	request, response := newTestCollectors(recorder, clock)
+
+	// Parse/Bind/Execute "SELECT 1", "SELEC 2" and "SELECT 3", Sync
+	_, _ = request.Write(decodeHexStream(t, "50000000100053454c4543542031000000420000000c000000000000000045000000090000000000500000000f0053454c45432032000000420000000c00000000000000004500000009000000000050000000100053454c4543542033000000420000000c0000000000000000450000000900000000005300000004"))
+	// ParseComplete, BindComplete, DataRow, CommandComplete, ErrorResponse to the second Parse, ReadyForQuery
+	_, _ = response.Write(decodeHexStream(t, "31000000043200000004440000000b00010000000131430000000d53454c4543542031004500000034534552524f5200433432363031004d73796e746178206572726f72206174206f72206e656172202253454c45432200005a0000000549"))
+
+	if len(recorder.queries) != 2 {
+		t.Fatalf("collector wrote %d queries, want 2", len(recorder.queries))
+	}
+	if q := recorder.queries[0]; q.Query != "SELECT 1" || q.Error != "" || q.RowsAffected != 1 {
+		t.Errorf("collector wrote %+v, want successful SELECT 1", *q)
+	}
+	if q := recorder.queries[1]; q.Query != "SELEC 2" || q.Error != `syntax error at or near "SELEC"` {
+		t.Errorf("collector wrote %+v, want failed SELEC 2", *q)
+	}
+	if len(request.session.pending) != 0 {
+		t.Errorf("session left %d pending states, want 0", len(request.session.pending))
+	}
+}
+
+func Test_collector_Concurrent_Directions(t *testing.T) {
+	recorder := &queryRecorder{}
+	request, response := newTestCollectors(recorder, &fakeClock{})
+
+	// Query "SELECT 1" and the response to it: CommandComplete and ReadyForQuery
+	query := decodeHexStream(t, "510000000d53454c454354203100")
+	reply := decodeHexStream(t, "430000000d53454c4543542031005a0000000549")
+
+	const n = 1000
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < n; i++ {
+			_, _ = request.Write(query)
+		}
+		close(done)
+	}()
+	for i := 0; i < n; i++ {
+		_, _ = response.Write(reply)
+	}
+	<-done
+}
+
+// startTestBackend starts a server which answers StartupMessage with AuthenticationOk and ReadyForQuery
+// and then keeps connections open without answering anything else.
+func startTestBackend(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestBackend(t, conn)
+		}
+	}()
+	t.Cleanup(func() { _ = l.Close() })
+	return l
+}
+
+// serveTestBackend answers StartupMessage with AuthenticationOk and ReadyForQuery
+// and then discards everything until the connection is closed.
+func serveTestBackend(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	startup := make([]byte, 27)
+	if _, err := io.ReadFull(conn, startup); err != nil {
+		return
+	}
+	_, _ = conn.Write(decodeHexStream(t, "5200000008000000005a0000000549"))
+	_, _ = io.Copy(ioutil.Discard, conn)
+}
+
+// startTestProxy starts serving proxy to the backend and returns the listener address and Serve result.
+func startTestProxy(t *testing.T, proxy *Proxy) (string, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- proxy.Serve(l)
+	}()
+	return l.Addr().String(), served
+}
+
+// connectTestClient connects to the proxy and sends StartupMessage.
+// If ready is true, it waits for ReadyForQuery as well.
+func connectTestClient(t *testing.T, addr string, ready bool) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	if _, err := conn.Write(decodeHexStream(t, "0000001b0003000075736572007500646174616261736500640000")); err != nil {
+		t.Fatal(err)
+	}
+	if ready {
+		if _, err := io.ReadFull(conn, make([]byte, 15)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return conn
+}
+
+func Test_Proxy_Shutdown_Closes_Idle_Connections(t *testing.T) {
+	backend := startTestBackend(t)
+	proxy := NewProxy(&queryRecorder{}).To(backend.Addr().String())
+	addr, served := startTestProxy(t, proxy)
+	client := connectTestClient(t, addr, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() error = %v, want nil", err)
+	}
+	if err := <-served; err != ErrProxyClosed {
+		t.Errorf("Serve() error = %v, want %v", err, ErrProxyClosed)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("client Read() error = %v, want %v", err, io.EOF)
+	}
+}
+
+func Test_Proxy_Shutdown_Closes_Busy_Connections_After_Deadline(t *testing.T) {
+	backend := startTestBackend(t)
+	proxy := NewProxy(&queryRecorder{}).To(backend.Addr().String())
+	addr, served := startTestProxy(t, proxy)
+	client := connectTestClient(t, addr, true)
+	// The query is never answered, so the connection stays busy.
+	if _, err := client.Write(decodeHexStream(t, "510000000d53454c454354203100")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := <-served; err != ErrProxyClosed {
+		t.Errorf("Serve() error = %v, want %v", err, ErrProxyClosed)
+	}
+	if len(proxy.conns) != 0 {
+		t.Errorf("Proxy has %d connections after Shutdown, want 0", len(proxy.conns))
+	}
+}
+
+func Test_Proxy_Run(t *testing.T) {
+	backend := startTestBackend(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// The address is busy, so Run must fail right away.
+	proxy := NewProxy(&queryRecorder{}).From(l.Addr().String()).To(backend.Addr().String())
+	if err := proxy.Run(context.Background()); err == nil {
+		t.Error("Run() on busy address expected to fail, but nil returned")
+	}
+
+	proxy = NewProxy(&queryRecorder{}).From("127.0.0.1:0").To(backend.Addr().String())
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan error, 1)
+	go func() {
+		ran <- proxy.Run(ctx)
+	}()
+	cancel()
+	select {
+	case err := <-ran:
+		if err != nil {
+			t.Errorf("Run() error = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Run() didn't return after its context was canceled")
+	}
+}
+
+// failingListener accepts a single connection, then fails once fail is closed.
+type failingListener struct {
+	net.Listener
+	fail     chan struct{}
+	accepted bool
+}
+
+var errTestAccept = errors.New("accept failed")
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.accepted {
+		<-l.fail
+		return nil, errTestAccept
+	}
+	l.accepted = true
+	return l.Listener.Accept()
+}
+
+func Test_Proxy_Run_Drains_Connections_If_Accept_Fails(t *testing.T) {
+	backend := startTestBackend(t)
+	proxy := NewProxy(&queryRecorder{}).To(backend.Addr().String()).DrainTimeout(100 * time.Millisecond)
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &failingListener{Listener: tcp, fail: make(chan struct{})}
+	ran := make(chan error, 1)
+	go func() {
+		ran <- proxy.run(context.Background(), l)
+	}()
+
+	client := connectTestClient(t, tcp.Addr().String(), true)
+	// The query is never answered, so the connection stays busy till the drain deadline.
+	if _, err := client.Write(decodeHexStream(t, "510000000d53454c454354203100")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(l.fail)
+
+	select {
+	case err := <-ran:
+		if err != errTestAccept {
+			t.Errorf("run() error = %v, want %v", err, errTestAccept)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run() didn't return after Accept failed")
+	}
+	proxy.mu.Lock()
+	conns := len(proxy.conns)
+	proxy.mu.Unlock()
+	if conns != 0 {
+		t.Errorf("Proxy has %d connections after run returned, want 0", conns)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("client Read() error = %v, want %v", err, io.EOF)
+	}
+}
+
+func Test_collector_Notice_Attached_To_Statement(t *testing.T) {
+	recorder := &queryRecorder{}
+	request, response := newTestCollectors(recorder, &fakeClock{})
+
+	// Query "COMMIT"
+	_, _ = request.Write(decodeHexStream(t, "510000000b434f4d4d495400"))
+	// NoticeResponse, CommandComplete, ReadyForQuery
+	_, _ = response.Write(decodeHexStream(t, "4e00000043535741524e494e4700565741524e494e4700433235503031004d7468657265206973206e6f207472616e73616374696f6e20696e2070726f67726573730000"))
+	_, _ = response.Write(decodeHexStream(t, "430000000b434f4d4d4954005a0000000549"))
+
+	want := []*PgError{{Severity: "WARNING", SeverityLocalized: "WARNING", Code: "25P01", Message: "there is no transaction in progress"}}
+	if len(recorder.queries) != 1 {
+		t.Fatalf("collector wrote %d queries, want 1", len(recorder.queries))
+	}
+	if got := recorder.queries[0].Notices; !reflect.DeepEqual(got, want) {
+		t.Errorf("collector wrote notices %+v, want %+v", got, want)
+	}
+}
+
+func Test_collector_Attaches_Session_Info(t *testing.T) {
+	recorder := &queryRecorder{}
+	clock := &fakeClock{time.Date(2020, 5, 30, 12, 0, 0, 0, time.UTC)}
+	session := newSession(NewProxy(recorder).Clock(clock.now), SessionInfo{ConnID: 7, ClientAddr: "127.0.0.1:50000"})
+	request, response := newCollector(session, originFrontend, true), newCollector(session, originBackend, true)
+
+	// StartupMessage user=alice application_name=psql
+	_, _ = request.Write(decodeHexStream(t, "0000002a000300007573657200616c696365006170706c69636174696f6e5f6e616d65007073716c0000"))
+	// AuthenticationOk, ParameterStatus server_version=14.2 and application_name=app, BackendKeyData, ReadyForQuery
+	_, _ = response.Write(decodeHexStream(t, "52000000080000000053000000187365727665725f76657273696f6e0031342e320053000000196170706c69636174696f6e5f6e616d6500617070004b0000000c000004d20000002a5a0000000549"))
+	// Q "SELECT 1", CommandComplete, ReadyForQuery
+	_, _ = request.Write(decodeHexStream(t, "510000000d53454c454354203100"))
+	_, _ = response.Write(decodeHexStream(t, "430000000d53454c4543542031005a0000000549"))
+
+	want := SessionInfo{
+		ConnID:          7,
+		ClientAddr:      "127.0.0.1:50000",
+		User:            "alice",
+		Database:        "alice",
+		ApplicationName: "app",
+		ServerVersion:   "14.2",
+		BackendPID:      1234,
+	}
+	if len(recorder.queries) != 1 {
+		t.Fatalf("expected 1 query, got %s", dumpQueries(recorder.queries))
+	}
+	if got := recorder.queries[0].Session; got != want {
+		t.Errorf("Session = %+v, want %+v", got, want)
+	}
+}
+
+type transactionRecorder struct {
+	queryRecorder
+	transactions []*Transaction
+}
+
+func (r *transactionRecorder) WriteTransaction(tx *Transaction) {
+	r.transactions = append(r.transactions, tx)
+}
+
+func Test_collector_Transactions(t *testing.T) {
+	recorder := &transactionRecorder{}
+	clock := &fakeClock{time.Date(2020, 5, 30, 12, 0, 0, 0, time.UTC)}
+	start := clock.time
+	request, response := newTestCollectors(recorder, clock)
+
+	// Q "BEGIN", CommandComplete, ReadyForQuery 'T'
+	_, _ = request.Write(decodeHexStream(t, "510000000a424547494e00"))
+	clock.advance(time.Millisecond)
+	_, _ = response.Write(decodeHexStream(t, "430000000a424547494e005a0000000554"))
+	// Idle for 5ms, then Q "INSERT INTO t VALUES (1)", CommandComplete, ReadyForQuery 'T'
+	clock.advance(5 * time.Millisecond)
+	_, _ = request.Write(decodeHexStream(t, "510000001d494e5345525420494e544f20742056414c5545532028312900"))
+	clock.advance(time.Millisecond)
+	_, _ = response.Write(decodeHexStream(t, "430000000f494e5345525420302031005a0000000554"))
+	// Idle for 3ms, then Q "COMMIT", CommandComplete, ReadyForQuery 'I'
+	clock.advance(3 * time.Millisecond)
+	_, _ = request.Write(decodeHexStream(t, "510000000b434f4d4d495400"))
+	clock.advance(time.Millisecond)
+	_, _ = response.Write(decodeHexStream(t, "430000000b434f4d4d4954005a0000000549"))
+
+	// Q "BEGIN", Q "SELECT x" failing, Q "ROLLBACK"
+	failedStart := clock.time
+	_, _ = request.Write(decodeHexStream(t, "510000000a424547494e00"))
+	_, _ = response.Write(decodeHexStream(t, "430000000a424547494e005a0000000554"))
+	_, _ = request.Write(decodeHexStream(t, "510000000d53454c454354207800"))
+	_, _ = response.Write(decodeHexStream(t, "450000002c534552524f5200433432373033004d636f6c756d6e207820646f6573206e6f7420657869737400005a0000000545"))
+	clock.advance(2 * time.Millisecond)
+	_, _ = request.Write(decodeHexStream(t, "510000000d524f4c4c4241434b00"))
+	_, _ = response.Write(decodeHexStream(t, "430000000d524f4c4c4241434b005a0000000549"))
+
+	// Q "BEGIN; ROLLBACK" doesn't leave idle state at all.
+	_, _ = request.Write(decodeHexStream(t, "5100000014424547494e3b20524f4c4c4241434b00"))
+	_, _ = response.Write(decodeHexStream(t, "430000000a424547494e00430000000d524f4c4c4241434b005a0000000549"))
+
+	// Q "BEGIN", Q "ROLLBACK"
+	_, _ = request.Write(decodeHexStream(t, "510000000a424547494e00"))
+	_, _ = response.Write(decodeHexStream(t, "430000000a424547494e005a0000000554"))
+	_, _ = request.Write(decodeHexStream(t, "510000000d524f4c4c4241434b00"))
+	_, _ = response.Write(decodeHexStream(t, "430000000d524f4c4c4241434b005a0000000549"))
+
+	if len(recorder.transactions) != 3 {
+		t.Fatalf("expected 3 transactions, got %d", len(recorder.transactions))
+	}
+
+	committed := recorder.transactions[0]
+	if committed.Outcome != TransactionCommitted {
+		t.Errorf("Outcome = %q, want %q", committed.Outcome, TransactionCommitted)
+	}
+	if !committed.Begin.Equal(start) || committed.Duration != 11*time.Millisecond || committed.IdleDuration != 8*time.Millisecond {
+		t.Errorf("Begin = %v, Duration = %v, IdleDuration = %v", committed.Begin, committed.Duration, committed.IdleDuration)
+	}
+	if got := dumpQueries(committed.Queries); len(committed.Queries) != 3 ||
+		committed.Queries[0].Query != "BEGIN" || committed.Queries[1].Type != "INSERT" || committed.Queries[2].Query != "COMMIT" {
+		t.Errorf("unexpected queries %s", got)
+	}
+
+	failed := recorder.transactions[1]
+	if failed.Outcome != TransactionFailed {
+		t.Errorf("Outcome = %q, want %q", failed.Outcome, TransactionFailed)
+	}
+	if !failed.Begin.Equal(failedStart) || failed.Duration != 2*time.Millisecond || len(failed.Queries) != 3 {
+		t.Errorf("Begin = %v, Duration = %v, queries %s", failed.Begin, failed.Duration, dumpQueries(failed.Queries))
+	}
+
+	if rolledBack := recorder.transactions[2]; rolledBack.Outcome != TransactionRolledBack {
+		t.Errorf("Outcome = %q, want %q", rolledBack.Outcome, TransactionRolledBack)
+	}
+}
+
+func Test_collector_Transaction_Savepoint_Recovery(t *testing.T) {
+	recorder := &transactionRecorder{}
+	request, response := newTestCollectors(recorder, &fakeClock{})
+
+	// Q "BEGIN", Q "SAVEPOINT s", Q "SELECT x" failing, Q "ROLLBACK TO s", Q "COMMIT"
+	_, _ = request.Write(decodeHexStream(t, "510000000a424547494e00"))
+	_, _ = response.Write(decodeHexStream(t, "430000000a424547494e005a0000000554"))
+	_, _ = request.Write(decodeHexStream(t, "510000001053415645504f494e54207300"))
+	_, _ = response.Write(decodeHexStream(t, "430000000e53415645504f494e54005a0000000554"))
+	_, _ = request.Write(decodeHexStream(t, "510000000d53454c454354207800"))
+	_, _ = response.Write(decodeHexStream(t, "450000002c534552524f5200433432373033004d636f6c756d6e207820646f6573206e6f7420657869737400005a0000000545"))
+	_, _ = request.Write(decodeHexStream(t, "5100000012524f4c4c4241434b20544f207300"))
+	_, _ = response.Write(decodeHexStream(t, "430000000d524f4c4c4241434b005a0000000554"))
+	_, _ = request.Write(decodeHexStream(t, "510000000b434f4d4d495400"))
+	_, _ = response.Write(decodeHexStream(t, "430000000b434f4d4d4954005a0000000549"))
+
+	// Q "BEGIN", Q "SELECT x" failing, Q "ROLLBACK TO s; COMMIT"
+	_, _ = request.Write(decodeHexStream(t, "510000000a424547494e00"))
+	_, _ = response.Write(decodeHexStream(t, "430000000a424547494e005a0000000554"))
+	_, _ = request.Write(decodeHexStream(t, "510000000d53454c454354207800"))
+	_, _ = response.Write(decodeHexStream(t, "450000002c534552524f5200433432373033004d636f6c756d6e207820646f6573206e6f7420657869737400005a0000000545"))
+	_, _ = request.Write(decodeHexStream(t, "510000001a524f4c4c4241434b20544f20733b20434f4d4d495400"))
+	_, _ = response.Write(decodeHexStream(t, "430000000d524f4c4c4241434b00"+"430000000b434f4d4d4954005a0000000549"))
+
+	// Q "BEGIN", Q "SELECT x" failing, Q "COMMIT" answered with ROLLBACK
+	_, _ = request.Write(decodeHexStream(t, "510000000a424547494e00"))
+	_, _ = response.Write(decodeHexStream(t, "430000000a424547494e005a0000000554"))
+	_, _ = request.Write(decodeHexStream(t, "510000000d53454c454354207800"))
+	_, _ = response.Write(decodeHexStream(t, "450000002c534552524f5200433432373033004d636f6c756d6e207820646f6573206e6f7420657869737400005a0000000545"))
+	_, _ = request.Write(decodeHexStream(t, "510000000b434f4d4d495400"))
+	_, _ = response.Write(decodeHexStream(t, "430000000d524f4c4c4241434b005a0000000549"))
+
+	want := []TransactionOutcome{TransactionCommitted, TransactionCommitted, TransactionFailed}
+	var got []TransactionOutcome
+	for _, tx := range recorder.transactions {
+		got = append(got, tx.Outcome)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("outcomes = %v, want %v", got, want)
+	}
+	if queries := recorder.transactions[0].Queries; len(queries) != 5 {
+		t.Errorf("unexpected queries %s", dumpQueries(queries))
+	}
+}
+
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+	// closed receives ConnectionClosed events.
+	closed chan *ConnectionClosed
+}
+
+func newEventRecorder() *eventRecorder {
+	return &eventRecorder{closed: make(chan *ConnectionClosed, 16)}
+}
+
+func (r *eventRecorder) WriteEvent(e Event) {
+	r.mu.Lock()
+	r.events = append(r.events, e)
+	r.mu.Unlock()
+	if closed, ok := e.(*ConnectionClosed); ok {
+		r.closed <- closed
+	}
+}
+
+func (r *eventRecorder) types() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var types []string
+	for _, e := range r.events {
+		types = append(types, reflect.TypeOf(e).Elem().Name())
+	}
+	return types
+}
+
+func (r *eventRecorder) waitClosed(t *testing.T) *ConnectionClosed {
+	select {
+	case closed := <-r.closed:
+		return closed
+	case <-time.After(5 * time.Second):
+		t.Fatal("ConnectionClosed wasn't written")
+		return nil
+	}
+}
+
+func Test_Proxy_Connection_Events(t *testing.T) {
+	backend := startTestBackend(t)
+	recorder := newEventRecorder()
+	proxy := NewEventProxy(recorder).To(backend.Addr().String())
+	addr, _ := startTestProxy(t, proxy)
+	defer proxy.Shutdown(context.Background())
+
+	client := connectTestClient(t, addr, true)
+	_ = client.Close()
+
+	closed := recorder.waitClosed(t)
+	if closed.Reason != CloseByClient || closed.Err != nil {
+		t.Errorf("Reason = %q, Err = %v, want %q and nil", closed.Reason, closed.Err, CloseByClient)
+	}
+	if closed.BytesFromClient != 27 || closed.BytesFromServer != 15 {
+		t.Errorf("BytesFromClient = %d, BytesFromServer = %d, want 27 and 15", closed.BytesFromClient, closed.BytesFromServer)
+	}
+	if closed.Session.ConnID != 1 || closed.Session.User != "u" || closed.Session.Database != "d" {
+		t.Errorf("unexpected Session %+v", closed.Session)
+	}
+	want := []string{"ConnectionOpened", "AuthenticationSucceeded", "ConnectionClosed"}
+	if got := recorder.types(); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+	if auth := recorder.events[1].(*AuthenticationSucceeded); auth.Method != "trust" {
+		t.Errorf("Method = %q, want trust", auth.Method)
+	}
+}
+
+func Test_Proxy_DialFailed(t *testing.T) {
+	// The address of the closed listener refuses connections.
+	backend := startTestBackend(t)
+	_ = backend.Close()
+	recorder := newEventRecorder()
+	proxy := NewEventProxy(recorder).To(backend.Addr().String())
+	addr, _ := startTestProxy(t, proxy)
+	defer proxy.Shutdown(context.Background())
+
+	connectTestClient(t, addr, false)
+
+	closed := recorder.waitClosed(t)
+	if closed.Reason != CloseByDialFailure || closed.Err == nil {
+		t.Errorf("Reason = %q, Err = %v, want %q and an error", closed.Reason, closed.Err, CloseByDialFailure)
+	}
+	want := []string{"ConnectionOpened", "DialFailed", "ConnectionClosed"}
+	if got := recorder.types(); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func Test_collector_Authentication_And_Protocol_Errors(t *testing.T) {
+	recorder := newEventRecorder()
+	session := newSession(NewEventProxy(recorder).Clock((&fakeClock{}).now), SessionInfo{})
+	request, response := newCollector(session, originFrontend, true), newCollector(session, originBackend, true)
+
+	// StartupMessage user=u database=d
+	_, _ = request.Write(decodeHexStream(t, "0000001b0003000075736572007500646174616261736500640000"))
+	// AuthenticationMD5Password, then FATAL ErrorResponse
+	_, _ = response.Write(decodeHexStream(t, "520000000c0000000561626364"))
+	_, _ = response.Write(decodeHexStream(t, "450000004053464154414c00433238503031004d70617373776f72642061757468656e7469636174696f6e206661696c656420666f722075736572202275220000"))
+	// Message with length less than 4 breaks the stream.
+	_, _ = request.Write(decodeHexStream(t, "510000000200"))
+	_, _ = request.Write(decodeHexStream(t, "510000000d53454c454354203100"))
+
+	want := []string{"AuthenticationFailed", "ProtocolError"}
+	if got := recorder.types(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	failed := recorder.events[0].(*AuthenticationFailed)
+	if failed.Method != "md5" || failed.Error.Code != "28P01" || failed.Session.User != "u" {
+		t.Errorf("unexpected AuthenticationFailed %+v", failed)
+	}
+	if protocolError := recorder.events[1].(*ProtocolError); !protocolError.Frontend || protocolError.Err != errInvalidMessageLength {
+		t.Errorf("unexpected ProtocolError %+v", protocolError)
+	}
+}
+
+func Test_collector_Skips_Malformed_Messages(t *testing.T) {
+	recorder := newEventRecorder()
+	session := newSession(NewEventProxy(recorder).Clock((&fakeClock{}).now), SessionInfo{})
+	request, response := newCollector(session, originFrontend, false), newCollector(session, originBackend, false)
+
+	// Sync with a body, then Q "SELECT 1"
+	_, _ = request.Write(decodeHexStream(t, "530000000500"))
+	_, _ = request.Write(decodeHexStream(t, "510000000d53454c454354203100"))
+	// ReadyForQuery of invalid length, CommandComplete "SELECT 1", ReadyForQuery
+	_, _ = response.Write(decodeHexStream(t, "5a000000064900"))
+	_, _ = response.Write(decodeHexStream(t, "430000000d53454c454354203100"+"5a0000000549"))
+
+	want := []string{"ProtocolError", "ProtocolError", "Query"}
+	if got := recorder.types(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	for i, frontend := range []bool{true, false} {
+		protocolError := recorder.events[i].(*ProtocolError)
+		if protocolError.Frontend != frontend || !errors.Is(protocolError.Err, ErrMalformedMessage) {
+			t.Errorf("unexpected ProtocolError %+v", protocolError)
+		}
+	}
+	if q := recorder.events[2].(*Query); q.Query != "SELECT 1" || q.RowsAffected != 1 {
+		t.Errorf("unexpected Query %+v", q)
+	}
+}
+
+func Test_collector_Unknown_Statements_Replace_Known_Ones(t *testing.T) {
+	recorder := newEventRecorder()
+	session := newSession(NewEventProxy(recorder).Clock((&fakeClock{}).now).MaxFieldSize(20), SessionInfo{})
+	request, response := newCollector(session, originFrontend, false), newCollector(session, originBackend, false)
+
+	// The unnamed statement "SELECT 1" is parsed, bound and executed:
+	// Parse, Bind, Execute, Sync, then ParseComplete, BindComplete, CommandComplete, ReadyForQuery.
+	execute := "420000000c0000000000000000" + "45000000090000000000" + "5300000004"
+	_, _ = request.Write(decodeHexStream(t, "50000000100053454c4543542031000000"+execute))
+	_, _ = response.Write(decodeHexStream(t, "31000000043200000004430000000d53454c4543542031005a0000000549"))
+	// "DELETE FROM t WHERE id = 42" is longer than the field limit, its response is DELETE 1.
+	_, _ = request.Write(decodeHexStream(t, "50000000230044454c4554452046524f4d2074205748455245206964203d203432000000"+execute))
+	_, _ = response.Write(decodeHexStream(t, "31000000043200000004430000000d44454c4554452031005a0000000549"))
+	// Parse with a parameter count beyond its end.
+	_, _ = request.Write(decodeHexStream(t, "50000000150044454c4554452046524f4d2074000005"+execute))
+	_, _ = response.Write(decodeHexStream(t, "31000000043200000004430000000d44454c4554452031005a0000000549"))
+	// Q "DELETE FROM t" without the terminating zero byte.
+	_, _ = request.Write(decodeHexStream(t, "510000001144454c4554452046524f4d2074"))
+	_, _ = response.Write(decodeHexStream(t, "430000000d44454c4554452031005a0000000549"))
+
+	want := []string{"Query", "ProtocolError", "Query", "ProtocolError", "Query", "ProtocolError", "Query"}
+	if got := recorder.types(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	if protocolError := recorder.events[1].(*ProtocolError); !errors.Is(protocolError.Err, ErrFieldTooLong) {
+		t.Errorf("unexpected ProtocolError %+v", protocolError)
+	}
+	for i, query := range []string{"SELECT 1", "DELETE FROM t WHERE " + truncatedMark, "", ""} {
+		if q := recorder.events[i*2].(*Query); q.Query != query {
+			t.Errorf("Query %d = %q, want %q", i, q.Query, query)
+		}
+	}
+	for i, typ := range []string{"SELECT", "DELETE", "DELETE", "DELETE"} {
+		if q := recorder.events[i*2].(*Query); q.Type != typ {
+			t.Errorf("Query %d has type %q, want %q", i, q.Type, typ)
+		}
+	}
+	if len(session.pending) != 0 {
+		t.Errorf("session left %d pending states, want 0", len(session.pending))
+	}
+}
+
+func Test_collector_Message_Too_Long(t *testing.T) {
+	recorder := newEventRecorder()
+	session := newSession(NewEventProxy(recorder).Clock((&fakeClock{}).now).MaxMessageSize(8), SessionInfo{})
+	request := newCollector(session, originFrontend, false)
+
+	// Q "SELECT 1" is longer than the message limit, so nothing after it is observed.
+	_, _ = request.Write(decodeHexStream(t, "510000000d53454c454354203100"))
+	_, _ = request.Write(decodeHexStream(t, "5300000004"))
+
+	want := []string{"ProtocolError"}
+	if got := recorder.types(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	if protocolError := recorder.events[0].(*ProtocolError); !protocolError.Frontend || protocolError.Err != errMessageTooLong {
+		t.Errorf("unexpected ProtocolError %+v", protocolError)
+	}
+}
@@ -0,0 +1,137 @@
+package postgresql
+
+import (
+	"strings"
+	"time"
+)
+
+// preparedStatement is a statement created by Parse message.
+type preparedStatement struct {
+	query string
+	// oids are the types of statement parameters. They come either from Parse message
+	// or from ParameterDescription sent in response to Describe of the statement.
+	oids []oid
+	// parsed is the moment Parse message arrived from frontend.
+	parsed time.Time
+	// executed is true if the statement was executed at least once since it was parsed.
+	executed bool
+}
+
+// portal is a prepared statement bound to its parameters by Bind message.
+type portal struct {
+	statement *preparedStatement
+	bind      *bindMessage
+	// bound is the moment Bind message arrived from frontend.
+	bound time.Time
+}
+
+// registry keeps prepared statements and portals which live on a single connection.
+// Drivers often parse a named statement once and then bind and execute it many times,
+// so the registry is what links each execution to the statement's query.
+type registry struct {
+	statements map[string]*preparedStatement
+	portals    map[string]*portal
+}
+
+func newRegistry() *registry {
+	return &registry{
+		statements: make(map[string]*preparedStatement),
+		portals:    make(map[string]*portal),
+	}
+}
+
+// parse creates a prepared statement. Parse to the unnamed statement replaces the previous one.
+func (r *registry) parse(m *parseMessage, now time.Time) *preparedStatement {
+	statement := &preparedStatement{query: m.query, oids: m.oids, parsed: now}
+	r.statements[m.name] = statement
+	return statement
+}
+
+// forget drops the statement named name, which Parse replaced with a statement the session doesn't know.
+// All statements are dropped if the name isn't known either.
+func (r *registry) forget(name string, named bool) {
+	if !named {
+		r.statements = make(map[string]*preparedStatement)
+		return
+	}
+	delete(r.statements, name)
+}
+
+// bind creates a portal for the statement named in m.
+// It returns nil if the statement is unknown, e.g. it was prepared before the proxy saw the connection.
+func (r *registry) bind(m *bindMessage, now time.Time) *portal {
+	statement, ok := r.statements[m.statement]
+	if !ok {
+		delete(r.portals, m.portal)
+		return nil
+	}
+	portal := &portal{statement: statement, bind: m, bound: now}
+	r.portals[m.portal] = portal
+	return portal
+}
+
+// portal returns the portal named name or nil if there is no such portal.
+func (r *registry) portal(name string) *portal {
+	return r.portals[name]
+}
+
+func (r *registry) close(m *closeMessage) {
+	switch m.target {
+	case targetStatement:
+		delete(r.statements, m.name)
+	case targetPortal:
+		delete(r.portals, m.name)
+	}
+}
+
+// simpleQuery drops the unnamed statement and the unnamed portal which are destroyed by Query message.
+func (r *registry) simpleQuery() {
+	delete(r.statements, "")
+	delete(r.portals, "")
+}
+
+// readyForQuery drops all portals once the transaction is over.
+func (r *registry) readyForQuery(m *readyForQueryMessage) {
+	if m.status == 'I' {
+		r.portals = make(map[string]*portal)
+	}
+}
+
+// complete applies effects of the completed SQL command to the registry.
+// Prepared statements created by Parse share the namespace with statements created by PREPARE,
+// so DEALLOCATE and DISCARD ALL drop them as well.
+func (r *registry) complete(command, query string) {
+	switch command {
+	case "DEALLOCATE":
+		name, ok := deallocatedStatement(query)
+		if ok {
+			delete(r.statements, name)
+		}
+	case "DEALLOCATE ALL":
+		r.statements = make(map[string]*preparedStatement)
+	case "DISCARD ALL":
+		r.statements = make(map[string]*preparedStatement)
+		r.portals = make(map[string]*portal)
+	}
+}
+
+// deallocatedStatement returns the name of the statement from "DEALLOCATE [PREPARE] name" query.
+func deallocatedStatement(query string) (string, bool) {
+	fields := strings.Fields(query)
+	if len(fields) > 0 && strings.EqualFold(fields[0], "DEALLOCATE") {
+		fields = fields[1:]
+	}
+	if len(fields) > 0 && strings.EqualFold(fields[0], "PREPARE") {
+		fields = fields[1:]
+	}
+	if len(fields) != 1 {
+		return "", false
+	}
+
+	name := fields[0]
+	// Quoted identifiers are case sensitive, unquoted ones are folded to lower case.
+	if len(name) >= 2 && name[0] == '"' && name[len(name)-1] == '"' {
+		return strings.Replace(name[1:len(name)-1], `""`, `"`, -1), true
+	}
+	return strings.ToLower(name), true
+}
@@ -0,0 +1,24 @@
+package postgresql
+
+import "testing"
+
+func Test_deallocatedStatement(t *testing.T) {
+	tests := []struct {
+		query  string
+		want   string
+		wantOk bool
+	}{
+		{"DEALLOCATE s1", "s1", true},
+		{"deallocate prepare S1", "s1", true},
+		{`DEALLOCATE "S""1"`, `S"1`, true},
+		{"DEALLOCATE", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, ok := deallocatedStatement(tt.query)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("deallocatedStatement() = (%q, %v), want (%q, %v)", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
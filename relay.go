@@ -0,0 +1,318 @@
+package postgresql
+
+import (
+	"io"
+	"sync"
+)
+
+// syntheticResponse is a response Proxy makes up itself in place of the target.
+type syntheticResponse struct {
+	// seq is the number of ReadyForQuery of the target the response follows,
+	// or precedes if beforeReady is true.
+	seq         uint64
+	beforeReady bool
+	// data are the messages sent by an interceptor, if any.
+	data []byte
+	// err is ErrorResponse, if any, and rule is the firewall rule it's caused by.
+	err  []byte
+	rule *Rule
+	// ready is true if the response ends with ReadyForQuery reporting the current transaction status.
+	ready bool
+}
+
+// responseQueue writes the responses of the target to the client along with the responses
+// Proxy makes up itself, putting each of them where the client expects it: after the responses
+// to all messages sent to the target before. Both kinds of responses are fed to the session as well.
+type responseQueue struct {
+	client    io.Writer
+	collector *collector
+
+	// writeMu serializes writes to the client, it's acquired before mu.
+	writeMu sync.Mutex
+	// n is the number of bytes written to the client.
+	n int64
+
+	mu sync.Mutex
+	// sent and completed count the messages sent to the target which are answered with ReadyForQuery
+	// and the ReadyForQuery messages of the target.
+	sent, completed uint64
+	// status is the transaction status from the last ReadyForQuery of the target.
+	status  byte
+	pending []*syntheticResponse
+}
+
+func newResponseQueue(client io.Writer, collector *collector) *responseQueue {
+	return &responseQueue{client: client, collector: collector, status: 'I'}
+}
+
+// sync notes that the target was sent StartupMessage, Query or Sync, which it answers with ReadyForQuery.
+func (q *responseQueue) sync() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.sent++
+}
+
+// add queues the response to be written once the target answers all messages sent to it so far,
+// or right before ReadyForQuery answering the next Sync if beforeNext is true.
+func (q *responseQueue) add(r *syntheticResponse, beforeNext bool) error {
+	q.writeMu.Lock()
+	defer q.writeMu.Unlock()
+
+	q.mu.Lock()
+	r.seq = q.sent
+	if beforeNext {
+		r.seq++
+		r.beforeReady = true
+	}
+	q.pending = append(q.pending, r)
+	var out []byte
+	var messages []interface{}
+	out, messages = q.due(out, messages, false)
+	q.mu.Unlock()
+
+	return q.write(out, messages)
+}
+
+// readyMark locates the output of ReadyForQuery of the target among the messages written to the client,
+// which is empty if an interceptor dropped it.
+type readyMark struct {
+	start, end int
+	status     byte
+}
+
+// forward writes messages of the target to the client, along with the responses which are due.
+// readies locate the output of ReadyForQuery messages of the target in msgs.
+func (q *responseQueue) forward(msgs []byte, readies []readyMark) error {
+	q.writeMu.Lock()
+	defer q.writeMu.Unlock()
+
+	q.mu.Lock()
+	if len(q.pending) == 0 {
+		// Nothing to put in between, but ReadyForQuery is still counted.
+		for _, ready := range readies {
+			q.completed++
+			q.status = ready.status
+		}
+		q.mu.Unlock()
+		return q.write(msgs, nil)
+	}
+
+	var out []byte
+	var messages []interface{}
+	start := 0
+	for _, ready := range readies {
+		// The target's messages up to ReadyForQuery go first, then the responses due before it.
+		out, messages = q.flushTarget(out, messages, msgs[start:ready.start])
+		out, messages = q.due(out, messages, true)
+		out, messages = q.flushTarget(out, messages, msgs[ready.start:ready.end])
+		q.completed++
+		q.status = ready.status
+		out, messages = q.due(out, messages, false)
+		start = ready.end
+	}
+	out, messages = q.flushTarget(out, messages, msgs[start:])
+	q.mu.Unlock()
+
+	return q.write(out, messages)
+}
+
+// flushTarget appends raw messages, which are fed to the session through the collector
+// and are represented by []byte in messages.
+func (q *responseQueue) flushTarget(out []byte, messages []interface{}, msgs []byte) ([]byte, []interface{}) {
+	if len(msgs) == 0 {
+		return out, messages
+	}
+	out = append(out, msgs...)
+	return out, append(messages, msgs)
+}
+
+// due appends the queued responses which can be written now: the ones preceding the next
+// ReadyForQuery of the target if beforeReady is true, or the ones following all the answered messages.
+// It must be called with q.mu held.
+func (q *responseQueue) due(out []byte, messages []interface{}, beforeReady bool) ([]byte, []interface{}) {
+	for len(q.pending) > 0 {
+		r := q.pending[0]
+		if beforeReady != r.beforeReady {
+			break
+		}
+		if (beforeReady && r.seq != q.completed+1) || (!beforeReady && r.seq > q.completed) {
+			break
+		}
+		q.pending = q.pending[1:]
+		out, messages = q.flushTarget(out, messages, r.data)
+		if r.err != nil {
+			out = append(out, r.err...)
+			m := decodeErrorMessage(r.err)
+			m.rule = r.rule
+			messages = append(messages, m)
+		}
+		if r.ready {
+			out = append(out, encodeMessage(readyForQueryMessageType, []byte{q.status})...)
+			messages = append(messages, &readyForQueryMessage{status: q.status})
+		}
+	}
+	return out, messages
+}
+
+// write writes out to the client and then feeds the messages to the session.
+// Raw messages of the target go through the collector, decoded ones straight to the session.
+// It must be called with q.writeMu held.
+func (q *responseQueue) write(out []byte, messages []interface{}) error {
+	if len(out) == 0 {
+		return nil
+	}
+	n, err := q.client.Write(out)
+	q.n += int64(n)
+	if messages == nil {
+		_, _ = q.collector.Write(out)
+		return err
+	}
+	for _, m := range messages {
+		if raw, ok := m.([]byte); ok {
+			_, _ = q.collector.Write(raw)
+			continue
+		}
+		q.collector.session.backend([]interface{}{m})
+	}
+	return err
+}
+
+// raw writes messages which don't answer anything sent to the target, e.g. the ones completing the startup.
+func (q *responseQueue) raw(msgs []byte) error {
+	q.writeMu.Lock()
+	defer q.writeMu.Unlock()
+	return q.write(msgs, nil)
+}
+
+// written returns the number of bytes written to the client.
+func (q *responseQueue) written() int64 {
+	q.writeMu.Lock()
+	defer q.writeMu.Unlock()
+	return q.n
+}
+
+// requestRelay frames the stream of the client and passes it on to the target message by message,
+// so that interceptors can change messages and Firewall can block them before the target receives them.
+type requestRelay struct {
+	server    io.Writer
+	framer    *framer
+	collector *collector
+	chain     *interceptorChain
+	// guard is nil unless Proxy has Firewall.
+	guard     *guard
+	responses *responseQueue
+	// out are the messages of the current write passed on to the target.
+	out []byte
+	// intercepted are the messages the interceptors produced from the current message.
+	intercepted, toClient []byte
+	err                   error
+}
+
+func (r *requestRelay) Write(p []byte) (int, error) {
+	r.out = r.out[:0]
+	r.framer.write(p, r.relay)
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.framer.err != nil {
+		r.collector.session.protocolError(true, r.framer.err)
+		return 0, r.framer.err
+	}
+	if len(r.out) > 0 {
+		if _, err := r.server.Write(r.out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (r *requestRelay) relay(msg []byte) {
+	if r.err != nil {
+		return
+	}
+	// The session learns about every message the client sends, since it expects responses
+	// the way the client gets them.
+	_, _ = r.collector.Write(msg)
+
+	typed := r.framer.mode == framerTyped
+	r.intercepted, r.toClient = r.chain.frontend(msg, typed, r.intercepted[:0], r.toClient[:0])
+	if len(r.toClient) > 0 {
+		if r.err = r.responses.add(&syntheticResponse{data: append([]byte(nil), r.toClient...)}, false); r.err != nil {
+			return
+		}
+	}
+
+	if !typed {
+		// StartupMessage is answered with ReadyForQuery, CancelRequest isn't answered at all.
+		if isStartupMessage(msg) {
+			r.responses.sync()
+		}
+		r.out = append(r.out, r.intercepted...)
+		return
+	}
+	forEachMessage(r.intercepted, r.send)
+}
+
+// send passes the message on to the target unless Firewall blocks it.
+func (r *requestRelay) send(msg []byte) {
+	if r.err != nil {
+		return
+	}
+	if r.guard != nil {
+		pass, response, beforeNext := r.guard.check(msg)
+		if !pass {
+			if response != nil {
+				r.err = r.responses.add(response, beforeNext)
+			}
+			return
+		}
+	}
+	if msg[0] == queryMessageType || msg[0] == syncMessageType {
+		r.responses.sync()
+	}
+	r.out = append(r.out, msg...)
+}
+
+// responseRelay frames the stream of the target and writes it to the client through responseQueue,
+// so that interceptors can change messages before the client receives them.
+type responseRelay struct {
+	server    io.Writer
+	framer    *framer
+	chain     *interceptorChain
+	responses *responseQueue
+	// out are the messages of the current write passed on to the client and readies locate
+	// ReadyForQuery messages among them.
+	out     []byte
+	readies []readyMark
+	// toServer are the messages the interceptors sent to the target.
+	toServer []byte
+}
+
+func (r *responseRelay) Write(p []byte) (int, error) {
+	r.out, r.readies, r.toServer = r.out[:0], r.readies[:0], r.toServer[:0]
+	r.framer.write(p, func(msg []byte) {
+		start := len(r.out)
+		r.out, r.toServer = r.chain.backend(msg, r.out, r.toServer)
+		if isReadyForQueryMessage(msg) {
+			r.readies = append(r.readies, readyMark{start: start, end: len(r.out), status: msg[minPacketLen]})
+		}
+	})
+	if r.framer.err != nil {
+		r.responses.collector.session.protocolError(false, r.framer.err)
+		return 0, r.framer.err
+	}
+	if len(r.toServer) > 0 {
+		forEachMessage(r.toServer, func(msg []byte) {
+			if msg[0] == queryMessageType || msg[0] == syncMessageType {
+				r.responses.sync()
+			}
+		})
+		if _, err := r.server.Write(r.toServer); err != nil {
+			return 0, err
+		}
+	}
+	if err := r.responses.forward(r.out, r.readies); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,266 @@
+package postgresql
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// scramMechanism is the only SASL mechanism PostgreSQL supports without channel binding.
+const scramMechanism = "SCRAM-SHA-256"
+
+// scramIterations is the iteration count of verifiers derived from passwords, the same as backend uses.
+const scramIterations = 4096
+
+var errSCRAMAuthentication = errors.New("postgresql: SCRAM authentication failed")
+
+// scramVerifier is what is needed to check SCRAM-SHA-256 proof of a password without the password itself.
+// See https://datatracker.ietf.org/doc/html/rfc5802
+type scramVerifier struct {
+	iterations int
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+}
+
+// newSCRAMVerifier derives the verifier of the password.
+func newSCRAMVerifier(password string, salt []byte, iterations int) *scramVerifier {
+	salted := pbkdf2SHA256([]byte(password), salt, iterations)
+	return &scramVerifier{
+		iterations: iterations,
+		salt:       salt,
+		storedKey:  sha256Sum(hmacSHA256(salted, "Client Key")),
+		serverKey:  hmacSHA256(salted, "Server Key"),
+	}
+}
+
+// parseSCRAMVerifier parses the verifier in the format of pg_authid:
+// SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+func parseSCRAMVerifier(s string) (*scramVerifier, bool) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 3 || parts[0] != scramMechanism {
+		return nil, false
+	}
+	iterSalt := strings.SplitN(parts[1], ":", 2)
+	keys := strings.SplitN(parts[2], ":", 2)
+	if len(iterSalt) != 2 || len(keys) != 2 {
+		return nil, false
+	}
+
+	iterations, err := strconv.Atoi(iterSalt[0])
+	if err != nil || iterations <= 0 {
+		return nil, false
+	}
+	salt, err := base64.StdEncoding.DecodeString(iterSalt[1])
+	if err != nil {
+		return nil, false
+	}
+	storedKey, err := base64.StdEncoding.DecodeString(keys[0])
+	if err != nil || len(storedKey) != sha256.Size {
+		return nil, false
+	}
+	serverKey, err := base64.StdEncoding.DecodeString(keys[1])
+	if err != nil || len(serverKey) != sha256.Size {
+		return nil, false
+	}
+	return &scramVerifier{iterations: iterations, salt: salt, storedKey: storedKey, serverKey: serverKey}, true
+}
+
+// verifyPassword returns true if the verifier is derived from password.
+func (v *scramVerifier) verifyPassword(password string) bool {
+	derived := newSCRAMVerifier(password, v.salt, v.iterations)
+	return hmac.Equal(derived.storedKey, v.storedKey)
+}
+
+// scramServer is the server side of SCRAM-SHA-256 exchange.
+type scramServer struct {
+	verifier *scramVerifier
+	// nonce is the server part of the nonce.
+	nonce string
+
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+}
+
+func newSCRAMServer(verifier *scramVerifier, nonce string) *scramServer {
+	return &scramServer{verifier: verifier, nonce: nonce}
+}
+
+// first handles client-first-message and returns server-first-message.
+func (s *scramServer) first(clientFirst string) (string, error) {
+	// gs2-header is the channel binding flag and the authorization identity, each followed by a comma.
+	parts := strings.SplitN(clientFirst, ",", 3)
+	if len(parts) != 3 {
+		return "", fmt.Errorf("%w: malformed client-first-message", errSCRAMAuthentication)
+	}
+	switch {
+	case parts[0] == "n", parts[0] == "y":
+	case strings.HasPrefix(parts[0], "p="):
+		return "", fmt.Errorf("%w: channel binding isn't supported", errSCRAMAuthentication)
+	default:
+		return "", fmt.Errorf("%w: malformed client-first-message", errSCRAMAuthentication)
+	}
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+
+	clientNonce, ok := scramAttribute(s.clientFirstBare, 'r')
+	if !ok || clientNonce == "" {
+		return "", fmt.Errorf("%w: client nonce missing", errSCRAMAuthentication)
+	}
+	s.nonce = clientNonce + s.nonce
+	s.serverFirst = "r=" + s.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(s.verifier.salt) +
+		",i=" + strconv.Itoa(s.verifier.iterations)
+	return s.serverFirst, nil
+}
+
+// final verifies the proof of client-final-message and returns server-final-message.
+func (s *scramServer) final(clientFinal string) (string, error) {
+	i := strings.LastIndex(clientFinal, ",p=")
+	if i < 0 {
+		return "", fmt.Errorf("%w: client proof missing", errSCRAMAuthentication)
+	}
+	withoutProof := clientFinal[:i]
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[i+len(",p="):])
+	if err != nil || len(proof) != sha256.Size {
+		return "", fmt.Errorf("%w: malformed client proof", errSCRAMAuthentication)
+	}
+
+	binding, _ := scramAttribute(withoutProof, 'c')
+	if binding != base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) {
+		return "", fmt.Errorf("%w: channel binding mismatch", errSCRAMAuthentication)
+	}
+	if nonce, _ := scramAttribute(withoutProof, 'r'); nonce != s.nonce {
+		return "", fmt.Errorf("%w: nonce mismatch", errSCRAMAuthentication)
+	}
+
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+	clientKey := xorBytes(proof, hmacSHA256(s.verifier.storedKey, authMessage))
+	if subtle.ConstantTimeCompare(sha256Sum(clientKey), s.verifier.storedKey) != 1 {
+		return "", errSCRAMAuthentication
+	}
+	return "v=" + base64.StdEncoding.EncodeToString(hmacSHA256(s.verifier.serverKey, authMessage)), nil
+}
+
+// scramClient is the client side of SCRAM-SHA-256 exchange.
+type scramClient struct {
+	user     string
+	password string
+	nonce    string
+
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func newSCRAMClient(user, password, nonce string) *scramClient {
+	return &scramClient{user: user, password: password, nonce: nonce}
+}
+
+// first returns client-first-message. Backend ignores the user name in favour of the one from StartupMessage.
+func (c *scramClient) first() string {
+	c.clientFirstBare = "n=" + c.user + ",r=" + c.nonce
+	return "n,," + c.clientFirstBare
+}
+
+// final handles server-first-message and returns client-final-message.
+func (c *scramClient) final(serverFirst string) (string, error) {
+	nonce, ok := scramAttribute(serverFirst, 'r')
+	if !ok || !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return "", fmt.Errorf("%w: invalid server nonce", errSCRAMAuthentication)
+	}
+	encodedSalt, _ := scramAttribute(serverFirst, 's')
+	salt, err := base64.StdEncoding.DecodeString(encodedSalt)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid salt", errSCRAMAuthentication)
+	}
+	iterations, _ := scramAttribute(serverFirst, 'i')
+	n, err := strconv.Atoi(iterations)
+	if err != nil || n <= 0 {
+		return "", fmt.Errorf("%w: invalid iteration count", errSCRAMAuthentication)
+	}
+
+	salted := pbkdf2SHA256([]byte(c.password), salt, n)
+	clientKey := hmacSHA256(salted, "Client Key")
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte("n,,")) + ",r=" + nonce
+	authMessage := c.clientFirstBare + "," + serverFirst + "," + withoutProof
+	proof := xorBytes(clientKey, hmacSHA256(sha256Sum(clientKey), authMessage))
+	c.serverSignature = hmacSHA256(hmacSHA256(salted, "Server Key"), authMessage)
+
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verify checks the server signature of server-final-message.
+func (c *scramClient) verify(serverFinal string) error {
+	if e, ok := scramAttribute(serverFinal, 'e'); ok {
+		return fmt.Errorf("%w: %s", errSCRAMAuthentication, e)
+	}
+	v, _ := scramAttribute(serverFinal, 'v')
+	signature, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || !hmac.Equal(signature, c.serverSignature) {
+		return fmt.Errorf("%w: invalid server signature", errSCRAMAuthentication)
+	}
+	return nil
+}
+
+// scramAttribute returns the value of the attribute of SCRAM message.
+func scramAttribute(message string, name byte) (string, bool) {
+	for _, attr := range strings.Split(message, ",") {
+		if len(attr) >= 2 && attr[0] == name && attr[1] == '=' {
+			return attr[2:], true
+		}
+	}
+	return "", false
+}
+
+// scramNonce returns a new random nonce.
+func scramNonce() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// pbkdf2SHA256 is PBKDF2 with HMAC-SHA-256 producing a single block, which is Hi() of RFC 5802.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func hmacSHA256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+func sha256Sum(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
+
+func xorBytes(a, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+	return result
+}
@@ -0,0 +1,91 @@
+package postgresql
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// The exchange from https://datatracker.ietf.org/doc/html/rfc7677#section-3
+const (
+	rfc7677ClientNonce = "rOprNGfwEbeRWgbNEkqO"
+	rfc7677ServerNonce = "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	rfc7677Salt        = "W22ZaJ0SNY7soEsUEjb6gQ=="
+	rfc7677ClientFirst = "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"
+	rfc7677ServerFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	rfc7677ClientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	rfc7677ServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+func Test_scramClient(t *testing.T) {
+	c := newSCRAMClient("user", "pencil", rfc7677ClientNonce)
+	if got := c.first(); got != rfc7677ClientFirst {
+		t.Errorf("first() = %q, want %q", got, rfc7677ClientFirst)
+	}
+	got, err := c.final(rfc7677ServerFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != rfc7677ClientFinal {
+		t.Errorf("final() = %q, want %q", got, rfc7677ClientFinal)
+	}
+	if err := c.verify(rfc7677ServerFinal); err != nil {
+		t.Errorf("verify() error = %v", err)
+	}
+	if err := c.verify("v=AAAA"); err == nil {
+		t.Error("verify() of invalid signature expected to fail")
+	}
+}
+
+func Test_scramServer(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString(rfc7677Salt)
+	tests := []struct {
+		name        string
+		password    string
+		clientFinal string
+		wantErr     bool
+	}{
+		{"Valid_Proof", "pencil", rfc7677ClientFinal, false},
+		{"Wrong_Password", "pen", rfc7677ClientFinal, true},
+		{"Wrong_Nonce", "pencil", "c=biws,r=rOprNGfwEbeRWgbNEkqO,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", true},
+		{"Without_Proof", "pencil", "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSCRAMServer(newSCRAMVerifier(tt.password, salt, 4096), rfc7677ServerNonce)
+			serverFirst, err := s.first(rfc7677ClientFirst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if serverFirst != rfc7677ServerFirst {
+				t.Errorf("first() = %q, want %q", serverFirst, rfc7677ServerFirst)
+			}
+			serverFinal, err := s.final(tt.clientFinal)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("final() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && serverFinal != rfc7677ServerFinal {
+				t.Errorf("final() = %q, want %q", serverFinal, rfc7677ServerFinal)
+			}
+		})
+	}
+}
+
+func Test_parseSCRAMVerifier(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString(rfc7677Salt)
+	derived := newSCRAMVerifier("pencil", salt, 4096)
+	s := "SCRAM-SHA-256$4096:" + rfc7677Salt + "$" +
+		base64.StdEncoding.EncodeToString(derived.storedKey) + ":" + base64.StdEncoding.EncodeToString(derived.serverKey)
+
+	v, ok := parseSCRAMVerifier(s)
+	if !ok {
+		t.Fatalf("parseSCRAMVerifier(%q) failed", s)
+	}
+	if !v.verifyPassword("pencil") || v.verifyPassword("pen") {
+		t.Error("verifyPassword() doesn't match the password the verifier was derived from")
+	}
+	for _, invalid := range []string{"pencil", "md5a3556571e93b0d20722ba62be61e8c2d", "SCRAM-SHA-256$x:" + rfc7677Salt + "$a:b"} {
+		if _, ok := parseSCRAMVerifier(invalid); ok {
+			t.Errorf("parseSCRAMVerifier(%q) expected to fail", invalid)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package postgresql
+
+import (
+	"sync"
+	"time"
+)
+
+// Kinds of frontend requests the session waits backend responses to.
+const (
+	// pendingParse waits for ParseComplete.
+	pendingParse = iota + 1
+	// pendingBind waits for BindComplete.
+	pendingBind
+	// pendingDescribe waits for RowDescription or NoData, which may be preceded by ParameterDescription.
+	pendingDescribe
+	// pendingExecute waits for CommandComplete, EmptyQueryResponse or PortalSuspended.
+	pendingExecute
+	// pendingClose waits for CloseComplete.
+	pendingClose
+	// pendingStatement waits for CommandComplete or EmptyQueryResponse to a single statement of Query message.
+	pendingStatement
+	// pendingSync waits for ReadyForQuery, which ends Query message or the extended query batch.
+	pendingSync
+)
+
+// state is a frontend request waiting for backend response.
+type state struct {
+	kind int
+	// query is the text of the single statement this state is waiting a completion for.
+	query string
+	// begin is the moment the statement arrived from frontend.
+	begin time.Time
+	// executed is the moment Execute message for the statement arrived from frontend.
+	executed time.Time
+	// firstRow is the moment the first DataRow message arrived from backend.
+	firstRow time.Time
+	// statement is the prepared statement targeted by Describe message.
+	statement *preparedStatement
+	// portal is set if the state waits for completion of Execute message.
+	portal *portal
+	// notices are warnings and other notices raised by the statement.
+	notices []*PgError
+	// copy is set once the statement starts COPY FROM STDIN or COPY TO STDOUT.
+	copy *copyState
+}
+
+// SessionInfo describes the client connection a statement was executed on.
+type SessionInfo struct {
+	// ConnID identifies the connection among all connections served by Proxy.
+	ConnID uint32
+	// ClientAddr is the network address of the client.
+	ClientAddr string
+	// User, Database, ApplicationName, Options and Replication are the parameters
+	// the client sent in StartupMessage. ApplicationName follows changes reported by backend.
+	User            string
+	Database        string
+	ApplicationName string
+	Options         string
+	Replication     string
+	// ServerVersion is the version backend reported after authentication.
+	ServerVersion string
+	// BackendPID is the process ID of the backend serving the connection.
+	BackendPID uint32
+}
+
+// session is the protocol state machine of a single proxied connection.
+// Frontend messages are fed to it by the request collector and backend messages by the response collector,
+// which run in different goroutines, so all its methods are safe for concurrent use.
+//
+// Each frontend message which backend answers to becomes a pending state. Backend answers
+// in the order requests were sent, so the oldest pending state is the one each response belongs to.
+// See https://www.postgresql.org/docs/current/protocol-flow.html
+type session struct {
+	proxy *Proxy
+
+	mu       sync.Mutex
+	registry *registry
+	pending  []*state
+	// status is the transaction status from the last ReadyForQuery.
+	// It's zero until backend gets ready for the first query.
+	status       byte
+	info         SessionInfo
+	transactions transactionTracker
+	copies       copyTracker
+	// authenticating is true from StartupMessage till backend either accepts or rejects the client.
+	authenticating bool
+	// authMethod is the authentication method backend requested.
+	authMethod string
+}
+
+func newSession(p *Proxy, info SessionInfo) *session {
+	return &session{proxy: p, registry: newRegistry(), info: info}
+}
+
+// frontend handles messages sent by frontend. They must be handled before backend receives them,
+// otherwise the response may arrive before the session knows about the request.
+func (s *session) frontend(messages []interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, message := range messages {
+		now := s.proxy.now()
+		s.transactions.request(now)
+		switch m := message.(type) {
+		case *startupMessage:
+			s.authenticating = true
+			s.info.User = m.params["user"]
+			s.info.Database = m.params["database"]
+			// Database defaults to the user name.
+			if s.info.Database == "" {
+				s.info.Database = s.info.User
+			}
+			s.info.ApplicationName = m.params["application_name"]
+			s.info.Options = m.params["options"]
+			s.info.Replication = m.params["replication"]
+		case *parseMessage:
+			s.registry.parse(m, now)
+			s.push(&state{kind: pendingParse, query: m.query, begin: now})
+		case *bindMessage:
+			query := ""
+			if portal := s.registry.bind(m, now); portal != nil {
+				query = portal.statement.query
+			}
+			s.push(&state{kind: pendingBind, query: query, begin: now})
+		case *describeMessage:
+			state := &state{kind: pendingDescribe, begin: now}
+			if m.target == targetStatement {
+				state.statement = s.registry.statements[m.name]
+			} else if portal := s.registry.portal(m.name); portal != nil {
+				state.statement = portal.statement
+			}
+			if state.statement != nil {
+				state.query = state.statement.query
+			}
+			s.push(state)
+		case *executeMessage:
+			state := &state{kind: pendingExecute, executed: now, begin: now}
+			// Execution of a statement begins with its Parse if that's the first execution
+			// after it was parsed, otherwise it begins with Bind.
+			if portal := s.registry.portal(m.portal); portal != nil {
+				state.query = portal.statement.query
+				state.portal = portal
+				state.begin = portal.bound
+				if !portal.statement.executed {
+					state.begin = portal.statement.parsed
+					portal.statement.executed = true
+				}
+			}
+			s.push(state)
+		case *closeMessage:
+			s.registry.close(m)
+			s.push(&state{kind: pendingClose, begin: now})
+		case *syncMessage:
+			s.push(&state{kind: pendingSync, begin: now})
+		case *queryMessage:
+			s.registry.simpleQuery()
+			// Simple query may contain several statements and backend responds
+			// with CommandComplete or ErrorResponse to each of them before ReadyForQuery.
+			// Only the first statement starts right now, each next one starts
+			// when the previous one completes.
+			for i, statement := range splitStatements(m.query) {
+				state := &state{kind: pendingStatement, query: statement}
+				if i == 0 {
+					state.begin = now
+					state.executed = now
+				}
+				s.push(state)
+			}
+			s.push(&state{kind: pendingSync, begin: now})
+		case *undecodedMessage:
+			// The statement is unknown, but backend answers the message all the same.
+			if m.msgType == parseMessageType {
+				s.registry.forget(m.name, m.named)
+				s.push(&state{kind: pendingParse, begin: now})
+				continue
+			}
+			s.registry.simpleQuery()
+			s.push(&state{kind: pendingStatement, begin: now, executed: now})
+			s.push(&state{kind: pendingSync, begin: now})
+		case *copyDataMessage, *copyDoneMessage, *copyFailMessage:
+			s.copies.frontend(m, now)
+		}
+	}
+}
+
+// backend handles messages sent by backend.
+func (s *session) backend(messages []interface{}) {
+	var events []Event
+
+	s.mu.Lock()
+	for _, message := range messages {
+		now := s.proxy.now()
+		front := s.front()
+		switch m := message.(type) {
+		case *authenticationMessage:
+			if m.code != authenticationOk {
+				if method := authenticationMethod(m.code); method != "" {
+					s.authMethod = method
+				}
+				continue
+			}
+			method := s.authMethod
+			if method == "" {
+				method = "trust"
+			}
+			s.authenticating = false
+			events = append(events, &AuthenticationSucceeded{Session: s.info, Time: now, Method: method})
+		case *parameterStatusMessage:
+			switch m.name {
+			case "server_version":
+				s.info.ServerVersion = m.value
+			case "application_name":
+				s.info.ApplicationName = m.value
+			}
+		case *backendKeyDataMessage:
+			s.info.BackendPID = m.pid
+		case *parseCompleteMessage:
+			s.pop(pendingParse)
+		case *bindCompleteMessage:
+			s.pop(pendingBind)
+		case *closeCompleteMessage:
+			s.pop(pendingClose)
+		case *parameterDescriptionMessage:
+			if front != nil && front.kind == pendingDescribe && front.statement != nil {
+				front.statement.oids = m.oids
+			}
+		case *rowDescriptionMessage:
+			// RowDescription is also sent before rows of SELECT executed with Query message.
+			s.pop(pendingDescribe)
+		case *noDataMessage:
+			s.pop(pendingDescribe)
+		case *dataRowMessage:
+			if front != nil && front.kind != pendingSync && front.firstRow.IsZero() {
+				front.firstRow = now
+			}
+		case *copyResponseMessage:
+			if front != nil && (front.kind == pendingExecute || front.kind == pendingStatement) {
+				front.copy = newCopyState(m, front.query, now)
+			}
+		case *copyDataMessage:
+			if front != nil && front.copy != nil {
+				front.copy.fromServer.add(m)
+			}
+		case *copyDoneMessage:
+			if front != nil && front.copy != nil {
+				front.copy.fromServer.end = now
+			}
+		case *emptyQueryResponseMessage, *portalSuspendedMessage:
+			// Neither empty query nor suspended portal are reported.
+			if front != nil && (front.kind == pendingExecute || front.kind == pendingStatement) {
+				s.pending = s.pending[1:]
+			}
+		case *commandCompleteMessage:
+			if front == nil || (front.kind != pendingExecute && front.kind != pendingStatement) {
+				continue
+			}
+			command, rows := parseCommandTag(m.tag)
+			s.registry.complete(command, front.query)
+			events = append(events, s.complete(&Query{Type: command, RowsAffected: rows}, now))
+		case *errorMessage:
+			if s.authenticating {
+				s.authenticating = false
+				events = append(events, &AuthenticationFailed{Session: s.info, Time: now, Method: s.authMethod, Error: m.fields})
+				continue
+			}
+			// Errors which aren't caused by requests, e.g. FATAL termination of the connection,
+			// arrive with nothing pending.
+			if front == nil || front.kind == pendingSync {
+				continue
+			}
+			events = append(events, s.complete(&Query{Error: m.message, PgError: m.fields, Rule: m.rule}, now))
+			// After an error backend discards all messages until Sync
+			// and skips the remaining statements of Query message.
+			for len(s.pending) > 0 && s.pending[0].kind != pendingSync {
+				s.pending = s.pending[1:]
+			}
+		case *noticeMessage:
+			// Notices are raised while a statement is being executed, so they belong
+			// to the oldest statement waiting for completion.
+			for _, state := range s.pending {
+				if state.kind == pendingSync {
+					break
+				}
+				if state.kind == pendingExecute || state.kind == pendingStatement {
+					state.notices = append(state.notices, m.fields)
+					break
+				}
+			}
+		case *readyForQueryMessage:
+			s.status = m.status
+			s.registry.readyForQuery(m)
+			// Drop everything up to the end of the completed batch.
+			for len(s.pending) > 0 {
+				kind := s.pending[0].kind
+				s.pending = s.pending[1:]
+				if kind == pendingSync {
+					break
+				}
+			}
+			if tx := s.transactions.readyForQuery(m.status, s.info, len(s.pending) == 0, now); tx != nil {
+				events = append(events, tx)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	for _, e := range events {
+		s.proxy.events.WriteEvent(e)
+	}
+}
+
+// protocolError reports that the stream sent by frontend or backend can't be observed anymore.
+func (s *session) protocolError(frontend bool, err error) {
+	s.proxy.events.WriteEvent(&ProtocolError{Session: s.snapshot(), Time: s.proxy.now(), Frontend: frontend, Err: err})
+}
+
+// snapshot returns the current connection metadata.
+func (s *session) snapshot() SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.info
+}
+
+// authenticationMethod returns the name of the authentication method requested by Authentication message
+// with the code. It returns an empty string for the codes which continue the authentication exchange.
+func authenticationMethod(code uint32) string {
+	switch code {
+	case authenticationKerberosV5:
+		return "krb5"
+	case authenticationCleartextPassword:
+		return "password"
+	case authenticationMD5Password:
+		return "md5"
+	case authenticationGSS:
+		return "gss"
+	case authenticationSSPI:
+		return "sspi"
+	case authenticationSASL:
+		// SCRAM-SHA-256 is the only SASL mechanism backend supports.
+		return "scram-sha-256"
+	}
+	return ""
+}
+
+// idle returns true if the connection is outside of a transaction and nothing is pending,
+// so closing it doesn't interrupt anything.
+func (s *session) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status == 'I' && len(s.pending) == 0
+}
+
+func (s *session) push(state *state) {
+	s.pending = append(s.pending, state)
+}
+
+// front returns the oldest pending state or nil if nothing is pending.
+func (s *session) front() *state {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	return s.pending[0]
+}
+
+// pop removes the oldest pending state if it is of the kind.
+func (s *session) pop(kind int) {
+	if front := s.front(); front != nil && front.kind == kind {
+		s.pending = s.pending[1:]
+	}
+}
+
+// complete removes the oldest pending state and fills q with its statement and timings.
+func (s *session) complete(q *Query, now time.Time) *Query {
+	current := s.pending[0]
+	s.pending = s.pending[1:]
+
+	q.Session = s.info
+	q.Query = current.query
+	q.Notices = current.notices
+	q.Time = current.begin
+	q.Duration = now.Sub(current.begin)
+	if !current.executed.IsZero() {
+		q.ExecDuration = now.Sub(current.executed)
+		if !current.firstRow.IsZero() {
+			q.TimeToFirstRow = current.firstRow.Sub(current.executed)
+		}
+	}
+	if current.portal != nil {
+		q.Params = decodeParams(current.portal.statement.oids, current.portal.bind)
+	}
+	if current.copy != nil {
+		q.Copy = s.copies.complete(current.copy, now)
+	}
+
+	s.transactions.query(q)
+
+	// The next statement of the same simple query starts right after completion of the current one.
+	if next := s.front(); next != nil && current.kind == pendingStatement && next.kind == pendingStatement {
+		next.begin = now
+		next.executed = now
+	}
+
+	return q
+}
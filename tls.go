@@ -0,0 +1,229 @@
+package postgresql
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// SSLMode tells whether and how Proxy encrypts connections to the target.
+// The modes follow sslmode of libpq, see https://www.postgresql.org/docs/current/libpq-ssl.html
+type SSLMode string
+
+const (
+	// SSLDisable connects to the target in plaintext.
+	SSLDisable SSLMode = "disable"
+	// SSLPrefer uses TLS if the target supports it and plaintext otherwise. The certificate isn't verified.
+	SSLPrefer SSLMode = "prefer"
+	// SSLRequire fails if the target doesn't support TLS. The certificate isn't verified.
+	SSLRequire SSLMode = "require"
+	// SSLVerifyCA requires TLS and verifies the certificate is signed by a trusted CA.
+	SSLVerifyCA SSLMode = "verify-ca"
+	// SSLVerifyFull requires TLS and verifies both the certificate and that it belongs to the target host.
+	SSLVerifyFull SSLMode = "verify-full"
+)
+
+// sslRequest is SSLRequest message.
+var sslRequest = []byte{0x00, 0x00, 0x00, 0x08, 0x04, 0xd2, 0x16, 0x2f}
+
+// alpnProtocol is the ALPN protocol of PostgreSQL. It's mandatory for direct TLS connections.
+const alpnProtocol = "postgresql"
+
+// tlsHandshakeRecord is the first byte of TLS ClientHello.
+const tlsHandshakeRecord = 0x16
+
+// errDirectTLSWithoutALPN is returned if the client starts TLS without SSLRequest,
+// but doesn't negotiate the postgresql ALPN protocol.
+var errDirectTLSWithoutALPN = errors.New("postgresql: direct TLS connection without postgresql ALPN protocol")
+
+// errTargetRefusedTLS is returned if the target doesn't support TLS required by SSLMode.
+var errTargetRefusedTLS = errors.New("postgresql: target refused TLS")
+
+// dialTarget connects to the target and negotiates TLS according to the mode set by Proxy.TargetTLS.
+func (p *Proxy) dialTarget(target string) (net.Conn, error) {
+	server, err := net.Dial("tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	if p.targetSSLMode == "" || p.targetSSLMode == SSLDisable {
+		return server, nil
+	}
+
+	tlsServer, err := p.negotiateTarget(server, target)
+	if err != nil {
+		_ = server.Close()
+		return nil, fmt.Errorf("postgresql.Proxy.dialTarget: %w", err)
+	}
+	return tlsServer, nil
+}
+
+// negotiateTarget sends SSLRequest to the target and starts TLS if the target accepts it.
+func (p *Proxy) negotiateTarget(server net.Conn, target string) (net.Conn, error) {
+	if _, err := server.Write(sslRequest); err != nil {
+		return nil, err
+	}
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(server, response); err != nil {
+		return nil, err
+	}
+
+	switch response[0] {
+	case 'S':
+	case 'N':
+		if p.targetSSLMode == SSLPrefer {
+			return server, nil
+		}
+		return nil, errTargetRefusedTLS
+	default:
+		// Servers which don't know SSLRequest respond with ErrorResponse.
+		return nil, fmt.Errorf("unexpected response %q to SSLRequest", response[0])
+	}
+
+	config, err := p.targetTLSConfig(target)
+	if err != nil {
+		return nil, err
+	}
+	tlsServer := tls.Client(server, config)
+	if err := tlsServer.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsServer, nil
+}
+
+// targetTLSConfig returns the config of TLS connections to the target for SSLMode.
+// The client certificate, the trusted CAs and the server name are taken from the config set by Proxy.TargetTLS.
+func (p *Proxy) targetTLSConfig(target string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if p.targetTLSBase != nil {
+		config = p.targetTLSBase.Clone()
+	}
+
+	switch p.targetSSLMode {
+	case SSLPrefer, SSLRequire:
+		config.InsecureSkipVerify = true
+	case SSLVerifyCA:
+		// crypto/tls verifies the host name along with the chain, so the chain is verified separately.
+		config.InsecureSkipVerify = true
+		roots := config.RootCAs
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("postgresql: target sent no certificate")
+			}
+			opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	case SSLVerifyFull:
+		if config.ServerName == "" {
+			host, _, err := net.SplitHostPort(target)
+			if err != nil {
+				return nil, err
+			}
+			config.ServerName = host
+		}
+	default:
+		return nil, fmt.Errorf("unknown SSLMode %q", p.targetSSLMode)
+	}
+	return config, nil
+}
+
+// negotiateClient handles encryption requests frontend starts the connection with.
+// If Proxy.TLS is set, SSLRequest is accepted and TLS is terminated with its config,
+// as well as TLS started directly without SSLRequest. Other encryption requests are refused.
+// It returns the connection the rest of the frontend stream must be read from,
+// which starts with StartupMessage or CancelRequest.
+func (p *Proxy) negotiateClient(client net.Conn) (net.Conn, error) {
+	r := bufio.NewReader(client)
+	buffered := &readerConn{Conn: client, r: r}
+
+	// Direct TLS connection starts with ClientHello, which is never a valid startup message.
+	if p.tlsConfig != nil {
+		b, err := r.Peek(1)
+		if err != nil {
+			return nil, fmt.Errorf("postgresql.Proxy.negotiateClient: %w", err)
+		}
+		if b[0] == tlsHandshakeRecord {
+			return p.handshakeClient(buffered, true)
+		}
+	}
+
+	for {
+		msg, err := readStartupMessage(r)
+		if err != nil {
+			return nil, fmt.Errorf("postgresql.Proxy.negotiateClient: %w", err)
+		}
+
+		switch {
+		case isSSLRequestMessage(msg) && p.tlsConfig != nil:
+			if _, err := client.Write([]byte{'S'}); err != nil {
+				return nil, fmt.Errorf("postgresql.Proxy.negotiateClient: %w", err)
+			}
+			return p.handshakeClient(buffered, false)
+		case isSSLRequestMessage(msg) || isGSSENCRequestMessage(msg):
+			// Frontend goes on with either SSLRequest or StartupMessage once encryption is refused.
+			if _, err := client.Write([]byte{'N'}); err != nil {
+				return nil, fmt.Errorf("postgresql.Proxy.negotiateClient: %w", err)
+			}
+		default:
+			// The message has to be read again by whoever reads the connection next.
+			return &readerConn{Conn: client, r: io.MultiReader(bytes.NewReader(msg), r)}, nil
+		}
+	}
+}
+
+// handshakeClient terminates TLS on the client connection. direct is true if the client
+// started TLS without SSLRequest, which is allowed only along with the postgresql ALPN protocol.
+func (p *Proxy) handshakeClient(client net.Conn, direct bool) (*tls.Conn, error) {
+	config := p.tlsConfig.Clone()
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{alpnProtocol}
+	}
+
+	tlsConn := tls.Server(client, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("postgresql.Proxy.handshakeClient: %w", err)
+	}
+	if direct && tlsConn.ConnectionState().NegotiatedProtocol != alpnProtocol {
+		return nil, fmt.Errorf("postgresql.Proxy.handshakeClient: %w", errDirectTLSWithoutALPN)
+	}
+	return tlsConn, nil
+}
+
+// readStartupMessage reads a single untyped message: StartupMessage, SSLRequest,
+// GSSENCRequest or CancelRequest.
+func readStartupMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	pktLen := binary.BigEndian.Uint32(header)
+	if pktLen < 8 || pktLen > maxStartupMessageLen {
+		return nil, errInvalidMessageLength
+	}
+	msg := make([]byte, pktLen)
+	copy(msg, header)
+	if _, err := io.ReadFull(r, msg[4:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// readerConn is a connection whose reads come from r, e.g. because its first bytes were already
+// read from the connection itself.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
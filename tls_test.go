@@ -0,0 +1,262 @@
+package postgresql
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestCertificate creates a self-signed certificate for localhost.
+func newTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func Test_Proxy_TLS(t *testing.T) {
+	cert := newTestCertificate(t)
+	backend := startTestBackend(t)
+
+	tests := []struct {
+		name string
+		// requests are the encryption requests the client sends before StartupMessage.
+		requests []string
+		// responses are the expected answers to the requests.
+		responses string
+		tls       bool
+	}{
+		{"Plaintext", nil, "", false},
+		{"SSLRequest", []string{"0000000804d2162f"}, "S", true},
+		{"GSSENCRequest_Then_SSLRequest", []string{"0000000804d21630", "0000000804d2162f"}, "NS", true},
+		{"GSSENCRequest_Then_Plaintext", []string{"0000000804d21630"}, "N", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := newEventRecorder()
+			proxy := NewEventProxy(recorder).To(backend.Addr().String()).TLS(&tls.Config{Certificates: []tls.Certificate{cert}})
+			addr, _ := startTestProxy(t, proxy)
+			defer proxy.Shutdown(context.Background())
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			for i, request := range tt.requests {
+				if _, err := conn.Write(decodeHexStream(t, request)); err != nil {
+					t.Fatal(err)
+				}
+				response := make([]byte, 1)
+				if _, err := io.ReadFull(conn, response); err != nil {
+					t.Fatal(err)
+				}
+				if response[0] != tt.responses[i] {
+					t.Fatalf("response to request %d = %q, want %q", i, response[0], tt.responses[i])
+				}
+			}
+			if tt.tls {
+				roots := x509.NewCertPool()
+				roots.AddCert(cert.Leaf)
+				conn = tls.Client(conn, &tls.Config{ServerName: "localhost", RootCAs: roots})
+			}
+
+			// StartupMessage, then AuthenticationOk and ReadyForQuery from backend.
+			if _, err := conn.Write(decodeHexStream(t, "0000001b0003000075736572007500646174616261736500640000")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(conn, make([]byte, 15)); err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.Close()
+
+			closed := recorder.waitClosed(t)
+			if closed.Session.User != "u" || closed.Err != nil {
+				t.Errorf("Session = %+v, Err = %v", closed.Session, closed.Err)
+			}
+		})
+	}
+}
+
+// startTestTLSBackend starts a backend which expects SSLRequest. If config is nil, it refuses TLS,
+// otherwise it terminates TLS with config. Then it behaves as the backend of startTestBackend.
+func startTestTLSBackend(t *testing.T, config *tls.Config) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if _, err := io.ReadFull(conn, make([]byte, 8)); err != nil {
+					_ = conn.Close()
+					return
+				}
+				if config == nil {
+					_, _ = conn.Write([]byte{'N'})
+					serveTestBackend(t, conn)
+					return
+				}
+				_, _ = conn.Write([]byte{'S'})
+				serveTestBackend(t, tls.Server(conn, config))
+			}()
+		}
+	}()
+	t.Cleanup(func() { _ = l.Close() })
+	return l
+}
+
+func Test_Proxy_TargetTLS(t *testing.T) {
+	serverCert := newTestCertificate(t)
+	clientCert := newTestCertificate(t)
+	trusted := x509.NewCertPool()
+	trusted.AddCert(serverCert.Leaf)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert.Leaf)
+
+	plaintext := startTestTLSBackend(t, nil)
+	encrypted := startTestTLSBackend(t, &tls.Config{Certificates: []tls.Certificate{serverCert}})
+	mutual := startTestTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		// Client learns that its certificate is rejected after the handshake in TLS 1.3.
+		MaxVersion: tls.VersionTLS12,
+	})
+
+	tests := []struct {
+		name    string
+		backend net.Listener
+		mode    SSLMode
+		config  *tls.Config
+		wantErr bool
+	}{
+		{"Prefer_Plaintext", plaintext, SSLPrefer, nil, false},
+		{"Prefer_Encrypted", encrypted, SSLPrefer, nil, false},
+		{"Require_Plaintext", plaintext, SSLRequire, nil, true},
+		{"Require_Untrusted", encrypted, SSLRequire, nil, false},
+		{"VerifyCA_Untrusted", encrypted, SSLVerifyCA, &tls.Config{RootCAs: x509.NewCertPool()}, true},
+		{"VerifyCA_Other_Host", encrypted, SSLVerifyCA, &tls.Config{RootCAs: trusted, ServerName: "example.com"}, false},
+		{"VerifyFull_Other_Host", encrypted, SSLVerifyFull, &tls.Config{RootCAs: trusted, ServerName: "example.com"}, true},
+		{"VerifyFull_Target_Host", encrypted, SSLVerifyFull, &tls.Config{RootCAs: trusted}, false},
+		{"VerifyFull_Without_Client_Certificate", mutual, SSLVerifyFull, &tls.Config{RootCAs: trusted}, true},
+		{"VerifyFull_Client_Certificate", mutual, SSLVerifyFull, &tls.Config{RootCAs: trusted, Certificates: []tls.Certificate{clientCert}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := newEventRecorder()
+			proxy := NewEventProxy(recorder).To(tt.backend.Addr().String()).TargetTLS(tt.mode, tt.config)
+			addr, _ := startTestProxy(t, proxy)
+			defer proxy.Shutdown(context.Background())
+
+			client := connectTestClient(t, addr, !tt.wantErr)
+			_ = client.Close()
+
+			closed := recorder.waitClosed(t)
+			if tt.wantErr {
+				if closed.Reason != CloseByDialFailure {
+					t.Errorf("Reason = %q, want %q", closed.Reason, CloseByDialFailure)
+				}
+				return
+			}
+			if closed.Reason != CloseByClient || closed.Err != nil || closed.Session.User != "u" {
+				t.Errorf("Reason = %q, Err = %v, Session = %+v", closed.Reason, closed.Err, closed.Session)
+			}
+		})
+	}
+}
+
+func Test_Proxy_Direct_TLS(t *testing.T) {
+	cert := newTestCertificate(t)
+	backend := startTestBackend(t)
+	// The address of the closed listener refuses connections, which reveals the target the client was routed to.
+	refused := startTestBackend(t)
+	_ = refused.Close()
+
+	tests := []struct {
+		name       string
+		nextProtos []string
+		serverName string
+		wantErr    error
+		wantTarget string
+	}{
+		{"ALPN", []string{"postgresql"}, "localhost", nil, ""},
+		{"Without_ALPN", nil, "localhost", errDirectTLSWithoutALPN, ""},
+		{"Routed_By_SNI", []string{"postgresql"}, "Refused.Example.com", nil, refused.Addr().String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := newEventRecorder()
+			proxy := NewEventProxy(recorder).
+				To(backend.Addr().String()).
+				TLS(&tls.Config{Certificates: []tls.Certificate{cert}}).
+				Route("refused.example.com", refused.Addr().String())
+			addr, _ := startTestProxy(t, proxy)
+			defer proxy.Shutdown(context.Background())
+
+			conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: tt.serverName, NextProtos: tt.nextProtos, InsecureSkipVerify: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write(decodeHexStream(t, "0000001b0003000075736572007500646174616261736500640000")); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr == nil && tt.wantTarget == "" {
+				if _, err := io.ReadFull(conn, make([]byte, 15)); err != nil {
+					t.Fatal(err)
+				}
+				_ = conn.Close()
+			}
+
+			closed := recorder.waitClosed(t)
+			if tt.wantTarget == "" {
+				if !errors.Is(closed.Err, tt.wantErr) {
+					t.Errorf("Err = %v, want %v", closed.Err, tt.wantErr)
+				}
+				return
+			}
+			if closed.Reason != CloseByDialFailure {
+				t.Fatalf("Reason = %q, want %q", closed.Reason, CloseByDialFailure)
+			}
+			if failed := recorder.events[1].(*DialFailed); failed.Target != tt.wantTarget {
+				t.Errorf("Target = %q, want %q", failed.Target, tt.wantTarget)
+			}
+		})
+	}
+}
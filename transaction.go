@@ -0,0 +1,135 @@
+package postgresql
+
+import "time"
+
+// TransactionWriter is implemented by a QueryWriter which also wants to receive completed transactions.
+type TransactionWriter interface {
+	WriteTransaction(tx *Transaction)
+}
+
+// TransactionOutcome tells how a transaction ended.
+type TransactionOutcome string
+
+const (
+	// TransactionCommitted means the transaction was committed.
+	TransactionCommitted TransactionOutcome = "commit"
+	// TransactionRolledBack means the transaction was rolled back without an error.
+	TransactionRolledBack TransactionOutcome = "rollback"
+	// TransactionFailed means a statement of the transaction failed and the transaction was rolled back.
+	TransactionFailed TransactionOutcome = "failed"
+)
+
+// Transaction describes an explicit transaction block executed by backend.
+// Boundaries of the block come from the transaction status backend reports in ReadyForQuery:
+// the block begins once the status leaves idle ('I') and ends once it returns there.
+type Transaction struct {
+	// Session describes the connection the transaction was executed on.
+	Session SessionInfo
+	// Queries are the statements of the transaction including the ones which began and ended it.
+	Queries []*Query
+	// Begin is the moment the first statement of the transaction arrived from frontend.
+	Begin time.Time
+	// End is the moment backend reported the transaction is over.
+	End time.Time
+	// Duration is the time passed from Begin till End.
+	Duration time.Duration
+	// IdleDuration is the time backend spent inside the transaction waiting for frontend,
+	// i.e. the state pg_stat_activity reports as "idle in transaction".
+	IdleDuration time.Duration
+	Outcome      TransactionOutcome
+}
+
+// transactionTracker builds Transaction from the queries completed on a connection
+// and the transaction status of each ReadyForQuery.
+type transactionTracker struct {
+	// batch are the queries completed since the last ReadyForQuery.
+	batch []*Query
+	// current is the open transaction or nil if the connection is outside of a transaction block.
+	current *Transaction
+	// failed is true if the open transaction is in the failed state. It's cleared once
+	// ROLLBACK TO SAVEPOINT recovers the transaction.
+	failed bool
+	// idleSince is the moment backend became idle inside the open transaction,
+	// it's zero while frontend has requests in progress.
+	idleSince time.Time
+}
+
+// query records a completed query.
+func (t *transactionTracker) query(q *Query) {
+	t.batch = append(t.batch, q)
+}
+
+// request records that frontend sent a message, which ends idling inside the transaction.
+func (t *transactionTracker) request(now time.Time) {
+	if t.current != nil && !t.idleSince.IsZero() {
+		t.current.IdleDuration += now.Sub(t.idleSince)
+		t.idleSince = time.Time{}
+	}
+}
+
+// readyForQuery applies the transaction status of ReadyForQuery. idle tells whether
+// frontend has nothing more in flight, so backend starts waiting for it.
+// It returns the transaction if the status ends it.
+func (t *transactionTracker) readyForQuery(status byte, info SessionInfo, idle bool, now time.Time) *Transaction {
+	batch := t.batch
+	t.batch = nil
+
+	switch status {
+	case 'T', 'E':
+		if t.current == nil {
+			t.current = &Transaction{Begin: now}
+			if len(batch) > 0 {
+				t.current.Begin = batch[0].Time
+			}
+		}
+		t.current.Queries = append(t.current.Queries, batch...)
+		t.failed = status == 'E'
+		if idle {
+			t.idleSince = now
+		}
+		return nil
+	case 'I':
+		if t.current == nil {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	tx := t.current
+	tx.Queries = append(tx.Queries, batch...)
+	tx.Session = info
+	tx.End = now
+	tx.Duration = now.Sub(tx.Begin)
+	tx.Outcome = transactionOutcome(t.failed, batch)
+	t.current = nil
+	t.failed = false
+	t.idleSince = time.Time{}
+	return tx
+}
+
+// transactionOutcome decides how the transaction ended from its state before the last batch
+// and the statements of the batch which ended it.
+func transactionOutcome(failed bool, batch []*Query) TransactionOutcome {
+	for _, q := range batch {
+		// E.g. COMMIT failed on a deferred constraint.
+		if q.PgError != nil {
+			return TransactionFailed
+		}
+	}
+	var last string
+	if len(batch) > 0 {
+		last = batch[len(batch)-1].Type
+	}
+	switch {
+	case last == "COMMIT":
+		// Backend reports COMMIT of a failed transaction as ROLLBACK, so the batch recovered it,
+		// e.g. "ROLLBACK TO s; COMMIT".
+		return TransactionCommitted
+	case failed:
+		return TransactionFailed
+	case last == "ROLLBACK":
+		return TransactionRolledBack
+	}
+	return TransactionCommitted
+}
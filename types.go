@@ -0,0 +1,298 @@
+package postgresql
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// postgresEpoch is the zero point of binary date and timestamp values.
+var postgresEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// arrayElements maps OIDs of the supported array types to OIDs of their elements.
+var arrayElements = map[oid]oid{
+	oidJsonArray:        oidJson,
+	oidBoolArray:        oidBool,
+	oidByteaArray:       oidBytea,
+	oidInt2Array:        oidInt2,
+	oidInt4Array:        oidInt4,
+	oidTextArray:        oidText,
+	oidBpcharArray:      oidBpchar,
+	oidVarcharArray:     oidVarchar,
+	oidInt8Array:        oidInt8,
+	oidFloat4Array:      oidFloat4,
+	oidFloat8Array:      oidFloat8,
+	oidOidArray:         oidOid,
+	oidTimestampArray:   oidTimestamp,
+	oidDateArray:        oidDate,
+	oidTimestamptzArray: oidTimestamptz,
+	oidNumericArray:     oidNumeric,
+	oidUUIDArray:        oidUUID,
+	oidJsonbArray:       oidJsonb,
+}
+
+// decodeParams decodes values of Bind message into readable Go values using parameters types
+// specified in Parse message. Values of unspecified types in binary format are left as []byte,
+// values in text format are returned as strings. NULL is decoded as nil.
+func decodeParams(oids []oid, b *bindMessage) []interface{} {
+	params := make([]interface{}, len(b.values))
+	for i, value := range b.values {
+		if value == nil {
+			continue
+		}
+
+		// Zero format codes mean that all parameters use text format,
+		// one format code is applied to all parameters.
+		f := formatText
+		switch {
+		case len(b.formats) == 1:
+			f = b.formats[0]
+		case i < len(b.formats):
+			f = b.formats[i]
+		}
+
+		t := oidUnspecified
+		if i < len(oids) {
+			t = oids[i]
+		}
+
+		param, err := decodeParam(t, f, value)
+		if err != nil {
+			params[i] = value
+			continue
+		}
+		params[i] = param
+	}
+	return params
+}
+
+// decodeParam decodes a single non NULL parameter value of type t in format f.
+func decodeParam(t oid, f format, value []byte) (interface{}, error) {
+	if f == formatText {
+		return string(value), nil
+	}
+	if f != formatBinary {
+		return nil, fmt.Errorf("decodeParam: unknown format %d", f)
+	}
+
+	if elem, ok := arrayElements[t]; ok {
+		return decodeBinaryArray(elem, value)
+	}
+	return decodeBinaryValue(t, value)
+}
+
+func decodeBinaryValue(t oid, value []byte) (interface{}, error) {
+	switch t {
+	case oidBool:
+		if len(value) != 1 {
+			return nil, errors.New("decodeBinaryValue: invalid bool length")
+		}
+		return value[0] != 0, nil
+	case oidInt2:
+		if len(value) != 2 {
+			return nil, errors.New("decodeBinaryValue: invalid int2 length")
+		}
+		return int16(binary.BigEndian.Uint16(value)), nil
+	case oidInt4:
+		if len(value) != 4 {
+			return nil, errors.New("decodeBinaryValue: invalid int4 length")
+		}
+		return int32(binary.BigEndian.Uint32(value)), nil
+	case oidOid:
+		if len(value) != 4 {
+			return nil, errors.New("decodeBinaryValue: invalid oid length")
+		}
+		return binary.BigEndian.Uint32(value), nil
+	case oidInt8:
+		if len(value) != 8 {
+			return nil, errors.New("decodeBinaryValue: invalid int8 length")
+		}
+		return int64(binary.BigEndian.Uint64(value)), nil
+	case oidFloat4:
+		if len(value) != 4 {
+			return nil, errors.New("decodeBinaryValue: invalid float4 length")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(value)), nil
+	case oidFloat8:
+		if len(value) != 8 {
+			return nil, errors.New("decodeBinaryValue: invalid float8 length")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(value)), nil
+	case oidText, oidVarchar, oidBpchar, oidName, oidChar, oidUnknown, oidJson:
+		return string(value), nil
+	case oidJsonb:
+		// Binary jsonb is the version number followed by the text representation.
+		if len(value) < 1 || value[0] != 1 {
+			return nil, errors.New("decodeBinaryValue: unsupported jsonb version")
+		}
+		return string(value[1:]), nil
+	case oidBytea:
+		return value, nil
+	case oidUUID:
+		if len(value) != 16 {
+			return nil, errors.New("decodeBinaryValue: invalid uuid length")
+		}
+		s := hex.EncodeToString(value)
+		return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32], nil
+	case oidDate:
+		if len(value) != 4 {
+			return nil, errors.New("decodeBinaryValue: invalid date length")
+		}
+		days := int32(binary.BigEndian.Uint32(value))
+		switch days {
+		case math.MaxInt32:
+			return "infinity", nil
+		case math.MinInt32:
+			return "-infinity", nil
+		}
+		return postgresEpoch.AddDate(0, 0, int(days)), nil
+	case oidTimestamp, oidTimestamptz:
+		if len(value) != 8 {
+			return nil, errors.New("decodeBinaryValue: invalid timestamp length")
+		}
+		microseconds := int64(binary.BigEndian.Uint64(value))
+		switch microseconds {
+		case math.MaxInt64:
+			return "infinity", nil
+		case math.MinInt64:
+			return "-infinity", nil
+		}
+		// time.Duration overflows about 292 years away from the epoch, so the seconds are counted
+		// from the Unix epoch instead. The remainder is kept non-negative for the values before the epoch.
+		seconds, remainder := microseconds/1000000, microseconds%1000000
+		if remainder < 0 {
+			seconds--
+			remainder += 1000000
+		}
+		return time.Unix(postgresEpoch.Unix()+seconds, remainder*1000).UTC(), nil
+	case oidNumeric:
+		return decodeBinaryNumeric(value)
+	}
+	return nil, fmt.Errorf("decodeBinaryValue: unsupported type %d", t)
+}
+
+// decodeBinaryNumeric decodes numeric value into its decimal string representation.
+// Binary numeric consists of the number of base 10000 digits, the weight of the first digit,
+// the sign, the display scale and the digits themselves.
+func decodeBinaryNumeric(value []byte) (string, error) {
+	const (
+		numericPos  = 0x0000
+		numericNeg  = 0x4000
+		numericNaN  = 0xc000
+		numericPInf = 0xd000
+		numericNInf = 0xf000
+	)
+
+	if len(value) < 8 {
+		return "", errors.New("decodeBinaryNumeric: invalid numeric length")
+	}
+	ndigits := int(binary.BigEndian.Uint16(value[0:2]))
+	weight := int(int16(binary.BigEndian.Uint16(value[2:4])))
+	sign := binary.BigEndian.Uint16(value[4:6])
+	dscale := int(binary.BigEndian.Uint16(value[6:8]))
+	if len(value) != 8+ndigits*2 {
+		return "", errors.New("decodeBinaryNumeric: invalid numeric length")
+	}
+
+	switch sign {
+	case numericNaN:
+		return "NaN", nil
+	case numericPInf:
+		return "Infinity", nil
+	case numericNInf:
+		return "-Infinity", nil
+	case numericPos, numericNeg:
+	default:
+		return "", fmt.Errorf("decodeBinaryNumeric: invalid sign %x", sign)
+	}
+
+	digits := make([]int, ndigits)
+	for i := range digits {
+		digits[i] = int(binary.BigEndian.Uint16(value[8+i*2:]))
+	}
+	digit := func(i int) int {
+		if i < 0 || i >= len(digits) {
+			return 0
+		}
+		return digits[i]
+	}
+
+	var sb strings.Builder
+	if sign == numericNeg {
+		sb.WriteByte('-')
+	}
+
+	// Integer part: digits with weight from max(weight, 0) down to 0.
+	if weight < 0 {
+		sb.WriteByte('0')
+	} else {
+		sb.WriteString(strconv.Itoa(digit(0)))
+		for i := 1; i <= weight; i++ {
+			sb.WriteString(fmt.Sprintf("%04d", digit(i)))
+		}
+	}
+
+	// Fractional part: display scale decimal digits following the integer part.
+	if dscale > 0 {
+		var frac strings.Builder
+		for i := weight + 1; frac.Len() < dscale; i++ {
+			frac.WriteString(fmt.Sprintf("%04d", digit(i)))
+		}
+		sb.WriteByte('.')
+		sb.WriteString(frac.String()[:dscale])
+	}
+
+	return sb.String(), nil
+}
+
+// decodeBinaryArray decodes one-dimensional array of elements of type elem.
+// Binary array consists of the number of dimensions, the flag of NULL presence, the element type,
+// the size and the lower bound of each dimension and the elements prefixed with their lengths.
+func decodeBinaryArray(elem oid, value []byte) ([]interface{}, error) {
+	if len(value) < 12 {
+		return nil, errors.New("decodeBinaryArray: invalid array length")
+	}
+	ndim := int32(binary.BigEndian.Uint32(value[0:4]))
+	if ndim == 0 {
+		return []interface{}{}, nil
+	}
+	if ndim != 1 {
+		return nil, fmt.Errorf("decodeBinaryArray: unsupported number of dimensions %d", ndim)
+	}
+	if len(value) < 20 {
+		return nil, errors.New("decodeBinaryArray: invalid array length")
+	}
+	size := int32(binary.BigEndian.Uint32(value[12:16]))
+	if size < 0 || int(size) > (len(value)-20)/4 {
+		return nil, fmt.Errorf("decodeBinaryArray: invalid dimension size %d", size)
+	}
+
+	elements := make([]interface{}, size)
+	offset := 20
+	for i := range elements {
+		if len(value[offset:]) < 4 {
+			return nil, errors.New("decodeBinaryArray: invalid element length")
+		}
+		elemLen := int32(binary.BigEndian.Uint32(value[offset:]))
+		offset += 4
+		if elemLen == -1 {
+			continue
+		}
+		if elemLen < 0 || int(elemLen) > len(value[offset:]) {
+			return nil, errors.New("decodeBinaryArray: invalid element length")
+		}
+		element, err := decodeBinaryValue(elem, value[offset:offset+int(elemLen)])
+		if err != nil {
+			return nil, err
+		}
+		elements[i] = element
+		offset += int(elemLen)
+	}
+
+	return elements, nil
+}
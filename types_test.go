@@ -0,0 +1,76 @@
+package postgresql
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_decodeParam(t *testing.T) {
+	tests := []struct {
+		name    string
+		oid     oid
+		format  format
+		value   string
+		want    interface{}
+		wantErr bool
+	}{
+		{"Text_Format", oidInt8, formatText, "313233", "123", false},
+		{"Bool", oidBool, formatBinary, "01", true, false},
+		{"Int2", oidInt2, formatBinary, "fffe", int16(-2), false},
+		{"Int4", oidInt4, formatBinary, "000003eb", int32(1003), false},
+		{"Int8", oidInt8, formatBinary, "000000000000007b", int64(123), false},
+		{"Float4", oidFloat4, formatBinary, "3fc00000", float32(1.5), false},
+		{"Float8", oidFloat8, formatBinary, "c002000000000000", float64(-2.25), false},
+		{"Varchar", oidVarchar, formatBinary, "616263", "abc", false},
+		{"Bytea", oidBytea, formatBinary, "00ff", []byte{0x00, 0xff}, false},
+		{"UUID", oidUUID, formatBinary, "a0eebc999c0b4ef8bb6d6bb9bd380a11", "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11", false},
+		{"Date", oidDate, formatBinary, "00001d1f", time.Date(2020, 5, 30, 0, 0, 0, 0, time.UTC), false},
+		{"Date_Infinity", oidDate, formatBinary, "7fffffff", "infinity", false},
+		{"Timestamp", oidTimestamp, formatBinary, "000249db11e7f120", time.Date(2020, 5, 30, 12, 0, 0, 500000000, time.UTC), false},
+		{"Timestamptz", oidTimestamptz, formatBinary, "000249db11e7f120", time.Date(2020, 5, 30, 12, 0, 0, 500000000, time.UTC), false},
+		{"Timestamp_Year_1", oidTimestamp, formatBinary, "ff1fe2ffc59c6000", time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC), false},
+		{"Timestamp_Year_9999", oidTimestamp, formatBinary, "0380e70b913b7fff", time.Date(9999, 12, 31, 23, 59, 59, 999999000, time.UTC), false},
+		{"Timestamptz_Before_Epoch", oidTimestamptz, formatBinary, "fffffffffff85ee0", time.Date(1999, 12, 31, 23, 59, 59, 500000000, time.UTC), false},
+		{"Numeric", oidNumeric, formatBinary, "0002000000000002007b1194", "123.45", false},
+		{"Numeric_Negative_Fraction", oidNumeric, formatBinary, "0001ffff40000003000a", "-0.001", false},
+		{"Numeric_Weight", oidNumeric, formatBinary, "00010001000000000001", "10000", false},
+		{"Numeric_NaN", oidNumeric, formatBinary, "00000000c0000000", "NaN", false},
+		{"Json", oidJson, formatBinary, "7b7d", "{}", false},
+		{"Jsonb", oidJsonb, formatBinary, "015b2278225d", `["x"]`, false},
+		{"Int4_Array", oidInt4Array, formatBinary, "00000001000000010000001700000003000000010000000400000001ffffffff0000000400000003", []interface{}{int32(1), nil, int32(3)}, false},
+		{"Empty_Text_Array", oidTextArray, formatBinary, "000000000000000000000019", []interface{}{}, false},
+		{"Invalid_Int4", oidInt4, formatBinary, "0001", nil, true},
+		{"Unspecified_Type", oidUnspecified, formatBinary, "0001", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeParam(tt.oid, tt.format, decodeHexStream(t, tt.value))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("decodeParam() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeParam() got = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_decodeParams(t *testing.T) {
+	b, err := decodeBindMessage(decodeHexStream(t, "420000001a0000000100010002ffffffff00000004000000070000"))
+	if err != nil {
+		t.Fatalf("decodeBindMessage() error = %v", err)
+	}
+
+	// The second parameter type is unspecified, so its value is left as is.
+	want := []interface{}{nil, []byte{0, 0, 0, 7}}
+	if got := decodeParams([]oid{oidInt4}, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("decodeParams() got = %#v, want %#v", got, want)
+	}
+
+	want = []interface{}{nil, int32(7)}
+	if got := decodeParams([]oid{oidInt4, oidInt4}, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("decodeParams() got = %#v, want %#v", got, want)
+	}
+}
@@ -2,6 +2,7 @@ package postgresql
 
 import (
 	"bytes"
+	"strings"
 )
 
 func readNullTerminatedString(r *bytes.Reader) string {
@@ -20,6 +21,109 @@ func readNullTerminatedString(r *bytes.Reader) string {
 	}
 }
 
-func skipNullTerminatedString(r *bytes.Reader) () {
-	_ = readNullTerminatedString(r)
+// splitStatements splits simple query string into separate statements the same way
+// backend does it: by semicolons which are not inside of string literals, quoted identifiers,
+// dollar-quoted strings or comments. Statements consisting only of whitespace and comments are omitted
+// because backend doesn't respond to them.
+func splitStatements(query string) []string {
+	var statements []string
+
+	start := 0
+	empty := true
+	flush := func(end int) {
+		if !empty {
+			statements = append(statements, strings.TrimSpace(query[start:end]))
+		}
+		start = end + 1
+		empty = true
+	}
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == ';':
+			flush(i)
+		case c == '-' && i+1 < len(query) && query[i+1] == '-':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			// Block comments may be nested.
+			depth := 0
+			for ; i+1 < len(query); i++ {
+				if query[i] == '/' && query[i+1] == '*' {
+					depth++
+					i++
+				} else if query[i] == '*' && query[i+1] == '/' {
+					depth--
+					i++
+					if depth == 0 {
+						break
+					}
+				}
+			}
+		case c == '\'':
+			// Backslash escapes are recognized only in escape string constants: E'...'.
+			escapes := i > 0 && (query[i-1] == 'E' || query[i-1] == 'e')
+			i = skipQuoted(query, i, '\'', escapes)
+			empty = false
+		case c == '"':
+			i = skipQuoted(query, i, '"', false)
+			empty = false
+		case c == '$':
+			if tag := dollarQuoteTag(query[i:]); tag != "" {
+				if end := strings.Index(query[i+len(tag):], tag); end >= 0 {
+					i += len(tag) + end + len(tag) - 1
+				} else {
+					i = len(query)
+				}
+			}
+			empty = false
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+		default:
+			empty = false
+		}
+	}
+	flush(len(query))
+
+	return statements
+}
+
+// skipQuoted returns index of the closing quote for the quoted token started at the position start.
+// Doubled quotes inside of the token are treated as escaped ones.
+func skipQuoted(query string, start int, quote byte, backslashEscapes bool) int {
+	for i := start + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if backslashEscapes {
+				i++
+			}
+		case quote:
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i
+		}
+	}
+	return len(query)
+}
+
+// dollarQuoteTag returns the opening tag ($$ or $tag$) of dollar-quoted string
+// if s starts with it and empty string otherwise.
+func dollarQuoteTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if c == '$' {
+			return s[:i+1]
+		}
+		isLetter := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+		isDigit := c >= '0' && c <= '9'
+		// Tag follows the same rules as an unquoted identifier, so it can't start with a digit.
+		// $1 is a positional parameter.
+		if !isLetter && !(isDigit && i > 1) {
+			return ""
+		}
+	}
+	return ""
 }
@@ -0,0 +1,34 @@
+package postgresql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_splitStatements(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"Single_Statement", "SELECT 1", []string{"SELECT 1"}},
+		{"Trailing_Semicolon", "SELECT 1;", []string{"SELECT 1"}},
+		{"Multiple_Statements", "BEGIN; SELECT 1;\nCOMMIT;", []string{"BEGIN", "SELECT 1", "COMMIT"}},
+		{"Empty_Statements", " ; ;SELECT 1;; ", []string{"SELECT 1"}},
+		{"Empty_Query", "", nil},
+		{"Comments_Only", "SELECT 1; -- comment;\n /* another; */", []string{"SELECT 1"}},
+		{"Nested_Block_Comment", "SELECT /* a /* b; */ c; */ 1; SELECT 2", []string{"SELECT /* a /* b; */ c; */ 1", "SELECT 2"}},
+		{"String_Literal", "SELECT 'a;''b'; SELECT 2", []string{"SELECT 'a;''b'", "SELECT 2"}},
+		{"Escape_String_Literal", `SELECT E'a\';b'; SELECT 2`, []string{`SELECT E'a\';b'`, "SELECT 2"}},
+		{"Quoted_Identifier", `SELECT 1 AS "a;b"; SELECT 2`, []string{`SELECT 1 AS "a;b"`, "SELECT 2"}},
+		{"Dollar_Quoted_String", "DO $$BEGIN PERFORM 1; END$$; SELECT 2", []string{"DO $$BEGIN PERFORM 1; END$$", "SELECT 2"}},
+		{"Tagged_Dollar_Quoted_String", "SELECT $fn$ $$; $fn$; SELECT $1", []string{"SELECT $fn$ $$; $fn$", "SELECT $1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitStatements(tt.query); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitStatements() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}